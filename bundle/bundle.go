@@ -0,0 +1,204 @@
+// Package bundle signs serialized promise trees and verifies
+// them against the keys of trusted publishers.
+package bundle
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/pem"
+	"io/ioutil"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/juju/errors"
+)
+
+////////////////////////////////////////////////////////////////////////////////
+// Envelope is a serialized promise tree together with the servers it is
+// meant for and the time it may be evaluated until. The signature covers
+// all of it, so a signed tree cannot be sent to other servers or after
+// it expired. Targets are host names or shell patterns, eg. *.internal.
+type Envelope struct {
+	Data     []byte
+	Targets  []string
+	NotAfter time.Time
+}
+
+// digest returns the sha256 digest of e, every field length prefixed.
+func (e Envelope) digest() []byte {
+	h := sha256.New()
+	field := func(b []byte) {
+		binary.Write(h, binary.BigEndian, uint64(len(b)))
+		h.Write(b)
+	}
+
+	field([]byte("llconf envelope v1"))
+	field(e.Data)
+	binary.Write(h, binary.BigEndian, uint64(len(e.Targets)))
+	for _, target := range e.Targets {
+		field([]byte(target))
+	}
+	binary.Write(h, binary.BigEndian, e.NotAfter.Unix())
+
+	return h.Sum(nil)
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// Check returns an error if e expired at now or none of its targets
+// matches one of names.
+func (e Envelope) Check(names []string, now time.Time) error {
+	if e.NotAfter.IsZero() {
+		return errors.New("bundle has no expiry")
+	}
+	if now.After(e.NotAfter) {
+		return errors.Errorf("bundle expired at %s", e.NotAfter.Format(time.RFC3339))
+	}
+
+	for _, target := range e.Targets {
+		for _, name := range names {
+			if ok, _ := path.Match(strings.ToLower(target), strings.ToLower(name)); ok {
+				return nil
+			}
+		}
+	}
+
+	return errors.Errorf("bundle is meant for %s, not %s",
+		strings.Join(e.Targets, ", "), strings.Join(names, ", "))
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// Bundle is a signed envelope, as written to disk.
+type Bundle struct {
+	Envelope
+	Signature []byte
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// Sign returns the signature of e made with key.
+func Sign(e Envelope, key *rsa.PrivateKey) ([]byte, error) {
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, e.digest())
+	if err != nil {
+		return nil, errors.Annotate(err, "sign")
+	}
+
+	return sig, nil
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// Verify returns the id of the publisher whose key signature was made
+// with, or an error if none of keys verifies it.
+func Verify(e Envelope, signature []byte, keys map[string]*rsa.PublicKey) (string, error) {
+	if len(signature) == 0 {
+		return "", errors.New("bundle is not signed")
+	}
+
+	ids := []string{}
+	for id := range keys {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	digest := e.digest()
+	for _, id := range ids {
+		if err := rsa.VerifyPKCS1v15(keys[id], crypto.SHA256, digest, signature); err == nil {
+			return id, nil
+		}
+	}
+
+	return "", errors.New("bundle signature does not match any trusted publisher")
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// PublicKey returns the RSA public key of a PEM encoded
+// certificate or public key.
+func PublicKey(data []byte) (*rsa.PublicKey, error) {
+	for {
+		var block *pem.Block
+		if block, data = pem.Decode(data); block == nil {
+			break
+		}
+
+		var key interface{}
+		switch block.Type {
+		case "CERTIFICATE":
+			cert, err := x509.ParseCertificate(block.Bytes)
+			if err != nil {
+				return nil, errors.Annotate(err, "parse certificate")
+			}
+			key = cert.PublicKey
+		case "PUBLIC KEY":
+			pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+			if err != nil {
+				return nil, errors.Annotate(err, "parse public key")
+			}
+			key = pub
+		case "RSA PUBLIC KEY":
+			pub, err := x509.ParsePKCS1PublicKey(block.Bytes)
+			if err != nil {
+				return nil, errors.Annotate(err, "parse public key")
+			}
+			key = pub
+		default:
+			continue
+		}
+
+		if pub, ok := key.(*rsa.PublicKey); ok {
+			return pub, nil
+		}
+		return nil, errors.New("only rsa keys are supported")
+	}
+
+	return nil, errors.New("no certificate or public key found")
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// New returns e signed with key.
+func New(e Envelope, key *rsa.PrivateKey) (Bundle, error) {
+	sig, err := Sign(e, key)
+	if err != nil {
+		return Bundle{}, errors.Annotate(err, "sign")
+	}
+
+	return Bundle{Envelope: e, Signature: sig}, nil
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// Write writes b to path.
+func (b Bundle) Write(path string) error {
+	buf := bytes.Buffer{}
+	if err := gob.NewEncoder(&buf).Encode(b); err != nil {
+		return errors.Annotate(err, "encode")
+	}
+
+	return ioutil.WriteFile(path, buf.Bytes(), 0644)
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// Read reads the bundle at path and returns its envelope and publisher,
+// if it is signed by one of keys.
+func Read(path string, keys map[string]*rsa.PublicKey) (Envelope, string, error) {
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return Envelope{}, "", errors.Annotate(err, "read file")
+	}
+
+	b := Bundle{}
+	if err := gob.NewDecoder(bytes.NewBuffer(raw)).Decode(&b); err != nil {
+		return Envelope{}, "", errors.Annotate(err, "decode")
+	}
+
+	publisher, err := Verify(b.Envelope, b.Signature, keys)
+	if err != nil {
+		return Envelope{}, "", err
+	}
+
+	return b.Envelope, publisher, nil
+}
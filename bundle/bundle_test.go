@@ -0,0 +1,137 @@
+package bundle
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newKey(t *testing.T) *rsa.PrivateKey {
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func TestSignVerify(t *testing.T) {
+	alice, bob := newKey(t), newKey(t)
+	keys := map[string]*rsa.PublicKey{"alice": &alice.PublicKey}
+
+	e := Envelope{
+		Data:     []byte("serialized promise tree"),
+		Targets:  []string{"web1.internal"},
+		NotAfter: time.Now().Add(time.Hour),
+	}
+	sig, err := Sign(e, alice)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	publisher, err := Verify(e, sig, keys)
+	if err != nil {
+		t.Fatalf("verify: %s", err)
+	}
+	if publisher != "alice" {
+		t.Errorf("expected publisher alice, got %q", publisher)
+	}
+
+	tampered := e
+	tampered.Data = []byte("tampered promise tree")
+	if _, err := Verify(tampered, sig, keys); err == nil {
+		t.Error("expected tampered data to fail")
+	}
+
+	tampered = e
+	tampered.Targets = []string{"*"}
+	if _, err := Verify(tampered, sig, keys); err == nil {
+		t.Error("expected tampered targets to fail")
+	}
+
+	tampered = e
+	tampered.NotAfter = e.NotAfter.Add(time.Hour)
+	if _, err := Verify(tampered, sig, keys); err == nil {
+		t.Error("expected tampered expiry to fail")
+	}
+
+	if _, err := Verify(e, nil, keys); err == nil {
+		t.Error("expected unsigned data to fail")
+	}
+
+	sig, _ = Sign(e, bob)
+	if _, err := Verify(e, sig, keys); err == nil {
+		t.Error("expected untrusted publisher to fail")
+	}
+}
+
+func TestBundleFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "llconf-bundle")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	key := newKey(t)
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pub, err := PublicKey(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+	if err != nil {
+		t.Fatalf("public key: %s", err)
+	}
+
+	b, err := New(Envelope{Data: []byte("data"), Targets: []string{"*"}, NotAfter: time.Now().Add(time.Hour)}, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(dir, "promise.bundle")
+	if err := b.Write(path); err != nil {
+		t.Fatalf("write: %s", err)
+	}
+
+	e, publisher, err := Read(path, map[string]*rsa.PublicKey{"ci": pub})
+	if err != nil {
+		t.Fatalf("read: %s", err)
+	}
+	if string(e.Data) != "data" || publisher != "ci" {
+		t.Errorf("unexpected bundle %q from %q", e.Data, publisher)
+	}
+	if !e.NotAfter.Equal(b.NotAfter) || len(e.Targets) != 1 {
+		t.Errorf("unexpected envelope %v", e)
+	}
+}
+
+func TestEnvelopeCheck(t *testing.T) {
+	now := time.Now()
+
+	tests := []struct {
+		targets  []string
+		notAfter time.Time
+		names    []string
+		ok       bool
+	}{
+		{[]string{"web1.internal"}, now.Add(time.Minute), []string{"web1", "web1.internal"}, true},
+		{[]string{"*.internal"}, now.Add(time.Minute), []string{"WEB2.internal"}, true},
+		{[]string{"web1.internal"}, now.Add(time.Minute), []string{"web2.internal"}, false},
+		{[]string{"web1.internal"}, now.Add(-time.Minute), []string{"web1.internal"}, false},
+		{[]string{"web1.internal"}, time.Time{}, []string{"web1.internal"}, false},
+		{nil, now.Add(time.Minute), []string{"web1.internal"}, false},
+	}
+
+	for _, test := range tests {
+		e := Envelope{Targets: test.targets, NotAfter: test.notAfter}
+		if err := e.Check(test.names, now); (err == nil) != test.ok {
+			t.Errorf("%v until %s for %v: expected ok %t, got %v",
+				test.targets, test.notAfter, test.names, test.ok, err)
+		}
+	}
+}
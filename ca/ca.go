@@ -0,0 +1,383 @@
+package ca
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/denkhaus/llconf/util"
+	"github.com/juju/errors"
+)
+
+const (
+	CertFile    = "ca.cert.pem"
+	PrivKeyFile = "ca.privkey.pem"
+	IndexFile   = "index.json"
+	CRLFile     = "ca.crl.pem"
+
+	RoleServer = "server"
+	RoleClient = "client"
+
+	Organization = "llconf"
+)
+
+////////////////////////////////////////////////////////////////////////////////
+// Issued records a certificate signed by the authority.
+type Issued struct {
+	Serial     string
+	CommonName string
+	Role       string
+	NotAfter   time.Time
+	RevokedAt  *time.Time `json:",omitempty"`
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// Request describes the identity of a certificate to sign.
+type Request struct {
+	Role       string
+	CommonName string
+	DNSNames   []string
+	IPs        []net.IP
+	Validity   time.Duration
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// Authority is a local certificate authority stored in dir.
+type Authority struct {
+	dir    string
+	cert   *x509.Certificate
+	key    *rsa.PrivateKey
+	issued []Issued
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// Init creates a new authority in dir.
+func Init(dir, commonName string, validity time.Duration) (*Authority, error) {
+	if util.FileExists(filepath.Join(dir, CertFile)) {
+		return nil, errors.Errorf("certificate authority in %q already initialized", dir)
+	}
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, errors.Annotate(err, "generate priv key")
+	}
+
+	serial, err := newSerial()
+	if err != nil {
+		return nil, errors.Annotate(err, "new serial")
+	}
+
+	template := &x509.Certificate{
+		IsCA: true,
+		BasicConstraintsValid: true,
+		SerialNumber:          serial,
+		Subject: pkix.Name{
+			CommonName:   commonName,
+			Organization: []string{Organization},
+		},
+		NotBefore: time.Now(),
+		NotAfter:  time.Now().Add(validity),
+		KeyUsage:  x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, errors.Annotate(err, "create certificate")
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, errors.Annotate(err, "parse certificate")
+	}
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, errors.Annotate(err, "create ca dir")
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(dir, PrivKeyFile), EncodeKey(key), 0600); err != nil {
+		return nil, errors.Annotate(err, "write priv key")
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(dir, CertFile), EncodeCert(der), 0644); err != nil {
+		return nil, errors.Annotate(err, "write cert")
+	}
+
+	a := &Authority{dir: dir, cert: cert, key: key}
+	if err := a.save(); err != nil {
+		return nil, errors.Annotate(err, "save")
+	}
+
+	return a, nil
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// Open loads the authority stored in dir.
+func Open(dir string) (*Authority, error) {
+	if !util.FileExists(filepath.Join(dir, CertFile)) {
+		return nil, errors.Errorf("no certificate authority in %q, run ca init first", dir)
+	}
+
+	cert, err := ReadCert(filepath.Join(dir, CertFile))
+	if err != nil {
+		return nil, errors.Annotate(err, "read cert")
+	}
+
+	key, err := ReadKey(filepath.Join(dir, PrivKeyFile))
+	if err != nil {
+		return nil, errors.Annotate(err, "read priv key")
+	}
+
+	a := &Authority{dir: dir, cert: cert, key: key}
+
+	data, err := ioutil.ReadFile(filepath.Join(dir, IndexFile))
+	if err != nil {
+		return nil, errors.Annotate(err, "read index")
+	}
+
+	if err := json.Unmarshal(data, &a.issued); err != nil {
+		return nil, errors.Annotate(err, "unmarshal index")
+	}
+
+	return a, nil
+}
+
+////////////////////////////////////////////////////////////////////////////////
+func (a *Authority) Certificate() *x509.Certificate {
+	return a.cert
+}
+
+////////////////////////////////////////////////////////////////////////////////
+func (a *Authority) Issued() []Issued {
+	return a.issued
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// Sign creates a key pair for req and returns the PEM encoded
+// certificate and private key signed by the authority.
+func (a *Authority) Sign(req Request) (certPEM []byte, keyPEM []byte, err error) {
+	if req.CommonName == "" {
+		return nil, nil, errors.New("no common name provided")
+	}
+
+	template := &x509.Certificate{
+		Subject: pkix.Name{
+			CommonName:         req.CommonName,
+			Organization:       []string{Organization},
+			OrganizationalUnit: []string{req.Role},
+		},
+		DNSNames:    req.DNSNames,
+		IPAddresses: req.IPs,
+		NotBefore:   time.Now(),
+		NotAfter:    time.Now().Add(req.Validity),
+		KeyUsage:    x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature,
+	}
+
+	switch req.Role {
+	case RoleServer:
+		template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+		if len(template.DNSNames) == 0 && len(template.IPAddresses) == 0 {
+			template.DNSNames = []string{req.CommonName}
+		}
+	case RoleClient:
+		template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}
+	default:
+		return nil, nil, errors.Errorf("unknown role %q", req.Role)
+	}
+
+	if template.SerialNumber, err = newSerial(); err != nil {
+		return nil, nil, errors.Annotate(err, "new serial")
+	}
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, nil, errors.Annotate(err, "generate priv key")
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, a.cert, &key.PublicKey, a.key)
+	if err != nil {
+		return nil, nil, errors.Annotate(err, "create certificate")
+	}
+
+	a.issued = append(a.issued, Issued{
+		Serial:     SerialString(template.SerialNumber),
+		CommonName: req.CommonName,
+		Role:       req.Role,
+		NotAfter:   template.NotAfter,
+	})
+
+	if err := a.save(); err != nil {
+		return nil, nil, errors.Annotate(err, "save")
+	}
+
+	return EncodeCert(der), EncodeKey(key), nil
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// Revoke revokes all unrevoked certificates whose serial or common name
+// equals id and rewrites the revocation list.
+func (a *Authority) Revoke(id string) ([]Issued, error) {
+	now := time.Now()
+	revoked := []Issued{}
+
+	for i, issued := range a.issued {
+		if issued.RevokedAt != nil || (issued.Serial != id && issued.CommonName != id) {
+			continue
+		}
+
+		a.issued[i].RevokedAt = &now
+		revoked = append(revoked, a.issued[i])
+	}
+
+	if len(revoked) == 0 {
+		return nil, errors.Errorf("no valid certificate %q issued", id)
+	}
+
+	if err := a.save(); err != nil {
+		return nil, errors.Annotate(err, "save")
+	}
+
+	return revoked, nil
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// CRL returns the PEM encoded revocation list of the authority.
+func (a *Authority) CRL() ([]byte, error) {
+	revoked := []pkix.RevokedCertificate{}
+	for _, issued := range a.issued {
+		if issued.RevokedAt == nil {
+			continue
+		}
+
+		serial, ok := new(big.Int).SetString(issued.Serial, 16)
+		if !ok {
+			return nil, errors.Errorf("invalid serial %q in index", issued.Serial)
+		}
+
+		revoked = append(revoked, pkix.RevokedCertificate{
+			SerialNumber:   serial,
+			RevocationTime: *issued.RevokedAt,
+		})
+	}
+
+	now := time.Now()
+	der, err := a.cert.CreateCRL(rand.Reader, a.key, revoked, now, now.AddDate(0, 0, 30))
+	if err != nil {
+		return nil, errors.Annotate(err, "create crl")
+	}
+
+	return pem.EncodeToMemory(&pem.Block{Type: "X509 CRL", Bytes: der}), nil
+}
+
+////////////////////////////////////////////////////////////////////////////////
+func (a *Authority) save() error {
+	data, err := json.MarshalIndent(a.issued, "", "  ")
+	if err != nil {
+		return errors.Annotate(err, "marshal index")
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(a.dir, IndexFile), data, 0600); err != nil {
+		return errors.Annotate(err, "write index")
+	}
+
+	crl, err := a.CRL()
+	if err != nil {
+		return errors.Annotate(err, "create crl")
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(a.dir, CRLFile), crl, 0644); err != nil {
+		return errors.Annotate(err, "write crl")
+	}
+
+	return nil
+}
+
+////////////////////////////////////////////////////////////////////////////////
+func newSerial() (*big.Int, error) {
+	serialNumberLimit := new(big.Int).Lsh(big.NewInt(1), 128)
+	return rand.Int(rand.Reader, serialNumberLimit)
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// SerialString formats serial the way it is stored in the index.
+func SerialString(serial *big.Int) string {
+	return fmt.Sprintf("%x", serial)
+}
+
+////////////////////////////////////////////////////////////////////////////////
+func EncodeCert(der []byte) []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+}
+
+////////////////////////////////////////////////////////////////////////////////
+func EncodeKey(key *rsa.PrivateKey) []byte {
+	return pem.EncodeToMemory(&pem.Block{
+		Type:  "RSA PRIVATE KEY",
+		Bytes: x509.MarshalPKCS1PrivateKey(key),
+	})
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// ReadCert reads the first PEM encoded certificate from path.
+func ReadCert(path string) (*x509.Certificate, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Annotate(err, "read file")
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, errors.Errorf("no certificate found in %q", path)
+	}
+
+	return x509.ParseCertificate(block.Bytes)
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// ReadKey reads a PEM encoded RSA private key from path.
+func ReadKey(path string) (*rsa.PrivateKey, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Annotate(err, "read file")
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "RSA PRIVATE KEY" {
+		return nil, errors.Errorf("no private key found in %q", path)
+	}
+
+	return x509.ParsePKCS1PrivateKey(block.Bytes)
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// ExpiryWarning is the time before expiry from which on
+// certificates are reported as expiring.
+const ExpiryWarning = 30 * 24 * time.Hour
+
+////////////////////////////////////////////////////////////////////////////////
+// ExpiresSoon reports whether cert expires within ExpiryWarning.
+func ExpiresSoon(cert *x509.Certificate) bool {
+	return time.Now().Add(ExpiryWarning).After(cert.NotAfter)
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// Fingerprint returns the colon separated sha256 fingerprint of cert.
+func Fingerprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	parts := make([]string, len(sum))
+	for i, b := range sum {
+		parts[i] = fmt.Sprintf("%02X", b)
+	}
+	return strings.Join(parts, ":")
+}
@@ -0,0 +1,125 @@
+package ca
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestAuthority(t *testing.T) {
+	dir, err := ioutil.TempDir("", "llconf-ca")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if _, err := Init(dir, "test CA", 24*time.Hour); err != nil {
+		t.Fatalf("init: %s", err)
+	}
+
+	if _, err := Init(dir, "test CA", 24*time.Hour); err == nil {
+		t.Errorf("init: expected exception for existing ca")
+	}
+
+	a, err := Open(dir)
+	if err != nil {
+		t.Fatalf("open: %s", err)
+	}
+
+	certPEM, keyPEM, err := a.Sign(Request{Role: RoleServer, CommonName: "web1.example.com",
+		Validity: time.Hour})
+	if err != nil {
+		t.Fatalf("sign: %s", err)
+	}
+
+	pair, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		t.Fatalf("key pair: %s", err)
+	}
+
+	cert, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	equals(t, "web1.example.com", cert.Subject.CommonName)
+	equals(t, RoleServer, cert.Subject.OrganizationalUnit[0])
+
+	pool := x509.NewCertPool()
+	pool.AddCert(a.Certificate())
+	if _, err := cert.Verify(x509.VerifyOptions{Roots: pool, DNSName: "web1.example.com"}); err != nil {
+		t.Errorf("verify: %s", err)
+	}
+
+	if _, _, err := a.Sign(Request{Role: "other", CommonName: "x", Validity: time.Hour}); err == nil {
+		t.Errorf("sign: expected exception for unknown role")
+	}
+
+	revoked, err := a.Revoke("web1.example.com")
+	if err != nil {
+		t.Fatalf("revoke: %s", err)
+	}
+	equals(t, SerialString(cert.SerialNumber), revoked[0].Serial)
+
+	if _, err := a.Revoke("web1.example.com"); err == nil {
+		t.Errorf("revoke: expected exception for revoked certificate")
+	}
+
+	a, err = Open(dir)
+	if err != nil {
+		t.Fatalf("open: %s", err)
+	}
+	equals(t, 1, len(a.Issued()))
+
+	data, err := ioutil.ReadFile(filepath.Join(dir, CRLFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	block, _ := pem.Decode(data)
+	crl, err := x509.ParseCRL(block.Bytes)
+	if err != nil {
+		t.Fatalf("parse crl: %s", err)
+	}
+	equals(t, 1, len(crl.TBSCertList.RevokedCertificates))
+	equals(t, 0, crl.TBSCertList.RevokedCertificates[0].SerialNumber.Cmp(cert.SerialNumber))
+}
+
+func TestExpiresSoon(t *testing.T) {
+	dir, err := ioutil.TempDir("", "llconf-ca")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	a, err := Init(dir, "test CA", 365*24*time.Hour)
+	if err != nil {
+		t.Fatalf("init: %s", err)
+	}
+
+	equals(t, false, ExpiresSoon(a.Certificate()))
+	equals(t, 95, len(Fingerprint(a.Certificate())))
+
+	certPEM, _, err := a.Sign(Request{Role: RoleClient, CommonName: "admin", Validity: 24 * time.Hour})
+	if err != nil {
+		t.Fatalf("sign: %s", err)
+	}
+
+	block, _ := pem.Decode(certPEM)
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	equals(t, true, ExpiresSoon(cert))
+}
+
+func equals(t *testing.T, a interface{}, b interface{}) {
+	if a != b {
+		t.Errorf("error: wanted %v, got %v", a, b)
+	}
+}
@@ -0,0 +1,200 @@
+package cmd
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"time"
+
+	"github.com/codegangsta/cli"
+	"github.com/denkhaus/llconf/ca"
+	"github.com/denkhaus/llconf/context"
+	"github.com/denkhaus/llconf/logging"
+	"github.com/juju/errors"
+)
+
+func NewCACommand() cli.Command {
+	return cli.Command{
+		Name: "ca",
+		Subcommands: []cli.Command{
+			{
+				Name: "init",
+				Flags: []cli.Flag{
+					cli.StringFlag{
+						Name:  "cn",
+						Usage: "the common name of the certificate authority",
+						Value: "llconf CA",
+					},
+					cli.IntFlag{
+						Name:  "days",
+						Usage: "the validity of the ca certificate in days",
+						Value: 3650,
+					},
+				},
+				Action: func(ctx *cli.Context) error {
+					if err := caInit(ctx); err != nil {
+						logging.Logger.Error(err)
+					}
+					return nil
+				},
+			},
+			{
+				Name: "sign",
+				Flags: []cli.Flag{
+					cli.StringFlag{
+						Name:  "role",
+						Usage: "the role of the certificate, server or client",
+					},
+					cli.StringFlag{
+						Name:  "cn",
+						Usage: "the common name identifying the node",
+					},
+					cli.StringSliceFlag{
+						Name:  "dns",
+						Usage: "a dns name of the server, defaults to the common name",
+						Value: &cli.StringSlice{},
+					},
+					cli.StringSliceFlag{
+						Name:  "ip",
+						Usage: "an ip address of the server",
+						Value: &cli.StringSlice{},
+					},
+					cli.IntFlag{
+						Name:  "days",
+						Usage: "the validity of the certificate in days",
+						Value: 365,
+					},
+					cli.StringFlag{
+						Name:  "out",
+						Usage: "the folder the certificate and private key are written to",
+						Value: ".",
+					},
+				},
+				Action: func(ctx *cli.Context) error {
+					if err := caSign(ctx); err != nil {
+						logging.Logger.Error(err)
+					}
+					return nil
+				},
+			},
+			{
+				Name: "revoke",
+				Action: func(ctx *cli.Context) error {
+					if err := caRevoke(ctx); err != nil {
+						logging.Logger.Error(err)
+					}
+					return nil
+				},
+			},
+		},
+	}
+}
+
+func caDir(ctx *cli.Context) (string, error) {
+	rCtx, err := context.New(ctx, true, false)
+	if err != nil {
+		return "", errors.Annotate(err, "new run context")
+	}
+	defer rCtx.Close()
+
+	return rCtx.CADir, nil
+}
+
+func caInit(ctx *cli.Context) error {
+	logging.Logger.Infof("%s exec: ca init", ctx.App.Version)
+
+	dir, err := caDir(ctx)
+	if err != nil {
+		return errors.Annotate(err, "get ca dir")
+	}
+
+	validity := time.Duration(ctx.Int("days")) * 24 * time.Hour
+	if _, err := ca.Init(dir, ctx.String("cn"), validity); err != nil {
+		return errors.Annotate(err, "init ca")
+	}
+
+	logging.Logger.Infof("certificate authority successfull created @ %q", dir)
+	logging.Logger.Infof("trust it with: cert add --id ca --path %s", filepath.Join(dir, ca.CertFile))
+	return nil
+}
+
+func caSign(ctx *cli.Context) error {
+	logging.Logger.Infof("%s exec: ca sign", ctx.App.Version)
+
+	dir, err := caDir(ctx)
+	if err != nil {
+		return errors.Annotate(err, "get ca dir")
+	}
+
+	authority, err := ca.Open(dir)
+	if err != nil {
+		return errors.Annotate(err, "open ca")
+	}
+
+	req := ca.Request{
+		Role:       ctx.String("role"),
+		CommonName: ctx.String("cn"),
+		DNSNames:   ctx.StringSlice("dns"),
+		Validity:   time.Duration(ctx.Int("days")) * 24 * time.Hour,
+	}
+
+	for _, v := range ctx.StringSlice("ip") {
+		ip := net.ParseIP(v)
+		if ip == nil {
+			return errors.Errorf("invalid ip address %q", v)
+		}
+		req.IPs = append(req.IPs, ip)
+	}
+
+	certPEM, keyPEM, err := authority.Sign(req)
+	if err != nil {
+		return errors.Annotate(err, "sign")
+	}
+
+	certPath := filepath.Join(ctx.String("out"), fmt.Sprintf("%s.cert.pem", req.Role))
+	if err := ioutil.WriteFile(certPath, certPEM, 0644); err != nil {
+		return errors.Annotate(err, "write cert")
+	}
+
+	keyPath := filepath.Join(ctx.String("out"), fmt.Sprintf("%s.privkey.pem", req.Role))
+	if err := ioutil.WriteFile(keyPath, keyPEM, 0600); err != nil {
+		return errors.Annotate(err, "write priv key")
+	}
+
+	logging.Logger.Infof("%s certificate for %q successfull written to %q and %q",
+		req.Role, req.CommonName, certPath, keyPath)
+	return nil
+}
+
+func caRevoke(ctx *cli.Context) error {
+	logging.Logger.Infof("%s exec: ca revoke", ctx.App.Version)
+
+	id := ctx.Args().First()
+	if id == "" {
+		return errors.New("no serial or common name provided")
+	}
+
+	dir, err := caDir(ctx)
+	if err != nil {
+		return errors.Annotate(err, "get ca dir")
+	}
+
+	authority, err := ca.Open(dir)
+	if err != nil {
+		return errors.Annotate(err, "open ca")
+	}
+
+	revoked, err := authority.Revoke(id)
+	if err != nil {
+		return errors.Annotate(err, "revoke")
+	}
+
+	for _, issued := range revoked {
+		logging.Logger.Infof("%s certificate %s for %q successfull revoked",
+			issued.Role, issued.Serial, issued.CommonName)
+	}
+
+	logging.Logger.Infof("revocation list written to %q", filepath.Join(dir, ca.CRLFile))
+	return nil
+}
@@ -0,0 +1,175 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/codegangsta/cli"
+	"github.com/denkhaus/llconf/context"
+	"github.com/denkhaus/llconf/logging"
+	"github.com/juju/errors"
+)
+
+func newCertListCommand(isClient bool) cli.Command {
+	return cli.Command{
+		Name: "list",
+		Action: func(ctx *cli.Context) error {
+			if err := certList(ctx, isClient); err != nil {
+				logging.Logger.Error(err)
+			}
+			return nil
+		},
+	}
+}
+
+func newCertRevokeCommand(isClient bool) cli.Command {
+	return cli.Command{
+		Name: "revoke",
+		Flags: []cli.Flag{
+			cli.StringFlag{
+				Name:  "serial",
+				Usage: "the serial of the revoked certificate",
+			},
+			cli.StringFlag{
+				Name:  "crl",
+				Usage: "path to a revocation list to import",
+			},
+		},
+		Action: func(ctx *cli.Context) error {
+			if err := certRevoke(ctx, isClient); err != nil {
+				logging.Logger.Error(err)
+			}
+			return nil
+		},
+	}
+}
+
+func newCertRotateCommand(isClient bool) cli.Command {
+	return cli.Command{
+		Name: "rotate",
+		Flags: []cli.Flag{
+			cli.DurationFlag{
+				Name:  "overlap",
+				Usage: "the time peers trust the current and the next cert",
+				Value: 24 * time.Hour,
+			},
+			cli.BoolFlag{
+				Name:  "switch",
+				Usage: "use the next cert now, without waiting for the end of the overlap",
+			},
+			cli.BoolFlag{
+				Name:  "retire",
+				Usage: "remove the cert replaced by the last rotation",
+			},
+		},
+		Action: func(ctx *cli.Context) error {
+			if err := certRotate(ctx, isClient); err != nil {
+				logging.Logger.Error(err)
+			}
+			return nil
+		},
+	}
+}
+
+func certList(ctx *cli.Context, isClient bool) error {
+	rCtx, err := context.New(ctx, isClient, false)
+	if err != nil {
+		return errors.Annotate(err, "new run context")
+	}
+	defer rCtx.Close()
+
+	certs, err := rCtx.ListCerts()
+	if err != nil {
+		return errors.Annotate(err, "list certs")
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprint(w, "ID\tSUBJECT\tSERIAL\tEXPIRES\tSTATUS\tFINGERPRINT")
+	if !isClient {
+		fmt.Fprint(w, "\tPOLICY")
+	}
+	fmt.Fprintln(w)
+	for _, cert := range certs {
+		status := "valid"
+		switch {
+		case cert.Revoked:
+			status = "revoked"
+		case time.Now().After(cert.NotAfter):
+			status = "expired"
+		}
+
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s", cert.ID, cert.Subject, cert.Serial,
+			cert.NotAfter.Format("2006-01-02"), status, cert.Fingerprint)
+		if !isClient {
+			fmt.Fprintf(w, "\t%s", cert.Policy)
+		}
+		fmt.Fprintln(w)
+	}
+
+	return w.Flush()
+}
+
+func certRevoke(ctx *cli.Context, isClient bool) error {
+	logging.Logger.Infof("%s exec: cert revoke", ctx.App.Version)
+
+	rCtx, err := context.New(ctx, isClient, false)
+	if err != nil {
+		return errors.Annotate(err, "new run context")
+	}
+	defer rCtx.Close()
+
+	if path := ctx.String("crl"); path != "" {
+		n, err := rCtx.ImportCRL(path)
+		if err != nil {
+			return errors.Annotate(err, "import crl")
+		}
+
+		logging.Logger.Infof("%d revoked certificates successfull imported", n)
+		return nil
+	}
+
+	serial := ctx.String("serial")
+	if err := rCtx.RevokeCert(serial); err != nil {
+		return errors.Annotate(err, "revoke cert")
+	}
+
+	logging.Logger.Infof("certificate with serial %s successfull revoked", serial)
+	return nil
+}
+
+func certRotate(ctx *cli.Context, isClient bool) error {
+	logging.Logger.Infof("%s exec: cert rotate", ctx.App.Version)
+
+	rCtx, err := context.New(ctx, isClient, false)
+	if err != nil {
+		return errors.Annotate(err, "new run context")
+	}
+	defer rCtx.Close()
+
+	switch {
+	case ctx.Bool("switch"):
+		if err := rCtx.SwitchCert(); err != nil {
+			return errors.Annotate(err, "switch cert")
+		}
+
+		logging.Logger.Info("next certificate successfull switched")
+	case ctx.Bool("retire"):
+		if err := rCtx.RetireCert(); err != nil {
+			return errors.Annotate(err, "retire cert")
+		}
+
+		logging.Logger.Info("retired certificate successfull removed")
+	default:
+		bundlePath, switchAt, err := rCtx.RotateCert(ctx.Duration("overlap"))
+		if err != nil {
+			return errors.Annotate(err, "rotate cert")
+		}
+
+		logging.Logger.Infof("next certificate created, it is used from %s on", switchAt.Format(time.RFC3339))
+		logging.Logger.Infof("let peers trust %q with: cert add --replace", bundlePath)
+	}
+
+	return nil
+}
@@ -22,12 +22,47 @@ func NewClientCommand() cli.Command {
 				Usage:  "enable verbose output in client mode and makes server response more verbose",
 				EnvVar: "LLCONF_VERBOSE",
 			},
+			cli.BoolFlag{
+				Name:   "source",
+				Usage:  "send the source files and let the server compile them",
+				EnvVar: "LLCONF_SOURCE",
+			},
+			cli.StringSliceFlag{
+				Name:   "attach",
+				Usage:  "a file to send along with the promise tree, staged on the server in [var:bundle_dir]",
+				EnvVar: "LLCONF_ATTACH",
+				Value:  &cli.StringSlice{},
+			},
+			cli.StringFlag{
+				Name:   "ssh-command",
+				Usage:  "the llconf command run on ssh hosts",
+				EnvVar: "LLCONF_SSH_COMMAND",
+				Value:  "llconf",
+			},
+			cli.BoolFlag{
+				Name:   "ssh-upload",
+				Usage:  "upload the running llconf binary to ssh hosts",
+				EnvVar: "LLCONF_SSH_UPLOAD",
+			},
+			cli.StringFlag{
+				Name:   "target",
+				Usage:  "relay the promise tree through host to this server",
+				EnvVar: "LLCONF_TARGET",
+			},
+			cli.StringFlag{
+				Name:   "sign-key",
+				Usage:  "the private key promises are signed with, defaults to the client key",
+				EnvVar: "LLCONF_SIGN_KEY",
+			},
 		},
 		Subcommands: cli.Commands{
 			newClientRunCommand(),
 			newClientTestCommand(),
 			newClientWatchCommand(),
 			newClientCertCommand(),
+			newClientVendorCommand(),
+			newClientEnrollCommand(),
+			newClientBundleCommand(),
 		},
 	}
 
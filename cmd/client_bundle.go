@@ -0,0 +1,62 @@
+package cmd
+
+import (
+	"time"
+
+	"github.com/codegangsta/cli"
+	"github.com/denkhaus/llconf/context"
+	"github.com/denkhaus/llconf/logging"
+	"github.com/juju/errors"
+)
+
+func newClientBundleCommand() cli.Command {
+	return cli.Command{
+		Name: "bundle",
+		Flags: []cli.Flag{
+			cli.StringFlag{
+				Name:  "out, o",
+				Usage: "path of the signed bundle",
+				Value: "promise.bundle",
+			},
+			cli.StringSliceFlag{
+				Name:  "target, t",
+				Usage: "a server name or pattern the bundle is meant for, eg. *.internal",
+				Value: &cli.StringSlice{},
+			},
+			cli.DurationFlag{
+				Name:  "valid",
+				Usage: "the time the bundle may be evaluated in",
+				Value: 24 * time.Hour,
+			},
+		},
+		Action: func(ctx *cli.Context) error {
+			if err := clientBundle(ctx); err != nil {
+				logging.Logger.Error(err)
+			}
+			return nil
+		},
+	}
+}
+
+func clientBundle(ctx *cli.Context) error {
+	logging.Logger.Infof("%s exec: client bundle", ctx.App.Version)
+
+	rCtx, err := context.New(ctx, true, true)
+	if err != nil {
+		return errors.Annotate(err, "new run context")
+	}
+	defer rCtx.Close()
+
+	tree, err := rCtx.CompilePromise()
+	if err != nil {
+		return errors.Annotate(err, "compile promise")
+	}
+
+	path := ctx.String("out")
+	if err := rCtx.WriteBundle(tree, path, ctx.StringSlice("target"), ctx.Duration("valid")); err != nil {
+		return errors.Annotate(err, "write bundle")
+	}
+
+	logging.Logger.Infof("signed bundle %q successfull written", path)
+	return nil
+}
@@ -22,6 +22,10 @@ func newClientCertCommand() cli.Command {
 						Name:  "path",
 						Usage: "path to the cert file",
 					},
+					cli.BoolFlag{
+						Name:  "replace",
+						Usage: "replace the cert stored for the id",
+					},
 				},
 				Action: func(ctx *cli.Context) error {
 					if err := clientCertAdd(ctx); err != nil {
@@ -45,6 +49,9 @@ func newClientCertCommand() cli.Command {
 					return nil
 				},
 			},
+			newCertListCommand(true),
+			newCertRotateCommand(true),
+			newCertRevokeCommand(true),
 		},
 	}
 }
@@ -60,7 +67,7 @@ func clientCertAdd(ctx *cli.Context) error {
 
 	serverID := ctx.String("id")
 	path := ctx.String("path")
-	if err := rCtx.AddCert(serverID, path); err != nil {
+	if err := rCtx.AddCert(serverID, path, ctx.Bool("replace")); err != nil {
 		return errors.Annotate(err, "add server cert")
 	}
 
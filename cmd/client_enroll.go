@@ -0,0 +1,56 @@
+package cmd
+
+import (
+	"github.com/codegangsta/cli"
+	"github.com/denkhaus/llconf/context"
+	"github.com/denkhaus/llconf/logging"
+	"github.com/juju/errors"
+)
+
+func newClientEnrollCommand() cli.Command {
+	return cli.Command{
+		Name: "enroll",
+		Flags: []cli.Flag{
+			cli.StringFlag{
+				Name:   "token",
+				Usage:  "the enrollment token the server was started with",
+				EnvVar: "LLCONF_ENROLL_TOKEN",
+			},
+			cli.IntFlag{
+				Name:  "enroll-port",
+				Usage: "the port of the enrollment endpoint, defaults to port + 1",
+			},
+			cli.StringFlag{
+				Name:  "id",
+				Usage: "the id the server cert is stored under, defaults to its common name",
+			},
+			cli.StringFlag{
+				Name:  "client-id",
+				Usage: "the id the client cert is stored under, defaults to its common name",
+			},
+		},
+		Action: func(ctx *cli.Context) error {
+			if err := clientEnroll(ctx); err != nil {
+				logging.Logger.Error(err)
+			}
+			return nil
+		},
+	}
+}
+
+func clientEnroll(ctx *cli.Context) error {
+	logging.Logger.Infof("%s exec: client enroll", ctx.App.Version)
+
+	rCtx, err := context.New(ctx, true, false)
+	if err != nil {
+		return errors.Annotate(err, "new run context")
+	}
+	defer rCtx.Close()
+
+	if err := rCtx.Enroll(ctx.String("token"), ctx.String("id")); err != nil {
+		return errors.Annotate(err, "enroll")
+	}
+
+	logging.Logger.Info("enrollment successful")
+	return nil
+}
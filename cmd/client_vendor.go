@@ -0,0 +1,38 @@
+package cmd
+
+import (
+	"github.com/codegangsta/cli"
+	"github.com/denkhaus/llconf/context"
+	"github.com/denkhaus/llconf/logging"
+	"github.com/denkhaus/llconf/modules"
+	"github.com/juju/errors"
+)
+
+func newClientVendorCommand() cli.Command {
+	return cli.Command{
+		Name: "vendor",
+		Action: func(ctx *cli.Context) error {
+			if err := clientVendor(ctx); err != nil {
+				logging.Logger.Error(err)
+			}
+			return nil
+		},
+	}
+}
+
+func clientVendor(ctx *cli.Context) error {
+	logging.Logger.Infof("%s exec: client vendor", ctx.App.Version)
+
+	rCtx, err := context.New(ctx, true, true)
+	if err != nil {
+		return errors.Annotate(err, "new run context")
+	}
+	defer rCtx.Close()
+
+	if err := modules.Vendor(rCtx.InputDir); err != nil {
+		return errors.Annotate(err, "vendor modules")
+	}
+
+	logging.Logger.Info("vendor successful")
+	return nil
+}
@@ -0,0 +1,163 @@
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/codegangsta/cli"
+	"github.com/denkhaus/llconf/context"
+	"github.com/denkhaus/llconf/logging"
+	"github.com/denkhaus/llconf/modules"
+	"github.com/juju/errors"
+)
+
+func NewLibCommand() cli.Command {
+	return cli.Command{
+		Name: "lib",
+		Subcommands: []cli.Command{
+			{
+				Name: "install",
+				Flags: []cli.Flag{
+					cli.StringFlag{
+						Name:  "name",
+						Usage: "the library name, derived from the source if empty",
+					},
+					cli.StringFlag{
+						Name:  "rev",
+						Usage: "the git revision to checkout",
+					},
+				},
+				Action: func(ctx *cli.Context) error {
+					if err := libInstall(ctx); err != nil {
+						logging.Logger.Error(err)
+					}
+					return nil
+				},
+			},
+			{
+				Name: "update",
+				Flags: []cli.Flag{
+					cli.StringFlag{
+						Name:  "rev",
+						Usage: "the git revision to checkout",
+					},
+				},
+				Action: func(ctx *cli.Context) error {
+					if err := libUpdate(ctx); err != nil {
+						logging.Logger.Error(err)
+					}
+					return nil
+				},
+			},
+			{
+				Name: "list",
+				Action: func(ctx *cli.Context) error {
+					if err := libList(ctx); err != nil {
+						logging.Logger.Error(err)
+					}
+					return nil
+				},
+			},
+			{
+				Name: "remove",
+				Action: func(ctx *cli.Context) error {
+					if err := libRemove(ctx); err != nil {
+						logging.Logger.Error(err)
+					}
+					return nil
+				},
+			},
+		},
+	}
+}
+
+func openLibrary(ctx *cli.Context) (*modules.Library, error) {
+	rCtx, err := context.New(ctx, true, false)
+	if err != nil {
+		return nil, errors.Annotate(err, "new run context")
+	}
+	defer rCtx.Close()
+
+	return modules.OpenLibrary(rCtx.LibDir)
+}
+
+func libInstall(ctx *cli.Context) error {
+	logging.Logger.Infof("%s exec: lib install", ctx.App.Version)
+
+	source := ctx.Args().First()
+	if source == "" {
+		return errors.New("no library source provided")
+	}
+
+	lib, err := openLibrary(ctx)
+	if err != nil {
+		return errors.Annotate(err, "open library")
+	}
+
+	name, err := lib.Install(source, ctx.String("name"), ctx.String("rev"))
+	if err != nil {
+		return errors.Annotate(err, "install library")
+	}
+
+	logging.Logger.Infof("library %q successfull installed", name)
+	return nil
+}
+
+func libUpdate(ctx *cli.Context) error {
+	logging.Logger.Infof("%s exec: lib update", ctx.App.Version)
+
+	lib, err := openLibrary(ctx)
+	if err != nil {
+		return errors.Annotate(err, "open library")
+	}
+
+	names := []string(ctx.Args())
+	if len(names) == 0 {
+		names, _ = lib.Entries()
+	}
+
+	for _, name := range names {
+		if err := lib.Update(name, ctx.String("rev")); err != nil {
+			return errors.Annotatef(err, "update library %q", name)
+		}
+
+		logging.Logger.Infof("library %q successfull updated", name)
+	}
+
+	return nil
+}
+
+func libList(ctx *cli.Context) error {
+	lib, err := openLibrary(ctx)
+	if err != nil {
+		return errors.Annotate(err, "open library")
+	}
+
+	names, entries := lib.Entries()
+	for _, name := range names {
+		entry := entries[name]
+		fmt.Printf("%s\t%s\t%s\t%s\n", name, entry.Type, entry.Revision, entry.Source)
+	}
+
+	return nil
+}
+
+func libRemove(ctx *cli.Context) error {
+	logging.Logger.Infof("%s exec: lib remove", ctx.App.Version)
+
+	name := ctx.Args().First()
+	if name == "" {
+		return errors.New("no library name provided")
+	}
+
+	lib, err := openLibrary(ctx)
+	if err != nil {
+		return errors.Annotate(err, "open library")
+	}
+
+	if err := lib.Remove(name); err != nil {
+		return errors.Annotate(err, "remove library")
+	}
+
+	logging.Logger.Infof("library %q successfull removed", name)
+	return nil
+}
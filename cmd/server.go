@@ -7,9 +7,21 @@ func NewServerCommand() cli.Command {
 		Name: "server",
 		Subcommands: cli.Commands{
 			newServerRunCommand(),
+			newServerStdioCommand(),
 			newServerCertCommand(),
+			newServerPublisherCommand(),
 		},
 	}
 
 	return cd
 }
+
+// newServerNameFlag returns the flag naming the server for signed promise trees.
+func newServerNameFlag() cli.Flag {
+	return cli.StringSliceFlag{
+		Name:   "name",
+		Usage:  "a name signed promise trees may address this server by, defaults to the hostname",
+		EnvVar: "LLCONF_NAME",
+		Value:  &cli.StringSlice{},
+	}
+}
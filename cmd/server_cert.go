@@ -4,6 +4,7 @@ import (
 	"github.com/codegangsta/cli"
 	"github.com/denkhaus/llconf/context"
 	"github.com/denkhaus/llconf/logging"
+	"github.com/denkhaus/llconf/store"
 	"github.com/juju/errors"
 )
 
@@ -22,6 +23,10 @@ func newServerCertCommand() cli.Command {
 						Name:  "path",
 						Usage: "path to the cert file",
 					},
+					cli.BoolFlag{
+						Name:  "replace",
+						Usage: "replace the cert stored for the id",
+					},
 				},
 				Action: func(ctx *cli.Context) error {
 					if err := serverCertAdd(ctx); err != nil {
@@ -45,6 +50,48 @@ func newServerCertCommand() cli.Command {
 					return nil
 				},
 			},
+			{
+				Name: "policy",
+				Flags: []cli.Flag{
+					cli.StringFlag{
+						Name:  "id",
+						Usage: "the id the cert belongs to",
+					},
+					cli.StringSliceFlag{
+						Name:  "root",
+						Usage: "a root promise the client may run, all if empty",
+						Value: &cli.StringSlice{},
+					},
+					cli.StringSliceFlag{
+						Name:  "allow",
+						Usage: "a builtin the client may use, all if empty",
+						Value: &cli.StringSlice{},
+					},
+					cli.StringSliceFlag{
+						Name:  "deny",
+						Usage: "a builtin the client must not use",
+						Value: &cli.StringSlice{},
+					},
+					cli.StringSliceFlag{
+						Name:  "relay",
+						Usage: "a target pattern the client may relay to, all relayed targets if empty",
+						Value: &cli.StringSlice{},
+					},
+					cli.BoolFlag{
+						Name:  "read-only",
+						Usage: "skip promises changing the system, deny commands of unsigned promises",
+					},
+				},
+				Action: func(ctx *cli.Context) error {
+					if err := serverCertPolicy(ctx); err != nil {
+						logging.Logger.Error(err)
+					}
+					return nil
+				},
+			},
+			newCertListCommand(false),
+			newCertRotateCommand(false),
+			newCertRevokeCommand(false),
 		},
 	}
 }
@@ -60,7 +107,7 @@ func serverCertAdd(ctx *cli.Context) error {
 
 	clientID := ctx.String("id")
 	path := ctx.String("path")
-	if err := rCtx.AddCert(clientID, path); err != nil {
+	if err := rCtx.AddCert(clientID, path, ctx.Bool("replace")); err != nil {
 		return errors.Annotate(err, "register client cert")
 	}
 
@@ -85,3 +132,29 @@ func serverCertRm(ctx *cli.Context) error {
 	logging.Logger.Infof("client certificate for id %q successfull removed", clientID)
 	return nil
 }
+
+func serverCertPolicy(ctx *cli.Context) error {
+	logging.Logger.Infof("%s exec: server cert policy", ctx.App.Version)
+
+	rCtx, err := context.New(ctx, false, false)
+	if err != nil {
+		return errors.Annotate(err, "new run context")
+	}
+	defer rCtx.Close()
+
+	clientID := ctx.String("id")
+	policy := store.Policy{
+		Roots:    ctx.StringSlice("root"),
+		Builtins: ctx.StringSlice("allow"),
+		Deny:     ctx.StringSlice("deny"),
+		Relay:    ctx.StringSlice("relay"),
+		ReadOnly: ctx.Bool("read-only"),
+	}
+
+	if err := rCtx.SetCertPolicy(clientID, policy); err != nil {
+		return errors.Annotate(err, "set client cert policy")
+	}
+
+	logging.Logger.Infof("policy for id %q successfull saved: %s", clientID, policy)
+	return nil
+}
@@ -0,0 +1,147 @@
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/codegangsta/cli"
+	"github.com/denkhaus/llconf/context"
+	"github.com/denkhaus/llconf/logging"
+	"github.com/juju/errors"
+)
+
+func newServerPublisherCommand() cli.Command {
+	return cli.Command{
+		Name: "publisher",
+		Subcommands: []cli.Command{
+			{
+				Name: "add",
+				Flags: []cli.Flag{
+					cli.StringFlag{
+						Name:  "id",
+						Usage: "the id of the publisher",
+					},
+					cli.StringFlag{
+						Name:  "path",
+						Usage: "path to the cert or public key file of the publisher",
+					},
+				},
+				Action: func(ctx *cli.Context) error {
+					if err := serverPublisherAdd(ctx); err != nil {
+						logging.Logger.Error(err)
+					}
+					return nil
+				},
+			},
+			{
+				Name: "rm",
+				Flags: []cli.Flag{
+					cli.StringFlag{
+						Name:  "id",
+						Usage: "the id of the publisher",
+					},
+				},
+				Action: func(ctx *cli.Context) error {
+					if err := serverPublisherRm(ctx); err != nil {
+						logging.Logger.Error(err)
+					}
+					return nil
+				},
+			},
+			{
+				Name: "list",
+				Action: func(ctx *cli.Context) error {
+					if err := serverPublisherList(ctx); err != nil {
+						logging.Logger.Error(err)
+					}
+					return nil
+				},
+			},
+			{
+				Name:  "verify",
+				Flags: []cli.Flag{newServerNameFlag()},
+				Action: func(ctx *cli.Context) error {
+					if err := serverPublisherVerify(ctx); err != nil {
+						logging.Logger.Error(err)
+					}
+					return nil
+				},
+			},
+		},
+	}
+}
+
+func serverPublisherAdd(ctx *cli.Context) error {
+	logging.Logger.Infof("%s exec: server publisher add", ctx.App.Version)
+
+	rCtx, err := context.New(ctx, false, false)
+	if err != nil {
+		return errors.Annotate(err, "new run context")
+	}
+	defer rCtx.Close()
+
+	id := ctx.String("id")
+	if err := rCtx.AddPublisher(id, ctx.String("path")); err != nil {
+		return errors.Annotate(err, "add publisher")
+	}
+
+	logging.Logger.Infof("publisher %q successfull saved", id)
+	return nil
+}
+
+func serverPublisherRm(ctx *cli.Context) error {
+	logging.Logger.Infof("%s exec: server publisher rm", ctx.App.Version)
+
+	rCtx, err := context.New(ctx, false, false)
+	if err != nil {
+		return errors.Annotate(err, "new run context")
+	}
+	defer rCtx.Close()
+
+	id := ctx.String("id")
+	if err := rCtx.RemovePublisher(id); err != nil {
+		return errors.Annotate(err, "remove publisher")
+	}
+
+	logging.Logger.Infof("publisher %q successfull removed", id)
+	return nil
+}
+
+func serverPublisherList(ctx *cli.Context) error {
+	rCtx, err := context.New(ctx, false, false)
+	if err != nil {
+		return errors.Annotate(err, "new run context")
+	}
+	defer rCtx.Close()
+
+	ids, err := rCtx.ListPublishers()
+	if err != nil {
+		return errors.Annotate(err, "list publishers")
+	}
+
+	for _, id := range ids {
+		fmt.Println(id)
+	}
+
+	return nil
+}
+
+func serverPublisherVerify(ctx *cli.Context) error {
+	path := ctx.Args().First()
+	if path == "" {
+		return errors.New("no bundle path provided")
+	}
+
+	rCtx, err := context.New(ctx, false, false)
+	if err != nil {
+		return errors.Annotate(err, "new run context")
+	}
+	defer rCtx.Close()
+
+	publisher, err := rCtx.VerifyBundle(path)
+	if err != nil {
+		return errors.Annotate(err, "verify bundle")
+	}
+
+	logging.Logger.Infof("bundle %q is signed by publisher %q", path, publisher)
+	return nil
+}
@@ -1,6 +1,8 @@
 package cmd
 
 import (
+	"time"
+
 	"github.com/codegangsta/cli"
 	"github.com/denkhaus/llconf/context"
 	"github.com/denkhaus/llconf/logging"
@@ -16,6 +18,39 @@ func newServerRunCommand() cli.Command {
 				Name:  "no-redirect",
 				Usage: "do not redirect processing output to client",
 			},
+			cli.StringFlag{
+				Name:   "enroll-token",
+				Usage:  "accept a single client enrollment with this token of at least 32 characters",
+				EnvVar: "LLCONF_ENROLL_TOKEN",
+			},
+			cli.DurationFlag{
+				Name:  "enroll-ttl",
+				Usage: "the time the enrollment token is valid",
+				Value: time.Hour,
+			},
+			cli.IntFlag{
+				Name:  "enroll-port",
+				Usage: "the port of the enrollment endpoint, defaults to port + 1",
+			},
+			cli.StringSliceFlag{
+				Name:   "listen, l",
+				Usage:  "an address to listen on, eg. [::]:9954 or unix:///run/llconf.sock, defaults to host and port",
+				EnvVar: "LLCONF_LISTEN",
+				Value:  &cli.StringSlice{},
+			},
+			cli.DurationFlag{
+				Name:   "shutdown-timeout",
+				Usage:  "the time running evaluations may take to finish on shutdown or restart",
+				EnvVar: "LLCONF_SHUTDOWN_TIMEOUT",
+				Value:  5 * time.Minute,
+			},
+			cli.StringSliceFlag{
+				Name:   "relay",
+				Usage:  "a target pattern clients may relay commands to, eg. *.internal:9954",
+				EnvVar: "LLCONF_RELAY",
+				Value:  &cli.StringSlice{},
+			},
+			newServerNameFlag(),
 		},
 		Action: func(ctx *cli.Context) error {
 			if err := serverRun(ctx); err != nil {
@@ -0,0 +1,53 @@
+package cmd
+
+import (
+	"os"
+	"strings"
+
+	"github.com/codegangsta/cli"
+	"github.com/denkhaus/llconf/context"
+	"github.com/denkhaus/llconf/logging"
+	"github.com/denkhaus/llconf/util"
+	"github.com/juju/errors"
+)
+
+////////////////////////////////////////////////////////////////////////////////
+func newServerStdioCommand() cli.Command {
+	return cli.Command{
+		Name:  "stdio",
+		Usage: "serve a single client on stdin and stdout, eg. over ssh",
+		Flags: []cli.Flag{newServerNameFlag()},
+		Action: func(ctx *cli.Context) error {
+			if err := serverStdio(ctx); err != nil {
+				logging.Logger.Error(err)
+			}
+			return nil
+		},
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+func serverStdio(ctx *cli.Context) error {
+	// the protocol owns stdout, everything else is written to stderr
+	addr := "stdio"
+	if fields := strings.Fields(os.Getenv("SSH_CONNECTION")); len(fields) > 0 {
+		addr = fields[0]
+	}
+	conn := util.NewPipeConn(os.Stdin, os.Stdout, addr, nil)
+	os.Stdout = os.Stderr
+	logging.SetOutWriter(os.Stderr)
+
+	logging.Logger.Infof("%s exec: server stdio", ctx.App.Version)
+
+	rCtx, err := context.New(ctx, false, false)
+	if err != nil {
+		return errors.Annotate(err, "new stdio context")
+	}
+	defer rCtx.Close()
+
+	if err := rCtx.ServeConn(conn); err != nil {
+		return errors.Annotate(err, "serve stdio")
+	}
+
+	return nil
+}
@@ -3,6 +3,7 @@ package compiler
 import (
 	"io/ioutil"
 	"os"
+	"path"
 	"path/filepath"
 	"strings"
 	"sync"
@@ -10,12 +11,43 @@ import (
 	"github.com/denkhaus/llconf/compiler/parser"
 	"github.com/denkhaus/llconf/logging"
 	"github.com/denkhaus/llconf/promise"
+	"github.com/denkhaus/llconf/util"
 	"github.com/juju/errors"
 )
 
 var symlinks = make(map[string]string)
 
+const (
+	// ModuleFile marks a folder as module, which is only compiled if imported
+	ModuleFile = "module.cnf"
+	// VendorDir holds vendored modules, see package vendor
+	VendorDir = "vendor"
+)
+
 func Compile(folders ...string) (map[string]promise.Promise, error) {
+	inputs, err := readInputs(folders...)
+	if err != nil {
+		return nil, err
+	}
+
+	root, err := parser.ParseModule("", inputs)
+	if err != nil {
+		return nil, err
+	}
+
+	loader := moduleLoader{
+		folders: folders,
+		loaded:  make(map[string]*parser.Module),
+	}
+
+	if err := loader.link(root); err != nil {
+		return nil, err
+	}
+
+	return parser.Resolve(root)
+}
+
+func readInputs(folders ...string) ([]parser.Input, error) {
 	wg := &sync.WaitGroup{}
 	ch := make(chan string)
 
@@ -46,7 +78,79 @@ func Compile(folders ...string) (map[string]promise.Promise, error) {
 		})
 	}
 
-	return parser.Parse(inputs)
+	return inputs, nil
+}
+
+type moduleLoader struct {
+	folders []string
+	loaded  map[string]*parser.Module
+}
+
+// link loads the modules imported by module and links them recursively.
+// Every module folder is only loaded once, so import cycles are fine.
+func (p *moduleLoader) link(module *parser.Module) error {
+	for _, imp := range module.Imports() {
+		dir, err := p.find(imp.Path)
+		if err != nil {
+			return errors.Annotatef(err, "import at %s", imp.Pos)
+		}
+
+		dep, ok := p.loaded[dir]
+		if !ok {
+			inputs, err := readInputs(dir)
+			if err != nil {
+				return errors.Annotatef(err, "read module %q", imp.Path)
+			}
+
+			dep, err = parser.ParseModule(path.Base(imp.Path), inputs)
+			if err != nil {
+				return errors.Annotatef(err, "parse module %q", imp.Path)
+			}
+
+			p.loaded[dir] = dep
+			if err := p.link(dep); err != nil {
+				return err
+			}
+		}
+
+		module.Link(imp.Alias, dep)
+	}
+
+	return nil
+}
+
+// find looks up the module folder for an import path. Later folders take
+// precedence, so the input folder shadows the library folder and vendored
+// modules shadow plain ones.
+func (p *moduleLoader) find(importPath string) (string, error) {
+	if filepath.IsAbs(importPath) {
+		if isModuleDir(importPath) {
+			return filepath.Clean(importPath), nil
+		}
+		return "", errors.Errorf("module %q not found", importPath)
+	}
+
+	for i := len(p.folders) - 1; i >= 0; i-- {
+		for _, dir := range []string{
+			filepath.Join(p.folders[i], VendorDir, importPath),
+			filepath.Join(p.folders[i], importPath),
+		} {
+			if isModuleDir(dir) {
+				return dir, nil
+			}
+		}
+	}
+
+	return "", errors.Errorf("module %q not found", importPath)
+}
+
+func isModuleDir(dir string) bool {
+	return util.FileExists(filepath.Join(dir, ModuleFile))
+}
+
+// skipDir reports if a subfolder is excluded from flat compilation.
+func skipDir(dir string) bool {
+	return filepath.Base(dir) == VendorDir || isModuleDir(dir)
 }
 
 func listFiles(folder, suffix string, filename chan<- string) {
@@ -60,6 +164,16 @@ func listFiles(folder, suffix string, filename chan<- string) {
 			return err
 		}
 
+		if path != folder && skipDir(sym) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			if sym != path {
+				// symlinked module or vendor folder
+				return nil
+			}
+		}
+
 		if sym != path {
 			if _, ok := symlinks[sym]; !ok {
 				symlinks[sym] = path
@@ -1,6 +1,7 @@
 package lexer
 
 import (
+	"bytes"
 	"fmt"
 	"strings"
 	"unicode"
@@ -50,6 +51,12 @@ func (l *Lexer) errorf(format string, args ...interface{}) stateFn {
 }
 
 func (l *Lexer) emit(tt token.Type) {
+	l.emitValue(tt, l.input[l.start:l.pos])
+}
+
+// emitValue emits a token whose value differs from the raw input,
+// e.g. an argument with resolved escape sequences.
+func (l *Lexer) emitValue(tt token.Type, val string) {
 	token := token.Token{
 		Typ: tt,
 		Pos: token.Position{
@@ -57,7 +64,7 @@ func (l *Lexer) emit(tt token.Type) {
 			Line:  l.line(),
 			Start: l.start,
 			End:   l.pos},
-		Val: l.input[l.start:l.pos],
+		Val: val,
 	}
 	l.tokens <- token
 	l.start = l.pos
@@ -171,6 +178,12 @@ func lexInsidePromise(l *Lexer) stateFn {
 		case r == '"':
 			l.backup()
 			return lexArgument
+		case r == '`':
+			l.backup()
+			return lexRawArgument
+		case r == ';':
+			l.backup()
+			return lexLineComment
 		case unicode.IsSpace(r):
 			// ignore
 		default:
@@ -202,24 +215,63 @@ func lexArgument(l *Lexer) stateFn {
 	l.next()
 	l.emit(token.LeftArg)
 
+	var value bytes.Buffer
 	for {
 		switch r := l.next(); {
 		case r == eof:
 			return l.errorf("unexpected eof in argument")
+		case r == '\\':
+			switch e := l.next(); e {
+			case '"', '\\':
+				value.WriteRune(e)
+			case 'n':
+				value.WriteRune('\n')
+			case 't':
+				value.WriteRune('\t')
+			case eof:
+				return l.errorf("unexpected eof in argument")
+			default:
+				return l.errorf("unknown escape sequence in argument: \\%c", e)
+			}
 		case r == '"':
+			l.backup()
+			l.emitValue(token.Argument, value.String())
+			return lexArgumentClosing
+		default:
+			value.WriteRune(r)
+		}
+	}
+}
+
+// lexRawArgument lexes a backquoted argument, which may span multiple
+// lines and is taken literally without any escape processing.
+func lexRawArgument(l *Lexer) stateFn {
+	l.removeLeadingWhitespace()
+	l.next()
+	l.emit(token.LeftArg)
+
+	for {
+		switch r := l.next(); {
+		case r == eof:
+			return l.errorf("unexpected eof in raw argument")
+		case r == '`':
 			l.backup()
 			l.emit(token.Argument)
-			l.next()
-			l.emit(token.RightArg)
-			if l.getterDepth == 0 {
-				return lexInsidePromise
-			} else {
-				return lexInsideGetter
-			}
+			return lexArgumentClosing
 		}
 	}
 }
 
+func lexArgumentClosing(l *Lexer) stateFn {
+	l.next()
+	l.emit(token.RightArg)
+	if l.getterDepth == 0 {
+		return lexInsidePromise
+	} else {
+		return lexInsideGetter
+	}
+}
+
 func lexInsideGetter(l *Lexer) stateFn {
 	l.removeLeadingWhitespace()
 	for {
@@ -235,6 +287,12 @@ func lexInsideGetter(l *Lexer) stateFn {
 		case r == '"':
 			l.backup()
 			return lexArgument
+		case r == '`':
+			l.backup()
+			return lexRawArgument
+		case r == ';':
+			l.backup()
+			return lexLineComment
 		case unicode.IsSpace(r):
 			//ignore
 		default:
@@ -243,6 +301,28 @@ func lexInsideGetter(l *Lexer) stateFn {
 	}
 }
 
+// lexLineComment lexes a comment starting with ';' up to the end of the line.
+// The comment is emitted as a single token, so tooling can preserve it.
+func lexLineComment(l *Lexer) stateFn {
+	l.removeLeadingWhitespace()
+	for {
+		r := l.next()
+		if r == eof || r == '\n' {
+			if r == '\n' {
+				l.backup()
+			}
+			l.emit(token.Comment)
+			break
+		}
+	}
+
+	if l.getterDepth == 0 {
+		return lexInsidePromise
+	} else {
+		return lexInsideGetter
+	}
+}
+
 func lexGetterOpening(l *Lexer) stateFn {
 	l.next()
 	l.emit(token.LeftGetter)
@@ -268,11 +348,21 @@ func lexGetterType(l *Lexer) stateFn {
 			l.removeTrailingWhitespace()
 			l.emit(token.GetterType)
 			return lexArgument
+		case r == '`':
+			l.backup()
+			l.removeTrailingWhitespace()
+			l.emit(token.GetterType)
+			return lexRawArgument
 		case r == '[':
 			l.backup()
 			l.removeTrailingWhitespace()
 			l.emit(token.GetterType)
 			return lexInsideGetter
+		case r == ';':
+			l.backup()
+			l.removeTrailingWhitespace()
+			l.emit(token.GetterType)
+			return lexLineComment
 		}
 	}
 }
@@ -282,7 +372,7 @@ func lexGetterValue(l *Lexer) stateFn {
 		switch r := l.next(); {
 		case r == eof:
 			l.errorf("unclosed getter")
-		case isValidNameRune(r):
+		case isValidNameRune(r) || r == '.':
 			//continue
 		case r == ']':
 			l.backup()
@@ -292,6 +382,14 @@ func lexGetterValue(l *Lexer) stateFn {
 		case r == '"':
 			l.backup()
 			return lexArgument
+		case r == '`':
+			l.backup()
+			return lexRawArgument
+		case r == ';':
+			l.backup()
+			l.removeTrailingWhitespace()
+			l.emit(token.GetterValue)
+			return lexLineComment
 		default:
 			return l.errorf("unexpected char inside getter value: %q", r)
 		}
@@ -311,7 +409,7 @@ func lexGetterClosing(l *Lexer) stateFn {
 }
 
 func isValidNameRune(r rune) bool {
-	return r == '-' || r == '_' || r == ' ' || unicode.IsLetter(r) || unicode.IsDigit(r)
+	return r == '-' || r == '_' || r == ' ' || r == '/' || unicode.IsLetter(r) || unicode.IsDigit(r)
 }
 
 func isAlphaNumeric(r rune) bool {
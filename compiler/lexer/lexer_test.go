@@ -108,6 +108,16 @@ var tests = []test{
 		{token.RightGetter, 15, "]"},
 		{token.RightPromise, 17, ")"},
 		{token.EOF, 18, ""}}},
+	{"dotted getter", "(test [fact:os.distro])", []testToken{
+		{token.LeftPromise, 0, "("},
+		{token.PromiseName, 1, "test"},
+		{token.LeftGetter, 6, "["},
+		{token.GetterType, 7, "fact"},
+		{token.GetterSeparator, 11, ":"},
+		{token.GetterValue, 12, "os.distro"},
+		{token.RightGetter, 21, "]"},
+		{token.RightPromise, 22, ")"},
+		{token.EOF, 23, ""}}},
 	{"joiner", "(test [join [var:bla ] \" blubb\"])", []testToken{
 		{token.LeftPromise, 0, "("},
 		{token.PromiseName, 1, "test"},
@@ -138,6 +148,103 @@ var tests = []test{
 		{token.RightGetter, 26, "]"},
 		{token.RightPromise, 27, ")"},
 		{token.EOF, 28, ""}}},
+
+	{"escaped quote", `(test "a\"b")`, []testToken{
+		{token.LeftPromise, 0, "("},
+		{token.PromiseName, 1, "test"},
+		{token.LeftArg, 6, "\""},
+		{token.Argument, 7, "a\"b"},
+		{token.RightArg, 11, "\""},
+		{token.RightPromise, 12, ")"},
+		{token.EOF, 13, ""}}},
+	{"escape sequences", `(test "a\\b\nc\td")`, []testToken{
+		{token.LeftPromise, 0, "("},
+		{token.PromiseName, 1, "test"},
+		{token.LeftArg, 6, "\""},
+		{token.Argument, 7, "a\\b\nc\td"},
+		{token.RightArg, 17, "\""},
+		{token.RightPromise, 18, ")"},
+		{token.EOF, 19, ""}}},
+	{"unknown escape", `(test "a\qb")`, []testToken{
+		{token.LeftPromise, 0, "("},
+		{token.PromiseName, 1, "test"},
+		{token.LeftArg, 6, "\""},
+		{token.Error, 7, "unknown escape sequence in argument: \\q"}}},
+	{"escaped quote in getter", `(test [join "\"" [var:a]])`, []testToken{
+		{token.LeftPromise, 0, "("},
+		{token.PromiseName, 1, "test"},
+		{token.LeftGetter, 6, "["},
+		{token.GetterType, 7, "join"},
+		{token.LeftArg, 12, "\""},
+		{token.Argument, 13, "\""},
+		{token.RightArg, 15, "\""},
+		{token.LeftGetter, 17, "["},
+		{token.GetterType, 18, "var"},
+		{token.GetterSeparator, 21, ":"},
+		{token.GetterValue, 22, "a"},
+		{token.RightGetter, 23, "]"},
+		{token.RightGetter, 24, "]"},
+		{token.RightPromise, 25, ")"},
+		{token.EOF, 26, ""}}},
+
+	{"raw argument", "(test `a \"b\" \\n`)", []testToken{
+		{token.LeftPromise, 0, "("},
+		{token.PromiseName, 1, "test"},
+		{token.LeftArg, 6, "`"},
+		{token.Argument, 7, "a \"b\" \\n"},
+		{token.RightArg, 15, "`"},
+		{token.RightPromise, 16, ")"},
+		{token.EOF, 17, ""}}},
+	{"multi-line raw argument", "(test \"bash\" `\necho 1\necho 2\n`)", []testToken{
+		{token.LeftPromise, 0, "("},
+		{token.PromiseName, 1, "test"},
+		{token.LeftArg, 6, "\""},
+		{token.Argument, 7, "bash"},
+		{token.RightArg, 11, "\""},
+		{token.LeftArg, 13, "`"},
+		{token.Argument, 14, "\necho 1\necho 2\n"},
+		{token.RightArg, 29, "`"},
+		{token.RightPromise, 30, ")"},
+		{token.EOF, 31, ""}}},
+	{"unclosed raw argument", "(test `bla)", []testToken{
+		{token.LeftPromise, 0, "("},
+		{token.PromiseName, 1, "test"},
+		{token.LeftArg, 6, "`"},
+		{token.Error, 7, "unexpected eof in raw argument"}}},
+
+	{"comment in promise", "(hello ; greet\n (world) ; done\n)", []testToken{
+		{token.LeftPromise, 0, "("},
+		{token.PromiseName, 1, "hello"},
+		{token.Comment, 7, "; greet"},
+		{token.LeftPromise, 16, "("},
+		{token.PromiseName, 17, "world"},
+		{token.RightPromise, 22, ")"},
+		{token.Comment, 24, "; done"},
+		{token.RightPromise, 31, ")"},
+		{token.EOF, 32, ""}}},
+	{"comment in getter", "(test [join ; parts\n [var:a ; first\n] \"b\"])", []testToken{
+		{token.LeftPromise, 0, "("},
+		{token.PromiseName, 1, "test"},
+		{token.LeftGetter, 6, "["},
+		{token.GetterType, 7, "join"},
+		{token.Comment, 12, "; parts"},
+		{token.LeftGetter, 21, "["},
+		{token.GetterType, 22, "var"},
+		{token.GetterSeparator, 25, ":"},
+		{token.GetterValue, 26, "a"},
+		{token.Comment, 28, "; first"},
+		{token.RightGetter, 36, "]"},
+		{token.LeftArg, 38, "\""},
+		{token.Argument, 39, "b"},
+		{token.RightArg, 40, "\""},
+		{token.RightGetter, 41, "]"},
+		{token.RightPromise, 42, ")"},
+		{token.EOF, 43, ""}}},
+	{"comment at eof", "(hello ; greet", []testToken{
+		{token.LeftPromise, 0, "("},
+		{token.PromiseName, 1, "hello"},
+		{token.Comment, 7, "; greet"},
+		{token.Error, 14, "unexpected eof in promise"}}},
 }
 
 func TestLexer(t *testing.T) {
@@ -0,0 +1,143 @@
+package parser
+
+import (
+	"errors"
+	"path"
+	"strings"
+
+	"github.com/denkhaus/llconf/compiler/token"
+	"github.com/denkhaus/llconf/promise"
+)
+
+// Import is an (import "path" ["alias"]) declaration of a module.
+type Import struct {
+	Path  string
+	Alias string
+	Pos   token.Position
+}
+
+// Module is a namespace of promises. Promises of a module are only
+// visible to other modules if they are exported, and only by their
+// qualified name "alias/name".
+type Module struct {
+	Name       string
+	promises   Tree
+	exports    map[string]token.Position
+	importDecl []Import
+	imports    map[string]*Module
+}
+
+func newModule(name string) *Module {
+	return &Module{
+		Name:     name,
+		promises: Tree{},
+		exports:  map[string]token.Position{},
+		imports:  map[string]*Module{},
+	}
+}
+
+// Imports returns the import declarations of the module.
+func (m *Module) Imports() []Import {
+	return m.importDecl
+}
+
+// Link makes the exported promises of dep available under alias.
+func (m *Module) Link(alias string, dep *Module) {
+	m.imports[alias] = dep
+}
+
+// qualify returns name in the namespace ns, which is the chain of import
+// aliases a module is reached by, so modules sharing a base name do not
+// collide.
+func qualify(ns, name string) string {
+	if ns == "" {
+		return name
+	}
+	return ns + NamespaceSeparator + name
+}
+
+// lookup finds the named promise a name refers to, the module it has to
+// be resolved in and the namespace of that module relative to ns. A nil
+// module denotes a builtin.
+func (m *Module) lookup(name, ns string) (UnresolvedPromise, *Module, string, error) {
+	if u, present := m.promises[name]; present {
+		return u, m, ns, nil
+	}
+
+	idx := strings.Index(name, NamespaceSeparator)
+	if idx < 0 {
+		return UnresolvedPromise{}, nil, "", nil
+	}
+
+	alias, local := name[:idx], name[idx+1:]
+	dep, present := m.imports[alias]
+	if !present {
+		return UnresolvedPromise{}, nil, "", errors.New("module " + alias + " is not imported")
+	}
+
+	if _, exported := dep.exports[local]; !exported {
+		return UnresolvedPromise{}, nil, "", errors.New("promise (" + local +
+			") is not exported by module " + alias)
+	}
+
+	return dep.promises[local], dep, qualify(ns, alias), nil
+}
+
+func (m *Module) addImport(p UnresolvedPromise) error {
+	if len(p.children) != 0 || len(p.args) < 1 || len(p.args) > 2 {
+		return errors.New("use (import \"path\" [\"alias\"]) at " + p.pos.String())
+	}
+
+	values, err := constantArgs(p)
+	if err != nil {
+		return err
+	}
+
+	imp := Import{Path: values[0], Alias: path.Base(values[0]), Pos: p.pos}
+	if len(values) == 2 {
+		imp.Alias = values[1]
+	}
+
+	if imp.Alias == "" || strings.Contains(imp.Alias, NamespaceSeparator) {
+		return errors.New("invalid import alias " + imp.Alias + " at " + p.pos.String())
+	}
+
+	for _, i := range m.importDecl {
+		if i.Alias == imp.Alias {
+			return errors.New("found duplicate import: " + imp.Alias + " at " + p.pos.String())
+		}
+	}
+
+	m.importDecl = append(m.importDecl, imp)
+	return nil
+}
+
+func (m *Module) addExport(p UnresolvedPromise) error {
+	if len(p.children) != 0 || len(p.args) == 0 {
+		return errors.New("use (export \"name\" ...) at " + p.pos.String())
+	}
+
+	values, err := constantArgs(p)
+	if err != nil {
+		return err
+	}
+
+	for _, v := range values {
+		m.exports[v] = p.pos
+	}
+
+	return nil
+}
+
+func constantArgs(p UnresolvedPromise) ([]string, error) {
+	values := []string{}
+	for _, a := range p.args {
+		c, ok := a.(promise.Constant)
+		if !ok {
+			return nil, errors.New("(" + p.name + ") only accepts string arguments at " +
+				p.pos.String())
+		}
+		values = append(values, string(c))
+	}
+	return values, nil
+}
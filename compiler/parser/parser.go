@@ -3,7 +3,9 @@ package parser
 import (
 	"errors"
 	"fmt"
+	"sort"
 	"strconv"
+	"strings"
 
 	"github.com/denkhaus/llconf/compiler/lexer"
 	"github.com/denkhaus/llconf/compiler/token"
@@ -14,6 +16,9 @@ var builtins = map[string]promise.Promise{
 	"or":       promise.OrPromise{},
 	"and":      promise.AndPromise{},
 	"not":      promise.NotPromise{},
+	"if":       promise.IfPromise{},
+	"when":     promise.WhenPromise{},
+	"foreach":  promise.ForeachPromise{},
 	"test":     promise.ExecPromise{Type: promise.ExecTest},
 	"indir":    promise.InDir{},
 	"setenv":   promise.SetEnv{},
@@ -33,6 +38,34 @@ var builtins = map[string]promise.Promise{
 	"info":     promise.LogPromise{Type: promise.LogTypeInfo},
 }
 
+// Builtin returns the prototype of the builtin promise name.
+func Builtin(name string) (promise.Promise, bool) {
+	p, ok := builtins[name]
+	return p, ok
+}
+
+// BuiltinNames returns the sorted names of all builtin promises.
+func BuiltinNames() []string {
+	names := []string{}
+	for name := range builtins {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+	return names
+}
+
+const (
+	importDirective = "import"
+	exportDirective = "export"
+	// paramsDeclaration declares the parameters of a named promise
+	// as its first child
+	paramsDeclaration = "params"
+	// NamespaceSeparator separates the module alias from the promise
+	// name in qualified names like "nginx/installed"
+	NamespaceSeparator = "/"
+)
+
 type UnresolvedPromise struct {
 	name     string
 	children []UnresolvedPromise
@@ -59,34 +92,67 @@ func (p UnresolvedPromise) String() string {
 }
 
 func (p *UnresolvedPromise) resolvePrimary(
-	unresolved Tree,
+	module *Module,
+	ns string,
 	builtins map[string]promise.Promise) (promise.NamedPromise, error) {
 
-	if len(p.children) != 1 {
+	children := p.children
+	var params []promise.Param
+	if len(children) > 0 && children[0].name == paramsDeclaration {
+		var err error
+		if params, err = children[0].parseParams(); err != nil {
+			return promise.NamedPromise{}, err
+		}
+		children = children[1:]
+	}
+
+	if len(children) != 1 {
 		return promise.NamedPromise{}, errors.New("named promise needs exactly one child, found " +
-			strconv.Itoa(len(p.children)) + " " + p.pos.String())
+			strconv.Itoa(len(children)) + " " + p.pos.String())
 	}
 
-	if child, err := p.children[0].resolve(unresolved, builtins); err == nil {
-		return promise.NamedPromise{Name: p.name, Promise: child}, nil
+	if child, err := children[0].resolve(module, ns, builtins, params); err == nil {
+		return promise.NamedPromise{Name: qualify(ns, p.name), Promise: child, Params: params}, nil
 	} else {
 		return promise.NamedPromise{}, err
 	}
 }
 
 func (p *UnresolvedPromise) resolve(
-	unresolved Tree,
-	builtins map[string]promise.Promise) (promise.Promise, error) {
+	module *Module,
+	ns string,
+	builtins map[string]promise.Promise,
+	params []promise.Param) (promise.Promise, error) {
+
+	args := []promise.Argument{}
+	for _, a := range p.args {
+		if b, err := promise.BindParams(a, params); err == nil {
+			args = append(args, b)
+		} else {
+			return nil, errors.New(err.Error() + " at " + p.pos.String())
+		}
+	}
+
+	u, owner, ownerNs, err := module.lookup(p.name, ns)
+	if err != nil {
+		return nil, errors.New(err.Error() + " at " + p.pos.String())
+	}
 
-	if u, present := unresolved[p.name]; present {
-		t, e := u.resolvePrimary(unresolved, builtins)
-		t.Arguments = p.args
-		return t, e
+	if owner != nil {
+		t, e := u.resolvePrimary(owner, ownerNs, builtins)
+		if e != nil {
+			return nil, e
+		}
+		if e := checkArity(t, len(args)); e != nil {
+			return nil, errors.New(e.Error() + " at " + p.pos.String())
+		}
+		t.Arguments = args
+		return t, nil
 	}
 
 	children := []promise.Promise{}
 	for _, c := range p.children {
-		if r, e := c.resolve(unresolved, builtins); e == nil {
+		if r, e := c.resolve(module, ns, builtins, params); e == nil {
 			children = append(children, r)
 		} else {
 			return nil, e
@@ -94,7 +160,7 @@ func (p *UnresolvedPromise) resolve(
 	}
 
 	if _, present := builtins[p.name]; present {
-		if promise, err := builtins[p.name].New(children, p.args); err == nil {
+		if promise, err := builtins[p.name].New(children, args); err == nil {
 			return promise, nil
 		} else {
 			return nil, errors.New(err.Error() + " at " + p.pos.String())
@@ -105,6 +171,66 @@ func (p *UnresolvedPromise) resolve(
 		p.name + ") at " + p.pos.String())
 }
 
+// parseParams parses a (params "name" "name=default" ...) declaration.
+func (p *UnresolvedPromise) parseParams() ([]promise.Param, error) {
+	if len(p.children) != 0 {
+		return nil, errors.New("nested promises not allowed in (params) at " + p.pos.String())
+	}
+
+	values, err := constantArgs(*p)
+	if err != nil {
+		return nil, err
+	}
+
+	params := []promise.Param{}
+	seen := map[string]bool{}
+	for _, v := range values {
+		param := promise.Param{Name: v}
+		if idx := strings.Index(v, "="); idx >= 0 {
+			param = promise.Param{Name: v[:idx], Default: v[idx+1:], HasDefault: true}
+		} else if len(params) > 0 && params[len(params)-1].HasDefault {
+			return nil, errors.New("parameter " + strconv.Quote(v) +
+				" without default follows parameter with default at " + p.pos.String())
+		}
+
+		if param.Name == "" || seen[param.Name] {
+			return nil, errors.New("invalid or duplicate parameter " +
+				strconv.Quote(param.Name) + " at " + p.pos.String())
+		}
+
+		seen[param.Name] = true
+		params = append(params, param)
+	}
+
+	return params, nil
+}
+
+// checkArity checks the number of arguments passed to a named promise
+// against its declared parameters. Promises without declaration accept
+// any number of arguments.
+func checkArity(p promise.NamedPromise, n int) error {
+	if p.Params == nil {
+		return nil
+	}
+
+	required := 0
+	for _, param := range p.Params {
+		if !param.HasDefault {
+			required++
+		}
+	}
+
+	if n < required || n > len(p.Params) {
+		if required == len(p.Params) {
+			return fmt.Errorf("(%s) expects %d arguments, found %d", p.Name, required, n)
+		}
+		return fmt.Errorf("(%s) expects %d to %d arguments, found %d",
+			p.Name, required, len(p.Params), n)
+	}
+
+	return nil
+}
+
 func parseGetter(l *lexer.Lexer) (promise.Argument, error) {
 	var typ string
 	var getter promise.Argument
@@ -114,9 +240,22 @@ func parseGetter(l *lexer.Lexer) (promise.Argument, error) {
 		case t.Typ == token.Error:
 			return nil, errors.New(t.Val + " " + t.Pos.String())
 		case t.Typ == token.GetterType:
-			if t.Val == "join" {
+			switch {
+			case t.Val == "join":
 				return parseJoiner(l)
-			} else {
+			case t.Val == "default":
+				args, err := parseGetterArgs(l)
+				if err != nil {
+					return nil, err
+				}
+				return promise.NewDefaultGetter(args)
+			case promise.IsStringGetter(t.Val):
+				args, err := parseGetterArgs(l)
+				if err != nil {
+					return nil, err
+				}
+				return promise.NewStringGetter(t.Val, args)
+			default:
 				typ = t.Val
 			}
 		case t.Typ == token.GetterValue:
@@ -131,6 +270,12 @@ func parseGetter(l *lexer.Lexer) (promise.Argument, error) {
 				getter = promise.EnvGetter{Name: t.Val}
 			case "var":
 				getter = promise.VarGetter{Name: t.Val}
+			case "var?":
+				getter = promise.VarGetter{Name: t.Val, Optional: true}
+			case "param":
+				getter = promise.ParamGetter{Name: t.Val, Position: -1}
+			case "fact":
+				getter = promise.FactGetter{Name: t.Val}
 			default:
 				return nil, fmt.Errorf("unknown getter type: %q", t.Val)
 			}
@@ -141,28 +286,40 @@ func parseGetter(l *lexer.Lexer) (promise.Argument, error) {
 }
 
 func parseJoiner(l *lexer.Lexer) (promise.Argument, error) {
+	args, err := parseGetterArgs(l)
+	if err != nil {
+		return nil, err
+	}
+
+	return promise.JoinArgument{Args: args}, nil
+}
 
-	joiner := promise.JoinArgument{}
+// parseGetterArgs parses the arguments of a composite getter
+// up to and including its closing bracket.
+func parseGetterArgs(l *lexer.Lexer) ([]promise.Argument, error) {
+	args := []promise.Argument{}
 
 	for {
 		t := l.NextToken()
 		switch t.Typ {
 		case token.LeftArg:
 			if arg, err := parseArg(l); err == nil {
-				joiner.Args = append(joiner.Args, arg)
+				args = append(args, arg)
 			} else {
 				return nil, err
 			}
 		case token.LeftGetter:
 			if get, err := parseGetter(l); err == nil {
-				joiner.Args = append(joiner.Args, get)
+				args = append(args, get)
 			} else {
 				return nil, err
 			}
 		case token.RightGetter:
-			return joiner, nil
+			return args, nil
+		case token.Comment:
+			// ignore
 		default:
-			return nil, fmt.Errorf("unexpected token in joiner: %q in %s", t.Val, t.Pos.String())
+			return nil, fmt.Errorf("unexpected token in getter: %q in %s", t.Val, t.Pos.String())
 		}
 	}
 }
@@ -223,7 +380,7 @@ func (p *UnresolvedPromise) parse(l *lexer.Lexer) error {
 
 type Tree map[string]UnresolvedPromise
 
-func (tree Tree) generatePromises(l *lexer.Lexer) error {
+func (tree Tree) generatePromises(l *lexer.Lexer, module *Module) error {
 	for {
 		t := l.NextToken()
 		switch {
@@ -233,6 +390,25 @@ func (tree Tree) generatePromises(l *lexer.Lexer) error {
 			if err := p.parse(l); err != nil {
 				return err
 			}
+
+			switch p.name {
+			case importDirective:
+				if err := module.addImport(p); err != nil {
+					return err
+				}
+				continue
+			case exportDirective:
+				if err := module.addExport(p); err != nil {
+					return err
+				}
+				continue
+			}
+
+			if strings.Contains(p.name, NamespaceSeparator) {
+				return errors.New("promise names must not contain " +
+					strconv.Quote(NamespaceSeparator) + ": " + p.name + " at " + p.pos.String())
+			}
+
 			if _, present := tree[p.name]; present {
 				return errors.New("found duplicate promise: " +
 					p.name + " at " + p.pos.String())
@@ -247,26 +423,62 @@ func (tree Tree) generatePromises(l *lexer.Lexer) error {
 	}
 }
 
+// Parse parses and resolves the inputs as one flat namespace.
 func Parse(inputs []Input) (map[string]promise.Promise, error) {
-	unresolved := Tree{}
+	module, err := ParseModule("", inputs)
+	if err != nil {
+		return nil, err
+	}
+
+	return Resolve(module)
+}
+
+// ParseModule parses the inputs of a single module without resolving them.
+// The imports of the module have to be linked before it can be resolved.
+func ParseModule(name string, inputs []Input) (*Module, error) {
+	module := newModule(name)
 
 	for _, input := range inputs {
 		l := lexer.Lex(input.File, input.String)
-		err := unresolved.generatePromises(l)
+		err := module.promises.generatePromises(l, module)
 		if err != nil {
 			return nil, err
 		}
 	}
 
+	for name, pos := range module.exports {
+		if _, present := module.promises[name]; !present {
+			return nil, errors.New("exported promise (" + name +
+				") is not defined at " + pos.String())
+		}
+	}
+
+	return module, nil
+}
+
+// Resolve resolves all promises of the module. Exported promises of
+// imported modules are included by their qualified names.
+func Resolve(module *Module) (map[string]promise.Promise, error) {
 	resolved := map[string]promise.Promise{}
 
-	for k, p := range unresolved {
-		if r, e := p.resolvePrimary(unresolved, builtins); e == nil {
+	for k, p := range module.promises {
+		if r, e := p.resolvePrimary(module, module.Name, builtins); e == nil {
 			resolved[k] = r
 		} else {
 			return nil, e
 		}
 	}
 
+	for alias, imported := range module.imports {
+		for name := range imported.exports {
+			p := imported.promises[name]
+			if r, e := p.resolvePrimary(imported, qualify(module.Name, alias), builtins); e == nil {
+				resolved[alias+NamespaceSeparator+name] = r
+			} else {
+				return nil, e
+			}
+		}
+	}
+
 	return resolved, nil
 }
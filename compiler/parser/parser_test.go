@@ -2,6 +2,7 @@ package parser
 
 import (
 	"fmt"
+	"path"
 	"reflect"
 	"strings"
 	"testing"
@@ -85,6 +86,48 @@ func TestGetter(t *testing.T) {
 	}
 }
 
+func TestComments(t *testing.T) {
+	p, err := Parse([]Input{{"main.cnf",
+		`(hallo ; say hello
+  (test "echo" ; the command
+    [join "hello " ; greeting
+      [var:name]])) ; who`}})
+	if err != nil {
+		t.Errorf("TestComments: %s", err)
+	} else {
+		args := p["hallo"].(promise.NamedPromise).Promise.(promise.ExecPromise).Arguments
+		if len(args) != 2 {
+			t.Errorf("TestComments: expected 2 arguments, found %d", len(args))
+		}
+	}
+}
+
+func TestStringGetters(t *testing.T) {
+	p, err := Parse([]Input{{"main.cnf",
+		`(site (params "name")
+  (test "echo" [upper [default [var:prefix] "www"]]
+    [path-join "/srv" [lower [param:name]]]))
+(main (site "Example"))`}})
+	if err != nil {
+		t.Fatalf("TestStringGetters: %s", err)
+	}
+
+	args := p["site"].(promise.NamedPromise).Promise.(promise.ExecPromise).Arguments
+	vars := promise.Variables{}
+	if v := args[1].GetValue([]promise.Constant{}, &vars); v != "WWW" {
+		t.Errorf("TestStringGetters: expected \"WWW\", found %q", v)
+	}
+	if v := args[2].GetValue([]promise.Constant{"Example"}, &vars); v != "/srv/example" {
+		t.Errorf("TestStringGetters: expected \"/srv/example\", found %q", v)
+	}
+}
+
+func TestStringGetterArity(t *testing.T) {
+	if _, err := Parse([]Input{{"main.cnf", `(hallo (test "echo" [replace "a" "b"]))`}}); err == nil {
+		t.Errorf("TestStringGetterArity: expected exception")
+	}
+}
+
 func TestUnknownPromise(t *testing.T) {
 	_, err := Parse([]Input{{"main.cnf", "(hallo (welt))"}})
 	if err == nil {
@@ -119,3 +162,178 @@ func TestNestedInExec(t *testing.T) {
 		t.Errorf("TestNestedInExec: %s", err.Error())
 	}
 }
+
+func parseModules(root string, modules map[string]string) (map[string]promise.Promise, error) {
+	mod, err := ParseModule("", []Input{{"main.cnf", root}})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, imp := range mod.Imports() {
+		dep, err := ParseModule(path.Base(imp.Path), []Input{{imp.Path + "/module.cnf", modules[imp.Path]}})
+		if err != nil {
+			return nil, err
+		}
+		mod.Link(imp.Alias, dep)
+	}
+
+	return Resolve(mod)
+}
+
+func TestImportModule(t *testing.T) {
+	p, err := parseModules(
+		`(import "lib/nginx")
+ (done (nginx/installed "nginx"))`,
+		map[string]string{"lib/nginx": `(export "installed")
+ (installed (package present))
+ (package present (test "dpkg" "-s" [arg:0]))`})
+
+	if err != nil {
+		t.Fatalf("TestImportModule: %s", err)
+	}
+
+	named := p["done"].(promise.NamedPromise).Promise.(promise.NamedPromise)
+	if named.Name != "nginx/installed" {
+		t.Errorf("TestImportModule: expected qualified name, found %q", named.Name)
+	}
+
+	if _, ok := p["nginx/installed"]; !ok {
+		t.Errorf("TestImportModule: exported promise not in result")
+	}
+}
+
+func TestImportAlias(t *testing.T) {
+	_, err := parseModules(
+		`(import "lib/nginx" "web")
+ (done (web/installed))`,
+		map[string]string{"lib/nginx": `(export "installed")
+ (installed (test "true"))`})
+
+	if err != nil {
+		t.Errorf("TestImportAlias: %s", err)
+	}
+}
+
+func TestImportSameBaseName(t *testing.T) {
+	p, err := parseModules(
+		`(import "a/util" "autil")
+ (import "b/util" "butil")
+ (done (and (autil/check) (butil/check)))`,
+		map[string]string{
+			"a/util": `(export "check")
+ (check (helper))
+ (helper (test "true"))`,
+			"b/util": `(export "check")
+ (check (helper))
+ (helper (test "false"))`,
+		})
+
+	if err != nil {
+		t.Fatalf("TestImportSameBaseName: %s", err)
+	}
+
+	names := []string{}
+	and := p["done"].(promise.NamedPromise).Promise.(promise.AndPromise)
+	for _, c := range and.Promises {
+		check := c.(promise.NamedPromise)
+		names = append(names, check.Name, check.Promise.(promise.NamedPromise).Name)
+	}
+
+	expected := []string{"autil/check", "autil/helper", "butil/check", "butil/helper"}
+	if strings.Join(names, " ") != strings.Join(expected, " ") {
+		t.Errorf("TestImportSameBaseName: expected %v, found %v", expected, names)
+	}
+}
+
+func TestImportNoNameCollision(t *testing.T) {
+	_, err := parseModules(
+		`(import "lib/nginx")
+ (installed (test "false"))
+ (done (and (installed) (nginx/installed)))`,
+		map[string]string{"lib/nginx": `(export "installed")
+ (installed (test "true"))`})
+
+	if err != nil {
+		t.Errorf("TestImportNoNameCollision: %s", err)
+	}
+}
+
+func TestImportUnexported(t *testing.T) {
+	_, err := parseModules(
+		`(import "lib/nginx")
+ (done (nginx/helper))`,
+		map[string]string{"lib/nginx": `(export "installed")
+ (installed (helper))
+ (helper (test "true"))`})
+
+	if err == nil {
+		t.Errorf("TestImportUnexported: expected exception")
+	}
+}
+
+func TestNotImported(t *testing.T) {
+	_, err := Parse([]Input{{"main.cnf", "(done (nginx/installed))"}})
+	if err == nil {
+		t.Errorf("TestNotImported: expected exception")
+	}
+}
+
+func TestExportUndefined(t *testing.T) {
+	_, err := ParseModule("nginx", []Input{{"module.cnf", `(export "installed")`}})
+	if err == nil {
+		t.Errorf("TestExportUndefined: expected exception")
+	}
+}
+
+func TestQualifiedDefinition(t *testing.T) {
+	_, err := Parse([]Input{{"main.cnf", `(nginx/installed (test "true"))`}})
+	if err == nil {
+		t.Errorf("TestQualifiedDefinition: expected exception")
+	}
+}
+
+func TestParams(t *testing.T) {
+	p, err := Parse([]Input{{"main.cnf",
+		`(done (and (nginx site "example.com") (nginx site "example.org" "8080")))
+ (nginx site (params "name" "port=80")
+   (test "echo" [join [param:name] ":" [param:port]]))`}})
+
+	if err != nil {
+		t.Fatalf("TestParams: %s", err)
+	}
+
+	join := p["nginx site"].(promise.NamedPromise).Promise.(promise.ExecPromise).Arguments[1]
+	if port := join.(promise.JoinArgument).Args[2].(promise.ParamGetter); port.Position != 1 {
+		t.Errorf("TestParams: parameter not bound to its position, found %d", port.Position)
+	}
+
+	if len(p["nginx site"].(promise.NamedPromise).Params) != 2 {
+		t.Errorf("TestParams: parameters not declared")
+	}
+}
+
+func TestParamsArity(t *testing.T) {
+	for _, call := range []string{`(nginx site)`, `(nginx site "a" "b" "c")`} {
+		_, err := Parse([]Input{{"main.cnf", `(done ` + call + `)
+ (nginx site (params "name" "port=80") (test "echo" [param:name]))`}})
+		if err == nil {
+			t.Errorf("TestParamsArity: expected exception for %s", call)
+		}
+	}
+}
+
+func TestUnknownParam(t *testing.T) {
+	_, err := Parse([]Input{{"main.cnf",
+		`(nginx site (params "name") (test "echo" [param:port]))`}})
+	if err == nil {
+		t.Errorf("TestUnknownParam: expected exception")
+	}
+}
+
+func TestParamWithoutDefaultAfterDefault(t *testing.T) {
+	_, err := Parse([]Input{{"main.cnf",
+		`(nginx site (params "port=80" "name") (test "echo" [param:name]))`}})
+	if err == nil {
+		t.Errorf("TestParamWithoutDefaultAfterDefault: expected exception")
+	}
+}
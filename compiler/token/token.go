@@ -36,6 +36,7 @@ const (
 
 var tokenNames = [...]string{
 	Error:           "Error",
+	Comment:         "Comment",
 	LeftPromise:     "LeftPromise",
 	RightPromise:    "RightPromise",
 	PromiseName:     "PromiseName",
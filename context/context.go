@@ -2,12 +2,13 @@ package context
 
 import (
 	"bytes"
+	"crypto/hmac"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/tls"
 	"crypto/x509"
 	"crypto/x509/pkix"
-	"encoding/gob"
+	"encoding/json"
 	"encoding/pem"
 	"math/big"
 	"net"
@@ -23,17 +24,26 @@ import (
 	"os/user"
 	"path"
 	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
 	"time"
 
 	syslogger "github.com/Sirupsen/logrus/hooks/syslog"
 	"github.com/codegangsta/cli"
 	"github.com/denkhaus/goagain"
+	"github.com/denkhaus/llconf/bundle"
+	"github.com/denkhaus/llconf/ca"
 	"github.com/denkhaus/llconf/compiler"
+	"github.com/denkhaus/llconf/facts"
 	"github.com/denkhaus/llconf/logging"
+	"github.com/denkhaus/llconf/modules"
 	"github.com/denkhaus/llconf/promise"
 	"github.com/denkhaus/llconf/server"
+	"github.com/denkhaus/llconf/source"
 	"github.com/denkhaus/llconf/store"
 	"github.com/denkhaus/llconf/util"
+	"github.com/denkhaus/llconf/wire"
 	"github.com/docker/libchan"
 	"github.com/docker/libchan/spdy"
 	"github.com/juju/errors"
@@ -42,13 +52,28 @@ import (
 //////////////////////////////////////////////////////////////////////////////////
 type RemoteCommand struct {
 	Data          []byte
+	Source        []byte
+	Blobs         [][]byte
+	Attachments   []Attachment
+	Signature     []byte
+	Targets       []string
+	NotAfter      time.Time
 	Stdout        io.Reader
+	Output        io.Writer
+	Cancel        libchan.Receiver
 	SendChannel   libchan.Sender
+	Target        string
 	Verbose       bool
 	Debug         bool
 	ClientVersion string
 }
 
+//////////////////////////////////////////////////////////////////////////////////
+type Attachment struct {
+	Path    string
+	Content io.ReadCloser
+}
+
 //////////////////////////////////////////////////////////////////////////////////
 type context struct {
 	verbose            bool
@@ -56,17 +81,36 @@ type context struct {
 	useSyslog          bool
 	noRedirect         bool
 	port               int
+	enrollPort         int
+	enrollToken        string
+	enrollTTL          time.Duration
+	shutdownTimeout    time.Duration
+	listenAddresses    []util.Address
 	clientVersion      string
 	rootPromise        string
 	LibDir             string
+	CADir              string
 	InputDir           string
 	workDir            string
 	runlogPath         string
 	host               string
 	settingsDir        string
 	dataStore          *store.DataStore
+	dataStoreID        string
+	dataStorePath      string
+	certMutex          sync.Mutex
+	serverCert         *tls.Certificate
+	serverCertModTime  time.Time
 	clientPrivKeyPath  string
 	clientCertFilePath string
+	signKeyPath        string
+	sendSource         bool
+	attachPaths        []string
+	sshCommand         string
+	sshUpload          bool
+	target             string
+	relayTargets       []string
+	serverNames        []string
 	serverPrivKeyPath  string
 	serverCertFilePath string
 	certRole           string
@@ -74,6 +118,8 @@ type context struct {
 	sender             libchan.Sender
 	receiver           libchan.Receiver
 	remoteSender       libchan.Sender
+	cancelMutex        sync.Mutex
+	cancelSender       libchan.Sender
 }
 
 //////////////////////////////////////////////////////////////////////////////////
@@ -104,6 +150,23 @@ func (p *context) Close() error {
 	return nil
 }
 
+//////////////////////////////////////////////////////////////////////////////////
+// openDataStore opens the data store on first use, so commands that
+// do not need it can run beside a server holding its lock.
+func (p *context) openDataStore() (*store.DataStore, error) {
+	if p.dataStore != nil {
+		return p.dataStore, nil
+	}
+
+	ds, err := store.New(p.dataStoreID, p.certRole, p.dataStorePath)
+	if err != nil {
+		return nil, errors.Annotate(err, "create data store")
+	}
+
+	p.dataStore = ds
+	return ds, nil
+}
+
 ////////////////////////////////////////////////////////////////////////////////
 func (p *context) clientSignalHandler() {
 	sigChan := make(chan os.Signal, 1)
@@ -112,9 +175,15 @@ func (p *context) clientSignalHandler() {
 		syscall.SIGINT)
 
 	sig := <-sigChan
-	signal.Stop(sigChan)
 	logging.Logger.Infof("%s signal received", sig.String())
 
+	if p.requestCancel(sig.String()) {
+		logging.Logger.Warn("cancel requested, waiting for the server, signal again to quit")
+		sig = <-sigChan
+		logging.Logger.Infof("%s signal received", sig.String())
+	}
+	signal.Stop(sigChan)
+
 	if err := p.Close(); err != nil {
 		logging.Logger.Error(errors.Annotate(err, "close context"))
 		os.Exit(1)
@@ -123,6 +192,25 @@ func (p *context) clientSignalHandler() {
 	}
 }
 
+//////////////////////////////////////////////////////////////////////////////////
+// requestCancel asks the server to cancel the running command
+// and reports whether one was running.
+func (p *context) requestCancel(reason string) bool {
+	p.cancelMutex.Lock()
+	defer p.cancelMutex.Unlock()
+
+	if p.cancelSender == nil {
+		return false
+	}
+
+	if err := p.cancelSender.Send(&server.CancelRequest{Reason: reason}); err != nil {
+		logging.Logger.Error(errors.Annotate(err, "send cancel request"))
+		return false
+	}
+
+	return true
+}
+
 //////////////////////////////////////////////////////////////////////////////////
 func (p *context) upgradeLogging() error {
 	if p.useSyslog {
@@ -145,7 +233,7 @@ func (p *context) ensureClientCert() error {
 	}
 
 	logging.Logger.Info("create client certificates")
-	return p.generateCert(p.clientPrivKeyPath, p.clientCertFilePath)
+	return p.generateCert(ca.RoleClient, p.clientPrivKeyPath, p.clientCertFilePath)
 }
 
 //////////////////////////////////////////////////////////////////////////////////
@@ -156,11 +244,15 @@ func (p *context) ensureServerCert() error {
 	}
 
 	logging.Logger.Info("create server certificates")
-	return p.generateCert(p.serverPrivKeyPath, p.serverCertFilePath)
+	return p.generateCert(ca.RoleServer, p.serverPrivKeyPath, p.serverCertFilePath)
 }
 
 //////////////////////////////////////////////////////////////////////////////////
-func (p *context) generateCert(privKeyPath string, certFilePath string) error {
+func (p *context) generateCert(role, privKeyPath string, certFilePath string) error {
+	hn, err := os.Hostname()
+	if err != nil {
+		return errors.Annotate(err, "get hostname")
+	}
 
 	serialNumberLimit := new(big.Int).Lsh(big.NewInt(1), 128)
 	serialNumber, err := rand.Int(rand.Reader, serialNumberLimit)
@@ -173,8 +265,9 @@ func (p *context) generateCert(privKeyPath string, certFilePath string) error {
 		BasicConstraintsValid: true,
 		SerialNumber:          serialNumber,
 		Subject: pkix.Name{
-			Country:      []string{"worldwide"},
-			Organization: []string{"llconf"},
+			CommonName:         hn,
+			Organization:       []string{ca.Organization},
+			OrganizationalUnit: []string{role},
 		},
 		NotBefore: time.Now(),
 		NotAfter:  time.Now().AddDate(5, 5, 5),
@@ -185,11 +278,6 @@ func (p *context) generateCert(privKeyPath string, certFilePath string) error {
 		},
 	}
 
-	hn, err := os.Hostname()
-	if err != nil {
-		return errors.Annotate(err, "get hostname")
-	}
-
 	template.DNSNames = append(template.DNSNames, hn)
 
 	privatekey, err := rsa.GenerateKey(rand.Reader, 2048)
@@ -210,7 +298,7 @@ func (p *context) generateCert(privKeyPath string, certFilePath string) error {
 	}
 
 	buf := pem.EncodeToMemory(pemkey)
-	if err := ioutil.WriteFile(privKeyPath, buf, 0644); err != nil {
+	if err := ioutil.WriteFile(privKeyPath, buf, 0600); err != nil {
 		return errors.Annotate(err, "write priv key")
 	}
 
@@ -228,32 +316,81 @@ func (p *context) generateCert(privKeyPath string, certFilePath string) error {
 }
 
 //////////////////////////////////////////////////////////////////////////////////
-func (p *context) StartServer() error {
-	logging.Logger.Debug("context: start server")
+// newServer creates a server evaluating promises in this context.
+func (p *context) newServer() (*server.Server, error) {
+	ds, err := p.openDataStore()
+	if err != nil {
+		return nil, errors.Annotate(err, "open data store")
+	}
+
 	srv := server.New(
 		p.host,
 		p.port,
-		p.dataStore,
+		ds,
 		p.ExecPromise,
 		p.noRedirect,
 		p.clientVersion,
 	)
 
+	cache, err := source.OpenCache(path.Join(p.settingsDir, "cache", "source"))
+	if err != nil {
+		return nil, errors.Annotate(err, "open source cache")
+	}
+	srv.EnableSource(cache, p.compileSource)
+	srv.SetNames(p.serverNames)
+
+	if len(p.relayTargets) > 0 {
+		logging.Logger.Infof("relay commands to %s", strings.Join(p.relayTargets, ", "))
+		srv.EnableRelay(p.relayTargets, p.relayDial)
+	}
+
+	return srv, nil
+}
+
+//////////////////////////////////////////////////////////////////////////////////
+func (p *context) StartServer() error {
+	logging.Logger.Debug("context: start server")
+	srv, err := p.newServer()
+	if err != nil {
+		return errors.Annotate(err, "new server")
+	}
+
+	if len(p.listenAddresses) == 0 {
+		addr, err := util.ParseAddress(p.host, p.port)
+		if err != nil {
+			return errors.Annotate(err, "parse host")
+		}
+		p.listenAddresses = append(p.listenAddresses, addr)
+	}
+	srv.SetListenAddresses(p.listenAddresses)
+
 	goagain.SetLogger(logging.Logger)
 
 	// close context before forking a new process,
 	// that cannot startup, because datastore is locked
 	goagain.OnBeforeSIGUSR2 = func(l net.Listener) error {
+		srv.ReleaseListeners()
 		if err := p.Close(); err != nil {
 			return errors.Annotate(err, "close context before forking")
 		}
 		return nil
 	}
 
-	cert, err := p.loadServerCert()
+	cert, err := p.serverCertificate()
 	if err != nil {
 		return errors.Annotate(err, "load server cert")
 	}
+	srv.SetCertificateFunc(p.serverCertificate)
+
+	if p.enrollToken != "" {
+		addr, err := p.enrollAddress()
+		if err != nil {
+			return errors.Annotate(err, "enrollment address")
+		}
+		if err := srv.RunEnrollment(addr.Addr, cert, p.enrollToken, p.enrollTTL); err != nil {
+			return errors.Annotate(err, "run enrollment")
+		}
+	}
 
 	logging.Logger.Debug("context: try to get used listener")
 	list, err := goagain.Listener()
@@ -285,18 +422,32 @@ func (p *context) StartServer() error {
 	}
 
 	logging.Logger.Debug("context: wait for signals")
-	if _, err := goagain.Wait(srv.ListenerTCP()); nil != err {
-		return errors.Annotate(err, "goagain wait")
+	if ln := srv.ListenerTCP(); ln != nil {
+		if _, err := goagain.Wait(ln); nil != err {
+			return errors.Annotate(err, "goagain wait")
+		}
+	} else {
+		logging.Logger.Warn("hot restart needs a tcp listen address")
+		waitForTermination()
 	}
 
-	if err := srv.Close(); nil != err {
-		return errors.Annotate(err, "close server")
+	if err := srv.Shutdown(p.shutdownTimeout); nil != err {
+		return errors.Annotate(err, "shutdown server")
 	}
 
-	time.Sleep(1 * time.Second)
 	return nil
 }
 
+//////////////////////////////////////////////////////////////////////////////////
+func waitForTermination() {
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGTERM, syscall.SIGINT)
+
+	sig := <-sigChan
+	signal.Stop(sigChan)
+	logging.Logger.Infof("%s signal received", sig.String())
+}
+
 //////////////////////////////////////////////////////////////////////////////////
 func (p *context) loadServerCert() (*tls.Certificate, error) {
 	logging.Logger.Debug("context: load server certificates")
@@ -313,11 +464,24 @@ func (p *context) loadServerCert() (*tls.Certificate, error) {
 		return nil, errors.Annotate(err, "load key pair")
 	}
 
+	if err := p.warnExpiring(&tlsCert); err != nil {
+		return nil, errors.Annotate(err, "warn expiring")
+	}
+
 	return &tlsCert, nil
 }
 
 //////////////////////////////////////////////////////////////////////////////////
 func (p *context) loadClientCert() (*tls.Certificate, error) {
+	promoted, err := promoteCert(p.clientPrivKeyPath, p.clientCertFilePath, false)
+	if err != nil {
+		return nil, errors.Annotate(err, "promote client cert")
+	}
+
+	if promoted {
+		logging.Logger.Info("client certificate rotated")
+	}
+
 	if _, err := os.Stat(p.clientCertFilePath); os.IsNotExist(err) {
 		return nil, errors.New("tls cert file not found")
 	}
@@ -330,31 +494,83 @@ func (p *context) loadClientCert() (*tls.Certificate, error) {
 		return nil, errors.Annotate(err, "load key pair")
 	}
 
+	if err := p.warnExpiring(&tlsCert); err != nil {
+		return nil, errors.Annotate(err, "warn expiring")
+	}
+
 	return &tlsCert, nil
 }
 
 //////////////////////////////////////////////////////////////////////////////////
-func (p *context) CreateClient() error {
+// warnExpiring logs a warning if the own certificate
+// or any stored certificate is about to expire.
+func (p *context) warnExpiring(tlsCert *tls.Certificate) error {
+	cert, err := x509.ParseCertificate(tlsCert.Certificate[0])
+	if err != nil {
+		return errors.Annotate(err, "parse certificate")
+	}
+
+	if ca.ExpiresSoon(cert) {
+		logging.Logger.Warnf("own certificate expires on %s", cert.NotAfter.Format(time.RFC3339))
+	}
+
+	ds, err := p.openDataStore()
+	if err != nil {
+		return errors.Annotate(err, "open data store")
+	}
+
+	return ds.WarnExpiring()
+}
+
+//////////////////////////////////////////////////////////////////////////////////
+// dial connects to the server at host. Unix sockets are authenticated by
+// their file permissions, tcp connections with the client certificate.
+func (p *context) dial() (net.Conn, error) {
+	addr, err := util.ParseAddress(p.host, p.port)
+	if err != nil {
+		return nil, errors.Annotate(err, "parse host")
+	}
+
+	switch addr.Network {
+	case "unix":
+		return net.Dial("unix", addr.Addr)
+	case "ssh":
+		return p.dialSSH(addr.Addr)
+	}
+
 	cert, err := p.loadClientCert()
 	if err != nil {
-		return errors.Annotate(err, "load client cert")
+		return nil, errors.Annotate(err, "load client cert")
+	}
+
+	ds, err := p.openDataStore()
+	if err != nil {
+		return nil, errors.Annotate(err, "open data store")
 	}
 
-	pool, err := p.dataStore.Pool()
+	return dialTLS(addr.Addr, cert, ds)
+}
+
+// dialTLS connects to addr with cert, trusting the server certificates of ds.
+func dialTLS(addr string, cert *tls.Certificate, ds *store.DataStore) (net.Conn, error) {
+	pool, err := ds.Pool()
 	if err != nil {
-		return errors.Annotate(err, "get server cert pool")
+		return nil, errors.Annotate(err, "get server cert pool")
 	}
 
 	tlsConfig := tls.Config{
-		Certificates: []tls.Certificate{*cert},
-		RootCAs:      pool,
+		Certificates:          []tls.Certificate{*cert},
+		RootCAs:               pool,
+		VerifyPeerCertificate: ds.VerifyPeerCertificate,
 	}
 
 	tlsConfig.BuildNameToCertificate()
-	hostPort := net.JoinHostPort(p.host, fmt.Sprintf("%d", p.port))
-
-	conn, err := tls.Dial("tcp", hostPort, &tlsConfig)
+	return tls.Dial("tcp", addr, &tlsConfig)
+}
 
+//////////////////////////////////////////////////////////////////////////////////
+func (p *context) CreateClient() error {
+	conn, err := p.dial()
 	if err != nil {
 		return errors.Annotate(err, "dial")
 	}
@@ -375,10 +591,125 @@ func (p *context) CreateClient() error {
 	return nil
 }
 
+//////////////////////////////////////////////////////////////////////////////////
+// enrollAddress returns the tcp address of the enrollment endpoint.
+func (p *context) enrollAddress() (util.Address, error) {
+	addr, err := util.ParseAddress(p.host, p.enrollPort)
+	if err != nil {
+		return addr, errors.Annotate(err, "parse host")
+	}
+
+	if addr.Network != "tcp" {
+		return addr, errors.New("enrollment needs a tcp host")
+	}
+
+	return addr, nil
+}
+
+//////////////////////////////////////////////////////////////////////////////////
+// Enroll exchanges certificates with a server started with an enrollment
+// token. The server certificate is stored under id, or the common
+// name of the server if id is empty.
+func (p *context) Enroll(token string, id string) error {
+	if token == "" {
+		return errors.New("no enrollment token provided")
+	}
+
+	if err := server.CheckEnrollToken(token); err != nil {
+		return err
+	}
+
+	cert, err := p.loadClientCert()
+	if err != nil {
+		return errors.Annotate(err, "load client cert")
+	}
+
+	tlsConfig := tls.Config{
+		Certificates: []tls.Certificate{*cert},
+		// the server certificate is trusted after the token is proven
+		InsecureSkipVerify: true,
+		MinVersion:         tls.VersionTLS12,
+	}
+
+	addr, err := p.enrollAddress()
+	if err != nil {
+		return errors.Annotate(err, "enrollment address")
+	}
+
+	conn, err := tls.Dial("tcp", addr.Addr, &tlsConfig)
+	if err != nil {
+		return errors.Annotate(err, "dial")
+	}
+	defer conn.Close()
+
+	peer := conn.ConnectionState().PeerCertificates[0]
+	own := cert.Certificate[0]
+
+	enc := json.NewEncoder(conn)
+	dec := json.NewDecoder(conn)
+
+	req := server.EnrollRequest{
+		ID:    p.clientID(cert),
+		Proof: server.EnrollProof(token, "client", own, peer.Raw),
+	}
+	if err := enc.Encode(&req); err != nil {
+		return errors.Annotate(err, "send request")
+	}
+
+	res := server.EnrollResponse{}
+	if err := dec.Decode(&res); err != nil {
+		return errors.Annotate(err, "receive response")
+	}
+
+	logging.Logger.Info(res.Status)
+	if res.Error != "" {
+		return errors.New(res.Error)
+	}
+
+	if !hmac.Equal(res.Proof, server.EnrollProof(token, "server", peer.Raw, own)) {
+		return errors.New("server does not know the enrollment token")
+	}
+
+	if id == "" {
+		id = res.ID
+	}
+
+	ds, err := p.openDataStore()
+	if err != nil {
+		return errors.Annotate(err, "open data store")
+	}
+
+	data := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: peer.Raw})
+	if err := ds.StoreCertData(id, data); err != nil {
+		return errors.Annotate(err, "store server cert")
+	}
+
+	logging.Logger.Infof("server certificate for id %q successfull saved", id)
+	return nil
+}
+
+//////////////////////////////////////////////////////////////////////////////////
+// clientID returns the id the client asks to be stored under.
+func (p *context) clientID(cert *tls.Certificate) string {
+	if id := p.appCtx.String("client-id"); id != "" {
+		return id
+	}
+
+	if leaf, err := x509.ParseCertificate(cert.Certificate[0]); err == nil {
+		return leaf.Subject.CommonName
+	}
+
+	return ""
+}
+
 //////////////////////////////////////////////////////////////////////////////////
 func (p *context) CompilePromise() (promise.Promise, error) {
 	logging.Logger.Info("compile promise")
 
+	if err := modules.VerifyLock(p.LibDir); err != nil {
+		return nil, errors.Annotate(err, "verify library lock")
+	}
+
 	promises, err := compiler.Compile(p.LibDir, p.InputDir)
 	if err != nil {
 		return nil, errors.Annotate(err, "compile promise")
@@ -392,6 +723,27 @@ func (p *context) CompilePromise() (promise.Promise, error) {
 	return tree, nil
 }
 
+//////////////////////////////////////////////////////////////////////////////////
+// compileSource compiles the root promise of a source bundle staged
+// in dir against the library of the server.
+func (p *context) compileSource(dir string, root string) (promise.Promise, error) {
+	if err := modules.VerifyLock(p.LibDir); err != nil {
+		return nil, errors.Annotate(err, "verify library lock")
+	}
+
+	promises, err := compiler.Compile(p.LibDir, dir)
+	if err != nil {
+		return nil, errors.Annotate(err, "compile source")
+	}
+
+	tree, ok := promises[root]
+	if !ok {
+		return nil, errors.New("root promise (" + root + ") unknown")
+	}
+
+	return tree, nil
+}
+
 //////////////////////////////////////////////////////////////////////////////////
 func (p *context) parseArguments(isClient bool, needInput bool) error {
 
@@ -436,6 +788,11 @@ func (p *context) parseArguments(isClient bool, needInput bool) error {
 	p.host = p.appCtx.GlobalString("host")
 	p.port = p.appCtx.GlobalInt("port")
 
+	p.enrollPort = p.appCtx.Int("enroll-port")
+	if p.enrollPort == 0 {
+		p.enrollPort = p.port + 1
+	}
+
 	p.useSyslog = p.appCtx.GlobalBool("syslog")
 	if err := p.upgradeLogging(); err != nil {
 		return errors.Annotate(err, "upgrade logging")
@@ -456,8 +813,8 @@ func (p *context) parseArguments(isClient bool, needInput bool) error {
 		return errors.Annotate(err, "create cert dir")
 	}
 
-	dataStorePath := path.Join(p.settingsDir, "store")
-	if err := os.MkdirAll(dataStorePath, 0700); err != nil {
+	p.dataStorePath = path.Join(p.settingsDir, "store")
+	if err := os.MkdirAll(p.dataStorePath, 0700); err != nil {
 		return errors.Annotate(err, "create datastore dir")
 	}
 
@@ -468,6 +825,8 @@ func (p *context) parseArguments(isClient bool, needInput bool) error {
 
 	logging.Logger.Infof("use library @ %q", p.LibDir)
 
+	p.CADir = path.Join(p.settingsDir, "ca")
+
 	if isClient {
 		p.verbose = p.appCtx.GlobalBool("verbose")
 		logging.Logger.Infof("verbose: %t debug: %t", p.verbose, p.debug)
@@ -478,55 +837,66 @@ func (p *context) parseArguments(isClient bool, needInput bool) error {
 			return errors.Annotate(err, "ensure client cert")
 		}
 
-		p.certRole = "server"
-		store, err := store.New("client", p.certRole, dataStorePath)
-		if err != nil {
-			return errors.Annotate(err, "create data store")
+		p.sendSource = p.appCtx.GlobalBool("source")
+		p.attachPaths = p.appCtx.GlobalStringSlice("attach")
+		p.sshCommand = p.appCtx.GlobalString("ssh-command")
+		p.sshUpload = p.appCtx.GlobalBool("ssh-upload")
+		p.target = p.appCtx.GlobalString("target")
+		p.signKeyPath = p.appCtx.GlobalString("sign-key")
+		if p.signKeyPath == "" {
+			p.signKeyPath = p.clientPrivKeyPath
 		}
-		p.dataStore = store
+
+		p.certRole = "server"
+		p.dataStoreID = "client"
 	} else {
 
 		p.noRedirect = p.appCtx.Bool("no-redirect")
+		p.enrollToken = p.appCtx.String("enroll-token")
+		p.enrollTTL = p.appCtx.Duration("enroll-ttl")
+		p.shutdownTimeout = p.appCtx.Duration("shutdown-timeout")
+		for _, listen := range p.appCtx.StringSlice("listen") {
+			addr, err := util.ParseAddress(listen, p.port)
+			if err != nil {
+				return errors.Annotatef(err, "parse listen address %q", listen)
+			}
+			p.listenAddresses = append(p.listenAddresses, addr)
+		}
 		p.serverPrivKeyPath = path.Join(certDir, "server.privkey.pem")
 		p.serverCertFilePath = path.Join(certDir, "server.cert.pem")
 		if err := p.ensureServerCert(); err != nil {
 			return errors.Annotate(err, "ensure server cert")
 		}
 
-		p.certRole = "client"
-		store, err := store.New("server", p.certRole, dataStorePath)
-		if err != nil {
-			return errors.Annotate(err, "create data store")
+		p.serverNames = p.appCtx.StringSlice("name")
+		if len(p.serverNames) == 0 {
+			hn, err := os.Hostname()
+			if err != nil {
+				return errors.Annotate(err, "get hostname")
+			}
+			p.serverNames = []string{hn}
+		}
+
+		p.relayTargets = p.appCtx.StringSlice("relay")
+		if len(p.relayTargets) > 0 {
+			// the relay logs into its targets as a client
+			p.clientPrivKeyPath = path.Join(certDir, "client.privkey.pem")
+			p.clientCertFilePath = path.Join(certDir, "client.cert.pem")
+			if err := p.ensureClientCert(); err != nil {
+				return errors.Annotate(err, "ensure client cert")
+			}
+			p.sshCommand = "llconf"
 		}
-		p.dataStore = store
-	}
-
-	gob.Register(promise.NamedPromise{})
-	gob.Register(promise.ExecPromise{})
-	gob.Register(promise.AndPromise{})
-	gob.Register(promise.OrPromise{})
-	gob.Register(promise.TruePromise{})
-	gob.Register(promise.FalsePromise{})
-	gob.Register(promise.NotPromise{})
-	gob.Register(promise.PipePromise{})
-	gob.Register(promise.SPipePromise{})
-	gob.Register(promise.EvalPromise{})
-	gob.Register(promise.ArgGetter{})
-	gob.Register(promise.JoinArgument{})
-	gob.Register(promise.InDir{})
-	gob.Register(promise.AsUser{})
-	gob.Register(promise.RestartPromise{})
-	gob.Register(promise.SetvarPromise{})
-	gob.Register(promise.ReadvarPromise{})
-	gob.Register(promise.VarGetter{})
-	gob.Register(promise.LogPromise{})
-	gob.Register(promise.Constant("const"))
+
+		p.certRole = "client"
+		p.dataStoreID = "server"
+	}
 
 	return nil
 }
 
 //////////////////////////////////////////////////////////////////////////////////
-func (p *context) AddCert(id string, certPath string) error {
+func (p *context) AddCert(id string, certPath string, replace bool) error {
 	logging.Logger.Infof("add %s cert", p.certRole)
 
 	if id == "" {
@@ -541,7 +911,16 @@ func (p *context) AddCert(id string, certPath string) error {
 		return errors.Errorf("%s certificate file does not exist", p.certRole)
 	}
 
-	return p.dataStore.StoreCert(id, certPath)
+	ds, err := p.openDataStore()
+	if errors.Cause(err) == store.ErrLocked {
+		logging.Logger.Infof("datastore is locked by a running server, queue %s cert %q for it", p.certRole, id)
+		return store.QueueCert(p.dataStoreID, p.dataStorePath, id, certPath, replace)
+	}
+	if err != nil {
+		return errors.Annotate(err, "open data store")
+	}
+
+	return ds.StoreCert(id, certPath, replace)
 }
 
 //////////////////////////////////////////////////////////////////////////////////
@@ -552,52 +931,443 @@ func (p *context) RemoveCert(id string) error {
 		return errors.Errorf("no %s id provided", p.certRole)
 	}
 
-	return p.dataStore.RemoveCert(id)
+	ds, err := p.openDataStore()
+	if err != nil {
+		return errors.Annotate(err, "open data store")
+	}
+
+	return ds.RemoveCert(id)
 }
 
 //////////////////////////////////////////////////////////////////////////////////
-func (p *context) SendPromise(tree promise.Promise) error {
+// SetCertPolicy restricts what the client with id may run.
+func (p *context) SetCertPolicy(id string, policy store.Policy) error {
+	logging.Logger.Infof("set %s cert policy", p.certRole)
+
+	if id == "" {
+		return errors.Errorf("no %s id provided", p.certRole)
+	}
+
+	ds, err := p.openDataStore()
+	if err != nil {
+		return errors.Annotate(err, "open data store")
+	}
+
+	return ds.SetPolicy(id, policy)
+}
+
+//////////////////////////////////////////////////////////////////////////////////
+// AddPublisher trusts promises signed by the key of the cert or public key at keyPath.
+func (p *context) AddPublisher(id string, keyPath string) error {
+	logging.Logger.Info("add publisher")
+
+	if id == "" {
+		return errors.New("no publisher id provided")
+	}
+
+	data, err := ioutil.ReadFile(keyPath)
+	if err != nil {
+		return errors.Annotate(err, "read key file")
+	}
+
+	ds, err := p.openDataStore()
+	if err != nil {
+		return errors.Annotate(err, "open data store")
+	}
+
+	return ds.AddPublisher(id, data)
+}
+
+//////////////////////////////////////////////////////////////////////////////////
+func (p *context) RemovePublisher(id string) error {
+	logging.Logger.Info("remove publisher")
+
+	if id == "" {
+		return errors.New("no publisher id provided")
+	}
+
+	ds, err := p.openDataStore()
+	if err != nil {
+		return errors.Annotate(err, "open data store")
+	}
+
+	return ds.RemovePublisher(id)
+}
+
+//////////////////////////////////////////////////////////////////////////////////
+// ListPublishers returns the sorted ids of all trusted publishers.
+func (p *context) ListPublishers() ([]string, error) {
+	ds, err := p.openDataStore()
+	if err != nil {
+		return nil, errors.Annotate(err, "open data store")
+	}
+
+	keys, err := ds.Publishers()
+	if err != nil {
+		return nil, errors.Annotate(err, "get publishers")
+	}
+
+	ids := []string{}
+	for id := range keys {
+		ids = append(ids, id)
+	}
+
+	sort.Strings(ids)
+	return ids, nil
+}
+
+//////////////////////////////////////////////////////////////////////////////////
+// VerifyBundle returns the publisher the bundle at path is signed by,
+// if it is meant for this server and has not expired.
+func (p *context) VerifyBundle(path string) (string, error) {
+	ds, err := p.openDataStore()
+	if err != nil {
+		return "", errors.Annotate(err, "open data store")
+	}
+
+	keys, err := ds.Publishers()
+	if err != nil {
+		return "", errors.Annotate(err, "get publishers")
+	}
+
+	e, publisher, err := bundle.Read(path, keys)
+	if err != nil {
+		return "", err
+	}
+
+	return publisher, e.Check(p.serverNames, time.Now())
+}
+
+//////////////////////////////////////////////////////////////////////////////////
+func (p *context) ListCerts() ([]store.CertInfo, error) {
+	ds, err := p.openDataStore()
+	if err != nil {
+		return nil, errors.Annotate(err, "open data store")
+	}
+
+	return ds.Certs()
+}
+
+//////////////////////////////////////////////////////////////////////////////////
+func (p *context) RevokeCert(serial string) error {
+	logging.Logger.Infof("revoke %s cert", p.certRole)
+
+	if serial == "" {
+		return errors.New("no serial provided")
+	}
+
+	ds, err := p.openDataStore()
+	if err != nil {
+		return errors.Annotate(err, "open data store")
+	}
+
+	return ds.Revoke(serial)
+}
+
+//////////////////////////////////////////////////////////////////////////////////
+func (p *context) ImportCRL(crlPath string) (int, error) {
+	logging.Logger.Infof("import %s revocation list", p.certRole)
+
+	data, err := ioutil.ReadFile(crlPath)
+	if err != nil {
+		return 0, errors.Annotate(err, "read crl")
+	}
+
+	ds, err := p.openDataStore()
+	if err != nil {
+		return 0, errors.Annotate(err, "open data store")
+	}
+
+	return ds.ImportCRL(data)
+}
+
+// sendValidity is the time a sent promise tree may be evaluated in,
+// which bounds how long a captured command can be replayed.
+const sendValidity = 10 * time.Minute
+
+//////////////////////////////////////////////////////////////////////////////////
+// sendTargets returns the name of the server promise trees are sent to,
+// the relay target if there is one. Unix sockets address this host.
+func (p *context) sendTargets() ([]string, error) {
+	target := p.host
+	if p.target != "" {
+		target = p.target
+	}
+
+	addr, err := util.ParseAddress(target, p.port)
+	if err != nil {
+		return nil, errors.Annotate(err, "parse target")
+	}
+
+	if host := addr.Host(); host != "" {
+		return []string{host}, nil
+	}
+
+	hn, err := os.Hostname()
+	if err != nil {
+		return nil, errors.Annotate(err, "get hostname")
+	}
+	return []string{hn}, nil
+}
+
+//////////////////////////////////////////////////////////////////////////////////
+// signEnvelope signs data for targets, valid for validity, with the sign key.
+func (p *context) signEnvelope(data []byte, targets []string, validity time.Duration) (bundle.Bundle, error) {
+	key, err := ca.ReadKey(p.signKeyPath)
+	if err != nil {
+		return bundle.Bundle{}, errors.Annotate(err, "read sign key")
+	}
+
+	return bundle.New(bundle.Envelope{
+		Data:     data,
+		Targets:  targets,
+		NotAfter: time.Now().Add(validity),
+	}, key)
+}
+
+//////////////////////////////////////////////////////////////////////////////////
+// encodePromise serializes tree with the files attached to it and
+// signs it with the sign key for targets, valid for validity.
+func (p *context) encodePromise(tree promise.Promise, files []wire.SourceFile, targets []string, validity time.Duration) (bundle.Bundle, error) {
 	if tree == nil {
-		return errors.New("no valid promises")
+		return bundle.Bundle{}, errors.New("no valid promises")
+	}
+
+	data, err := wire.Encode(tree, files)
+	if err != nil {
+		return bundle.Bundle{}, errors.Annotate(err, "encode")
 	}
 
-	buf := bytes.Buffer{}
-	enc := gob.NewEncoder(&buf)
-	if err := enc.Encode(tree); err != nil {
-		return errors.Annotate(err, "encode")
+	return p.signEnvelope(data, targets, validity)
+}
+
+//////////////////////////////////////////////////////////////////////////////////
+// WriteBundle writes tree as signed bundle to path, meant for the
+// servers matching targets and valid for validity.
+func (p *context) WriteBundle(tree promise.Promise, path string, targets []string, validity time.Duration) error {
+	if len(targets) == 0 {
+		return errors.New("no bundle target provided")
+	}
+
+	b, err := p.encodePromise(tree, nil, targets, validity)
+	if err != nil {
+		return errors.Annotate(err, "encode promise")
+	}
+
+	return b.Write(path)
+}
+
+//////////////////////////////////////////////////////////////////////////////////
+// attachments returns the files attached with --attach and, unless the
+// client runs in source mode, the templates referenced by tree.
+func (p *context) attachments(tree promise.Promise) ([]wire.SourceFile, map[string]string, error) {
+	paths := append([]string{}, p.attachPaths...)
+	if !p.sendSource {
+		paths = append(paths, source.Templates(tree, p.InputDir)...)
+	}
+
+	return source.Attachments(p.InputDir, paths)
+}
+
+//////////////////////////////////////////////////////////////////////////////////
+// openAttachments opens the attached files as streams for cmd.
+func openAttachments(cmd *RemoteCommand, files []wire.SourceFile, local map[string]string) error {
+	for _, f := range files {
+		file, err := os.Open(local[f.Path])
+		if err != nil {
+			closeAttachments(*cmd)
+			return errors.Annotatef(err, "open attachment %q", f.Path)
+		}
+		cmd.Attachments = append(cmd.Attachments, Attachment{Path: f.Path, Content: file})
+	}
+
+	return nil
+}
+
+func closeAttachments(cmd RemoteCommand) {
+	for _, a := range cmd.Attachments {
+		a.Content.Close()
+	}
+}
+
+//////////////////////////////////////////////////////////////////////////////////
+// SendPromise sends tree to the server, or the source it was compiled
+// from if the client runs in source mode.
+func (p *context) SendPromise(tree promise.Promise) error {
+	if p.sendSource {
+		return p.SendSource(tree)
+	}
+
+	files, local, err := p.attachments(tree)
+	if err != nil {
+		return errors.Annotate(err, "collect attachments")
+	}
+
+	targets, err := p.sendTargets()
+	if err != nil {
+		return err
+	}
+
+	b, err := p.encodePromise(tree, files, targets, sendValidity)
+	if err != nil {
+		return errors.Annotate(err, "encode promise")
+	}
+
+	cmd := p.newRemoteCommand()
+	cmd.Data = b.Data
+	cmd.Signature = b.Signature
+	cmd.Targets = b.Targets
+	cmd.NotAfter = b.NotAfter
+	if err := openAttachments(&cmd, files, local); err != nil {
+		return err
 	}
 
-	cmd := RemoteCommand{
-		Data:          buf.Bytes(),
+	logging.Logger.Infof("send promise with %d attachments", len(files))
+	resp, err := p.roundTrip(cmd)
+	if err != nil {
+		return err
+	}
+
+	return p.finish(resp)
+}
+
+//////////////////////////////////////////////////////////////////////////////////
+// SendSource sends the manifest of the input folder, so the server compiles
+// the root promise itself. File contents are only sent if the server
+// has not cached them yet. tree is used to find the templates to send.
+func (p *context) SendSource(tree promise.Promise) error {
+	templates := source.Templates(tree, p.InputDir)
+	manifest, contents, err := source.Collect(p.InputDir, p.rootPromise, templates)
+	if err != nil {
+		return errors.Annotate(err, "collect source")
+	}
+
+	files, local, err := p.attachments(tree)
+	if err != nil {
+		return errors.Annotate(err, "collect attachments")
+	}
+	manifest.Attachments = files
+
+	data, err := wire.EncodeSource(manifest)
+	if err != nil {
+		return errors.Annotate(err, "encode source")
+	}
+
+	targets, err := p.sendTargets()
+	if err != nil {
+		return err
+	}
+
+	b, err := p.signEnvelope(data, targets, sendValidity)
+	if err != nil {
+		return errors.Annotate(err, "sign")
+	}
+
+	cmd := p.newRemoteCommand()
+	cmd.Source = data
+	cmd.Signature = b.Signature
+	cmd.Targets = b.Targets
+	cmd.NotAfter = b.NotAfter
+	if err := openAttachments(&cmd, files, local); err != nil {
+		return err
+	}
+
+	logging.Logger.Infof("send source manifest of %d files", len(manifest.Files))
+	resp, err := p.roundTrip(cmd)
+	if err != nil {
+		return err
+	}
+
+	if len(resp.Missing) > 0 {
+		cmd = p.newRemoteCommand()
+		cmd.Source = data
+		cmd.Signature = b.Signature
+		cmd.Targets = b.Targets
+		cmd.NotAfter = b.NotAfter
+		for _, hash := range resp.Missing {
+			content, ok := contents[hash]
+			if !ok {
+				return errors.Errorf("server requested unknown source hash %s", hash)
+			}
+			cmd.Blobs = append(cmd.Blobs, content)
+		}
+
+		// the attachment streams of the first command are consumed
+		if err := openAttachments(&cmd, files, local); err != nil {
+			return err
+		}
+
+		logging.Logger.Infof("send %d uncached source files", len(cmd.Blobs))
+		if resp, err = p.roundTrip(cmd); err != nil {
+			return err
+		}
+	}
+
+	return p.finish(resp)
+}
+
+//////////////////////////////////////////////////////////////////////////////////
+func (p *context) newRemoteCommand() RemoteCommand {
+	return RemoteCommand{
 		Stdout:        os.Stdout,
+		Output:        os.Stdout,
 		SendChannel:   p.remoteSender,
 		Verbose:       p.verbose,
+		Target:        p.target,
 		Debug:         p.debug,
 		ClientVersion: p.clientVersion,
 	}
+}
 
+//////////////////////////////////////////////////////////////////////////////////
+// roundTrip sends cmd and waits for the response.
+func (p *context) roundTrip(cmd RemoteCommand) (server.CommandResponse, error) {
 	stdout := os.Stdout
 	defer func() {
 		os.Stdout = stdout
 	}()
 
-	logging.Logger.Info("send promise")
+	cancelReceiver, cancelSender := libchan.Pipe()
+	cmd.Cancel = cancelReceiver
+
+	p.cancelMutex.Lock()
+	p.cancelSender = cancelSender
+	p.cancelMutex.Unlock()
+
+	defer func() {
+		p.cancelMutex.Lock()
+		defer p.cancelMutex.Unlock()
+
+		p.cancelSender = nil
+		cancelSender.Close()
+	}()
+
+	resp := server.CommandResponse{}
 	if err := p.sender.Send(cmd); err != nil {
-		return errors.Annotate(err, "send")
+		return resp, errors.Annotate(err, "send")
 	}
 
-	resp := server.CommandResponse{}
 	if err := p.receiver.Receive(&resp); err != nil {
-		return errors.Annotate(err, "receive")
+		return resp, errors.Annotate(err, "receive")
 	}
 
+	return resp, nil
+}
+
+//////////////////////////////////////////////////////////////////////////////////
+// finish closes the send channel and reports the final response.
+func (p *context) finish(resp server.CommandResponse) error {
 	if err := p.sender.Close(); err != nil {
 		return errors.Annotate(err, "close sender channel")
 	}
 
-	os.Stdout = stdout
 	logging.Logger.Info(resp.Status)
 
+	if resp.Capabilities.Version != wire.Version {
+		logging.Logger.Warnf("client speaks protocol version %d, server %d",
+			wire.Version, resp.Capabilities.Version)
+	}
+
 	if resp.Error != "" {
 		return errors.New(resp.Error)
 	}
@@ -605,7 +1375,17 @@ func (p *context) SendPromise(tree promise.Promise) error {
 }
 
 //////////////////////////////////////////////////////////////////////////////////
-func (p *context) ExecPromise(tree promise.Promise, verbose bool) (err error) {
+// ExecPromise evaluates tree. If opts.ReadOnly is set, promises
+// changing the system are logged and skipped.
+func (p *context) ExecPromise(tree promise.Promise, opts server.ExecOptions) (err error) {
+	var starttime time.Time
+	defer func() {
+		if err != nil && isCanceled(opts.Cancel) {
+			defer logging.Logger.Reset()
+			writeRunLog(false, true, starttime, time.Now().Local(), p.runlogPath)
+		}
+	}()
+
 	defer func() {
 		e := recover()
 		if e != nil {
@@ -613,6 +1393,10 @@ func (p *context) ExecPromise(tree promise.Promise, verbose bool) (err error) {
 				err = errs
 				return
 			}
+			if evalErr, ok := e.(*promise.EvalError); ok {
+				err = evalErr
+				return
+			}
 			err = errors.Errorf("server panic happend: %s", debug.Stack())
 		}
 	}()
@@ -623,37 +1407,59 @@ func (p *context) ExecPromise(tree promise.Promise, verbose bool) (err error) {
 	vars["settings_dir"] = p.settingsDir
 	vars["lib_dir"] = p.LibDir
 	vars["executable"] = filepath.Clean(os.Args[0])
+	if opts.SourceDir != "" {
+		vars[promise.SourceDirVar] = opts.SourceDir
+	}
+	if opts.BundleDir != "" {
+		vars[promise.BundleDirVar] = opts.BundleDir
+	}
+	promise.SetFacts(vars, facts.Collect())
 
 	ctx := promise.Context{
 		ExecStdout: &bytes.Buffer{},
 		ExecStderr: &bytes.Buffer{},
+		Output:     opts.Output,
 		Compile:    compiler.Compile,
 		Vars:       vars,
 		Args:       os.Args[1:],
 		Env:        []string{},
-		Verbose:    verbose,
+		Verbose:    opts.Verbose,
+		ReadOnly:   opts.ReadOnly,
+		Cancel:     opts.Cancel,
 		InDir:      "",
 	}
 
-	starttime := time.Now().Local()
+	starttime = time.Now().Local()
 	res := tree.Eval([]promise.Constant{}, &ctx, "")
 	endtime := time.Now().Local()
 
 	defer logging.Logger.Reset()
-	logging.Logger.Infof("%d changes and %d tests (%d errors | %d warnings) executed in %s",
+	logging.Logger.Infof("%d changes, %d tests and %d conditions (%d errors | %d warnings) executed in %s",
 		logging.Logger.Changes,
 		logging.Logger.Tests,
+		logging.Logger.Conditions,
 		logging.Logger.Errors,
 		logging.Logger.Warnings,
 		endtime.Sub(starttime),
 	)
 
-	writeRunLog(res, starttime, endtime, p.runlogPath)
+	writeRunLog(res, false, starttime, endtime, p.runlogPath)
 	return
 }
 
+func isCanceled(cancel <-chan struct{}) bool {
+	select {
+	case <-cancel:
+		return true
+	default:
+		return false
+	}
+}
+
 //////////////////////////////////////////////////////////////////////////////////
-func writeRunLog(success bool, starttime, endtime time.Time, path string) error {
+// writeRunLog appends the outcome of a run to the run log. Runs
+// canceled by the client or a server shutdown are marked interrupted.
+func writeRunLog(success bool, interrupted bool, starttime, endtime time.Time, path string) error {
 	var output string
 
 	changes := logging.Logger.Changes
@@ -662,6 +1468,10 @@ func writeRunLog(success bool, starttime, endtime time.Time, path string) error
 
 	output = fmt.Sprintf("error, endtime=%d, duration=%f, c=%d, t=%d -> %t",
 		endtime.Unix(), duration.Seconds(), changes, tests, success)
+	if interrupted {
+		output += " (interrupted)"
+	}
+	output += "\n"
 
 	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
 	if err != nil {
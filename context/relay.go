@@ -0,0 +1,43 @@
+package context
+
+import (
+	"crypto/tls"
+	"net"
+
+	"github.com/denkhaus/llconf/store"
+	"github.com/denkhaus/llconf/util"
+	"github.com/juju/errors"
+)
+
+//////////////////////////////////////////////////////////////////////////////////
+// relayDial connects the relay to target like a client does. Tcp targets
+// are authenticated with the client certificate of the relay and the
+// server certificates added with "llconf client cert add".
+func (p *context) relayDial(target string) (net.Conn, error) {
+	addr, err := util.ParseAddress(target, p.port)
+	if err != nil {
+		return nil, errors.Annotate(err, "parse target")
+	}
+
+	switch addr.Network {
+	case "unix":
+		return net.Dial("unix", addr.Addr)
+	case "ssh":
+		return p.dialSSH(addr.Addr)
+	}
+
+	cert, err := tls.LoadX509KeyPair(p.clientCertFilePath, p.clientPrivKeyPath)
+	if err != nil {
+		return nil, errors.Annotate(err, "load client cert")
+	}
+
+	// the client store is opened per connection, so local
+	// clients are not locked out while the relay runs
+	ds, err := store.New("client", "server", p.dataStorePath)
+	if err != nil {
+		return nil, errors.Annotate(err, "open client data store")
+	}
+	defer ds.Close()
+
+	return dialTLS(addr.Addr, &cert, ds)
+}
@@ -0,0 +1,201 @@
+package context
+
+import (
+	"crypto/tls"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/denkhaus/llconf/logging"
+	"github.com/denkhaus/llconf/util"
+	"github.com/juju/errors"
+)
+
+// A rotation writes the next key pair beside the current one and a
+// state file holding the time it replaces the current key pair.
+// Until then peers trust both certificates from the bundle file.
+func nextCertPath(path string) string {
+	return strings.TrimSuffix(path, ".pem") + ".next.pem"
+}
+
+func oldCertPath(path string) string {
+	return strings.TrimSuffix(path, ".pem") + ".old.pem"
+}
+
+func bundleCertPath(path string) string {
+	return strings.TrimSuffix(path, ".pem") + ".bundle.pem"
+}
+
+func rotateStatePath(path string) string {
+	return strings.TrimSuffix(path, ".cert.pem") + ".rotate"
+}
+
+//////////////////////////////////////////////////////////////////////////////////
+// ownCertPaths returns the role, key and cert path of this node.
+func (p *context) ownCertPaths() (string, string, string) {
+	if p.clientCertFilePath != "" {
+		return "client", p.clientPrivKeyPath, p.clientCertFilePath
+	}
+	return "server", p.serverPrivKeyPath, p.serverCertFilePath
+}
+
+//////////////////////////////////////////////////////////////////////////////////
+// RotateCert creates the next key pair of this node, which replaces the
+// current one after overlap. It returns the path of a bundle holding
+// both certificates, that peers have to trust until then.
+func (p *context) RotateCert(overlap time.Duration) (string, time.Time, error) {
+	role, keyPath, certPath := p.ownCertPaths()
+	if util.FileExists(nextCertPath(certPath)) {
+		return "", time.Time{}, errors.Errorf("%s certificate rotation already in progress", role)
+	}
+
+	if err := p.generateCert(role, nextCertPath(keyPath), nextCertPath(certPath)); err != nil {
+		return "", time.Time{}, errors.Annotate(err, "generate next cert")
+	}
+
+	current, err := ioutil.ReadFile(certPath)
+	if err != nil {
+		return "", time.Time{}, errors.Annotate(err, "read current cert")
+	}
+
+	next, err := ioutil.ReadFile(nextCertPath(certPath))
+	if err != nil {
+		return "", time.Time{}, errors.Annotate(err, "read next cert")
+	}
+
+	bundlePath := bundleCertPath(certPath)
+	if err := ioutil.WriteFile(bundlePath, append(current, next...), 0644); err != nil {
+		return "", time.Time{}, errors.Annotate(err, "write cert bundle")
+	}
+
+	switchAt := time.Now().Add(overlap)
+	state := []byte(switchAt.Format(time.RFC3339))
+	if err := ioutil.WriteFile(rotateStatePath(certPath), state, 0600); err != nil {
+		return "", time.Time{}, errors.Annotate(err, "write rotation state")
+	}
+
+	return bundlePath, switchAt, nil
+}
+
+//////////////////////////////////////////////////////////////////////////////////
+// SwitchCert replaces the current key pair by the next one
+// without waiting for the end of the overlap.
+func (p *context) SwitchCert() error {
+	role, keyPath, certPath := p.ownCertPaths()
+
+	promoted, err := promoteCert(keyPath, certPath, true)
+	if err != nil {
+		return errors.Annotate(err, "promote cert")
+	}
+
+	if !promoted {
+		return errors.Errorf("no %s certificate rotation in progress", role)
+	}
+
+	return nil
+}
+
+//////////////////////////////////////////////////////////////////////////////////
+// RetireCert removes the key pair replaced by the last rotation.
+func (p *context) RetireCert() error {
+	role, keyPath, certPath := p.ownCertPaths()
+	if util.FileExists(nextCertPath(certPath)) {
+		return errors.Errorf("%s certificate rotation still in progress", role)
+	}
+
+	if !util.FileExists(oldCertPath(certPath)) {
+		return errors.Errorf("no retired %s certificate found", role)
+	}
+
+	for _, path := range []string{oldCertPath(keyPath), oldCertPath(certPath), bundleCertPath(certPath)} {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return errors.Annotatef(err, "remove %q", filepath.Base(path))
+		}
+	}
+
+	return nil
+}
+
+//////////////////////////////////////////////////////////////////////////////////
+// promoteCert replaces the current key pair by the next one if the
+// overlap is over or force is set. It reports whether it did.
+func promoteCert(keyPath, certPath string, force bool) (bool, error) {
+	if !util.FileExists(nextCertPath(certPath)) {
+		return false, nil
+	}
+
+	if !force {
+		data, err := ioutil.ReadFile(rotateStatePath(certPath))
+		if err != nil {
+			return false, errors.Annotate(err, "read rotation state")
+		}
+
+		switchAt, err := time.Parse(time.RFC3339, strings.TrimSpace(string(data)))
+		if err != nil {
+			return false, errors.Annotate(err, "parse rotation state")
+		}
+
+		if time.Now().Before(switchAt) {
+			return false, nil
+		}
+	}
+
+	// the cert is renamed last, since readers reload on cert changes
+	for _, path := range []string{keyPath, certPath} {
+		if err := os.Rename(path, oldCertPath(path)); err != nil {
+			return false, errors.Annotatef(err, "retire %q", filepath.Base(path))
+		}
+
+		if err := os.Rename(nextCertPath(path), path); err != nil {
+			return false, errors.Annotatef(err, "promote %q", filepath.Base(path))
+		}
+	}
+
+	if err := os.Remove(rotateStatePath(certPath)); err != nil && !os.IsNotExist(err) {
+		return false, errors.Annotate(err, "remove rotation state")
+	}
+
+	return true, nil
+}
+
+//////////////////////////////////////////////////////////////////////////////////
+// serverCertificate returns the current server certificate. It promotes a
+// rotated key pair when due and reloads whenever the cert file changes,
+// so the server picks up new certificates without a restart.
+func (p *context) serverCertificate() (*tls.Certificate, error) {
+	p.certMutex.Lock()
+	defer p.certMutex.Unlock()
+
+	promoted, err := promoteCert(p.serverPrivKeyPath, p.serverCertFilePath, false)
+	if err != nil {
+		logging.Logger.Error(errors.Annotate(err, "promote server cert"))
+	} else if promoted {
+		logging.Logger.Info("server certificate rotated")
+	}
+
+	info, err := os.Stat(p.serverCertFilePath)
+	if err != nil {
+		if p.serverCert != nil {
+			return p.serverCert, nil
+		}
+		return nil, errors.Annotate(err, "stat server cert")
+	}
+
+	if p.serverCert == nil || !info.ModTime().Equal(p.serverCertModTime) {
+		cert, err := p.loadServerCert()
+		if err != nil {
+			if p.serverCert != nil {
+				logging.Logger.Error(errors.Annotate(err, "reload server cert"))
+				return p.serverCert, nil
+			}
+			return nil, err
+		}
+
+		p.serverCert = cert
+		p.serverCertModTime = info.ModTime()
+	}
+
+	return p.serverCert, nil
+}
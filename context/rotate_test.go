@@ -0,0 +1,205 @@
+package context
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/denkhaus/llconf/ca"
+	"github.com/denkhaus/llconf/server"
+	"github.com/denkhaus/llconf/store"
+	"github.com/denkhaus/llconf/util"
+)
+
+func TestPromoteCert(t *testing.T) {
+	dir, err := ioutil.TempDir("", "llconf-rotate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	keyPath := filepath.Join(dir, "server.privkey.pem")
+	certPath := filepath.Join(dir, "server.cert.pem")
+
+	for path, content := range map[string]string{
+		keyPath:                "key",
+		certPath:               "cert",
+		nextCertPath(keyPath):  "next key",
+		nextCertPath(certPath): "next cert",
+	} {
+		ioutil.WriteFile(path, []byte(content), 0600)
+	}
+
+	switchAt := time.Now().Add(time.Hour).Format(time.RFC3339)
+	ioutil.WriteFile(rotateStatePath(certPath), []byte(switchAt), 0600)
+
+	if promoted, err := promoteCert(keyPath, certPath, false); err != nil || promoted {
+		t.Fatalf("promoted before end of overlap: %t %v", promoted, err)
+	}
+
+	if promoted, err := promoteCert(keyPath, certPath, true); err != nil || !promoted {
+		t.Fatalf("not promoted: %t %v", promoted, err)
+	}
+
+	for path, content := range map[string]string{
+		keyPath:               "next key",
+		certPath:              "next cert",
+		oldCertPath(keyPath):  "key",
+		oldCertPath(certPath): "cert",
+	} {
+		data, err := ioutil.ReadFile(path)
+		if err != nil || string(data) != content {
+			t.Errorf("%s: wanted %q, got %q %v", filepath.Base(path), content, data, err)
+		}
+	}
+
+	if _, err := os.Stat(rotateStatePath(certPath)); !os.IsNotExist(err) {
+		t.Errorf("rotation state not removed")
+	}
+
+	if promoted, err := promoteCert(keyPath, certPath, true); err != nil || promoted {
+		t.Errorf("promoted without rotation: %t %v", promoted, err)
+	}
+}
+
+func TestServeRotatedCert(t *testing.T) {
+	dir, err := ioutil.TempDir("", "llconf-rotate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	p := &context{
+		serverPrivKeyPath:  filepath.Join(dir, "server.privkey.pem"),
+		serverCertFilePath: filepath.Join(dir, "server.cert.pem"),
+		dataStorePath:      dir,
+		dataStoreID:        "server",
+		certRole:           "client",
+	}
+	defer p.Close()
+
+	clientKeyPath := filepath.Join(dir, "client.privkey.pem")
+	clientCertPath := filepath.Join(dir, "client.cert.pem")
+	if err := p.generateCert(ca.RoleServer, p.serverPrivKeyPath, p.serverCertFilePath); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.generateCert(ca.RoleClient, clientKeyPath, clientCertPath); err != nil {
+		t.Fatal(err)
+	}
+
+	ds, err := p.openDataStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ds.StoreCert("test", clientCertPath, false); err != nil {
+		t.Fatal(err)
+	}
+
+	cert, err := p.serverCertificate()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := server.New("127.0.0.1", 0, ds, p.ExecPromise, true, "test")
+	srv.SetListenAddresses([]util.Address{{Network: "tcp", Addr: "127.0.0.1:0"}})
+	srv.SetCertificateFunc(p.serverCertificate)
+	if err := srv.CreateListenerAndRun(cert); err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	clientCert, err := tls.LoadX509KeyPair(clientCertPath, clientKeyPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// served dials the server by ip, without server name
+	served := func() []byte {
+		conn, err := tls.Dial("tcp", srv.ListenerTCP().Addr().String(), &tls.Config{
+			Certificates:       []tls.Certificate{clientCert},
+			InsecureSkipVerify: true,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+
+		return conn.ConnectionState().PeerCertificates[0].Raw
+	}
+
+	if !bytes.Equal(served(), cert.Certificate[0]) {
+		t.Fatal("initial certificate not served")
+	}
+
+	if _, _, err := p.RotateCert(0); err != nil {
+		t.Fatal(err)
+	}
+
+	if info, err := os.Stat(nextCertPath(p.serverPrivKeyPath)); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("next private key not private: %v %v", info.Mode(), err)
+	}
+
+	next, err := ioutil.ReadFile(nextCertPath(p.serverCertFilePath))
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, _ := pem.Decode(next)
+	if _, err := x509.ParseCertificate(block.Bytes); err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(served(), block.Bytes) {
+		t.Error("rotated certificate not served to clients without server name")
+	}
+
+	// the server holds the datastore, so a rotated client
+	// certificate is queued for it and trusted at once
+	nextKeyPath, nextCertFile := nextCertPath(clientKeyPath), nextCertPath(clientCertPath)
+	if err := p.generateCert(ca.RoleClient, nextKeyPath, nextCertFile); err != nil {
+		t.Fatal(err)
+	}
+	nextClientCert, err := tls.LoadX509KeyPair(nextCertFile, nextKeyPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// tls 1.2 fails the handshake of the client on rejected certificates
+	handshake := func(cert tls.Certificate) error {
+		conn, err := tls.Dial("tcp", srv.ListenerTCP().Addr().String(), &tls.Config{
+			Certificates:       []tls.Certificate{cert},
+			InsecureSkipVerify: true,
+			MaxVersion:         tls.VersionTLS12,
+			CipherSuites:       []uint16{tls.TLS_RSA_WITH_AES_256_GCM_SHA384},
+		})
+		if err == nil {
+			conn.Close()
+		}
+		return err
+	}
+
+	if err := handshake(nextClientCert); err == nil {
+		t.Fatal("untrusted client certificate accepted")
+	}
+
+	current, _ := ioutil.ReadFile(clientCertPath)
+	nextPEM, _ := ioutil.ReadFile(nextCertFile)
+	bundlePath := bundleCertPath(clientCertPath)
+	if err := ioutil.WriteFile(bundlePath, append(current, nextPEM...), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.QueueCert(p.dataStoreID, p.dataStorePath, "test", bundlePath, true); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, cert := range []tls.Certificate{clientCert, nextClientCert} {
+		if err := handshake(cert); err != nil {
+			t.Errorf("client certificate of queued bundle not trusted: %s", err)
+		}
+	}
+}
@@ -0,0 +1,147 @@
+package context
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"os/user"
+	"regexp"
+	"strings"
+	"syscall"
+
+	"github.com/denkhaus/llconf/logging"
+	"github.com/denkhaus/llconf/util"
+	"github.com/juju/errors"
+)
+
+// uploadDir is the folder uploaded binaries are stored
+// in, relative to the home folder of the ssh user.
+const uploadDir = ".cache/llconf"
+
+var unsafeVersionChars = regexp.MustCompile(`[^A-Za-z0-9._-]`)
+
+//////////////////////////////////////////////////////////////////////////////////
+// sshArgs returns the arguments of ssh to log into target,
+// given as [user@]host[:port]. The login is separated from the
+// options, so targets like -oProxyCommand=... are not parsed as such.
+func sshArgs(target string) ([]string, error) {
+	args := []string{"-T", "-o", "BatchMode=yes"}
+
+	login, host := "", target
+	if i := strings.LastIndex(target, "@"); i >= 0 {
+		login, host = target[:i+1], target[i+1:]
+	}
+
+	if h, port, err := net.SplitHostPort(host); err == nil {
+		host = h
+		args = append(args, "-p", port)
+	}
+
+	host = strings.Trim(host, "[]")
+	if host == "" || strings.HasPrefix(host, "-") || strings.HasPrefix(login, "-") {
+		return nil, errors.Errorf("invalid ssh login %q", target)
+	}
+
+	return append(args, "--", login+host), nil
+}
+
+//////////////////////////////////////////////////////////////////////////////////
+// dialSSH logs into target with ssh and starts llconf in stdio mode
+// there. The stdio of ssh is used as connection to the server.
+func (p *context) dialSSH(target string) (net.Conn, error) {
+	args, err := sshArgs(target)
+	if err != nil {
+		return nil, err
+	}
+
+	remote := p.sshCommand
+	if p.sshUpload {
+		if remote, err = p.uploadBinary(args); err != nil {
+			return nil, errors.Annotate(err, "upload binary")
+		}
+	}
+
+	remoteArgs := []string{remote}
+	if p.debug {
+		remoteArgs = append(remoteArgs, "--debug")
+	}
+	remoteArgs = append(remoteArgs, "server", "stdio")
+
+	cmd := exec.Command("ssh", append(args, remoteArgs...)...)
+	cmd.Stderr = os.Stderr
+	// Ctrl-C cancels the run instead of killing ssh
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, errors.Annotate(err, "stdin pipe")
+	}
+
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, errors.Annotate(err, "stdout pipe")
+	}
+
+	logging.Logger.Infof("connect to %s with ssh", target)
+	if err := cmd.Start(); err != nil {
+		return nil, errors.Annotate(err, "start ssh")
+	}
+
+	return util.NewPipeConn(stdout, stdin, "ssh://"+target, cmd.Wait), nil
+}
+
+//////////////////////////////////////////////////////////////////////////////////
+// uploadBinary copies the running executable to the ssh host, unless
+// the same version has been uploaded before, and returns its path.
+func (p *context) uploadBinary(args []string) (string, error) {
+	version := unsafeVersionChars.ReplaceAllString(p.clientVersion, "_")
+	remote := fmt.Sprintf("%s/llconf-%s", uploadDir, version)
+
+	check := exec.Command("ssh", append(args, "test", "-x", remote)...)
+	if check.Run() == nil {
+		return remote, nil
+	}
+
+	exe, err := os.Executable()
+	if err != nil {
+		return "", errors.Annotate(err, "get executable")
+	}
+
+	f, err := os.Open(exe)
+	if err != nil {
+		return "", errors.Annotate(err, "open executable")
+	}
+	defer f.Close()
+
+	script := fmt.Sprintf("mkdir -p %s && cat > %s.tmp && chmod 0755 %[2]s.tmp && mv %[2]s.tmp %[2]s",
+		uploadDir, remote)
+
+	upload := exec.Command("ssh", append(args, script)...)
+	upload.Stdin = f
+	upload.Stderr = os.Stderr
+
+	logging.Logger.Infof("upload %s to %s", exe, remote)
+	if err := upload.Run(); err != nil {
+		return "", errors.Annotate(err, "copy executable")
+	}
+
+	return remote, nil
+}
+
+//////////////////////////////////////////////////////////////////////////////////
+// ServeConn evaluates the promises of a single client on conn, which
+// has been authenticated by ssh already.
+func (p *context) ServeConn(conn net.Conn) error {
+	srv, err := p.newServer()
+	if err != nil {
+		return errors.Annotate(err, "new server")
+	}
+
+	id := "ssh"
+	if u, err := user.Current(); err == nil {
+		id = "ssh:" + u.Username
+	}
+
+	return srv.ServeConn(conn, id)
+}
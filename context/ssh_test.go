@@ -0,0 +1,32 @@
+package context
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSSHArgs(t *testing.T) {
+	tests := map[string]string{
+		"web1":               "-T -o BatchMode=yes -- web1",
+		"root@web1":          "-T -o BatchMode=yes -- root@web1",
+		"root@web1:2222":     "-T -o BatchMode=yes -p 2222 -- root@web1",
+		"admin@[fd00::1]:22": "-T -o BatchMode=yes -p 22 -- admin@fd00::1",
+	}
+
+	for target, expected := range tests {
+		args, err := sshArgs(target)
+		if err != nil {
+			t.Errorf("%q: %s", target, err)
+			continue
+		}
+		if joined := strings.Join(args, " "); joined != expected {
+			t.Errorf("%q: expected %q, got %q", target, expected, joined)
+		}
+	}
+
+	for _, target := range []string{"-oProxyCommand=touch pwned", "root@-oProxyCommand=id", "-l@web1", "root@"} {
+		if args, err := sshArgs(target); err == nil {
+			t.Errorf("%q: expected error, got %q", target, strings.Join(args, " "))
+		}
+	}
+}
@@ -4,7 +4,9 @@ set -e
 LLCONF=/usr/local/bin/llconf
 CLIENT_CERT="/client.cert.pem"
 
-if [ ! -f "/initialized" ]
+# with LLCONF_ENROLL_TOKEN set the server accepts a single client
+# enrollment on port 9955 instead of waiting for a copied cert
+if [ ! -f "/initialized" ] && [ -z "$LLCONF_ENROLL_TOKEN" ]
 then
 	while [ ! -f $CLIENT_CERT ]
 	do
@@ -0,0 +1,237 @@
+package facts
+
+import (
+	"bufio"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/denkhaus/llconf/logging"
+)
+
+const (
+	OSReleaseFile = "/etc/os-release"
+	MemInfoFile   = "/proc/meminfo"
+	MountsFile    = "/proc/mounts"
+	KernelDir     = "/proc/sys/kernel"
+)
+
+// Facts maps dotted fact names like "os.distro" to their values.
+// Lists are stored comma separated.
+type Facts map[string]string
+
+////////////////////////////////////////////////////////////////////////////////
+// Collect gathers the facts of the local host. Facts that cannot
+// be determined are logged and left out.
+func Collect() Facts {
+	facts := Facts{
+		"arch":      runtime.GOARCH,
+		"os.type":   runtime.GOOS,
+		"cpu.count": strconv.Itoa(runtime.NumCPU()),
+	}
+
+	if hostname, err := os.Hostname(); err == nil {
+		facts["hostname"] = hostname
+		facts["fqdn"] = lookupFQDN(hostname)
+	} else {
+		logging.Logger.Warnf("facts: hostname: %s", err)
+	}
+
+	if f, err := os.Open(OSReleaseFile); err == nil {
+		release := parseOSRelease(f)
+		f.Close()
+
+		facts["os.name"] = release["NAME"]
+		facts["os.distro"] = release["ID"]
+		facts["os.version"] = release["VERSION_ID"]
+		facts["os.codename"] = release["VERSION_CODENAME"]
+	}
+
+	for name, file := range map[string]string{"kernel.name": "ostype", "kernel.release": "osrelease"} {
+		if data, err := ioutil.ReadFile(KernelDir + "/" + file); err == nil {
+			facts[name] = strings.TrimSpace(string(data))
+		}
+	}
+
+	if f, err := os.Open(MemInfoFile); err == nil {
+		if total, ok := parseMemTotal(f); ok {
+			facts["memory.total"] = strconv.FormatUint(total, 10)
+		}
+		f.Close()
+	}
+
+	if f, err := os.Open(MountsFile); err == nil {
+		facts["mounts"] = strings.Join(parseMounts(f), ",")
+		f.Close()
+	}
+
+	collectNetwork(facts)
+	return facts
+}
+
+////////////////////////////////////////////////////////////////////////////////
+func lookupFQDN(hostname string) string {
+	addrs, err := net.LookupHost(hostname)
+	if err != nil {
+		return hostname
+	}
+
+	for _, addr := range addrs {
+		if names, err := net.LookupAddr(addr); err == nil && len(names) > 0 {
+			return strings.TrimSuffix(names[0], ".")
+		}
+	}
+
+	return hostname
+}
+
+////////////////////////////////////////////////////////////////////////////////
+func collectNetwork(facts Facts) {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		logging.Logger.Warnf("facts: interfaces: %s", err)
+		return
+	}
+
+	names, ipv4, ipv6 := []string{}, []string{}, []string{}
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+
+		names = append(names, iface.Name)
+		ifaceV4, ifaceV6 := []string{}, []string{}
+		for _, addr := range addrs {
+			ipnet, ok := addr.(*net.IPNet)
+			if !ok {
+				continue
+			}
+
+			if ipnet.IP.To4() != nil {
+				ifaceV4 = append(ifaceV4, ipnet.IP.String())
+			} else {
+				ifaceV6 = append(ifaceV6, ipnet.IP.String())
+			}
+		}
+
+		facts["interface."+iface.Name+".mac"] = iface.HardwareAddr.String()
+		facts["interface."+iface.Name+".ipv4"] = strings.Join(ifaceV4, ",")
+		facts["interface."+iface.Name+".ipv6"] = strings.Join(ifaceV6, ",")
+		ipv4 = append(ipv4, ifaceV4...)
+		ipv6 = append(ipv6, ifaceV6...)
+	}
+
+	facts["interfaces"] = strings.Join(names, ",")
+	facts["ipv4"] = strings.Join(ipv4, ",")
+	facts["ipv6"] = strings.Join(ipv6, ",")
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// parseOSRelease parses KEY=value lines as found in /etc/os-release.
+func parseOSRelease(r io.Reader) map[string]string {
+	release := map[string]string{}
+
+	scn := bufio.NewScanner(r)
+	for scn.Scan() {
+		line := strings.TrimSpace(scn.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		parts := strings.SplitN(line, "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+
+		value := parts[1]
+		if unquoted, err := strconv.Unquote(value); err == nil {
+			value = unquoted
+		} else {
+			value = strings.Trim(value, `'"`)
+		}
+		release[parts[0]] = value
+	}
+
+	return release
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// parseMemTotal returns the total memory in bytes from /proc/meminfo.
+func parseMemTotal(r io.Reader) (uint64, bool) {
+	scn := bufio.NewScanner(r)
+	for scn.Scan() {
+		fields := strings.Fields(scn.Text())
+		if len(fields) < 2 || fields[0] != "MemTotal:" {
+			continue
+		}
+
+		total, err := strconv.ParseUint(fields[1], 10, 64)
+		if err != nil {
+			return 0, false
+		}
+
+		if len(fields) == 3 && fields[2] == "kB" {
+			total *= 1024
+		}
+		return total, true
+	}
+
+	return 0, false
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// parseMounts returns the sorted mount points of block devices from /proc/mounts.
+func parseMounts(r io.Reader) []string {
+	mounts := []string{}
+
+	scn := bufio.NewScanner(r)
+	for scn.Scan() {
+		fields := strings.Fields(scn.Text())
+		if len(fields) < 2 || !strings.HasPrefix(fields[0], "/") {
+			continue
+		}
+		mounts = append(mounts, fields[1])
+	}
+
+	sort.Strings(mounts)
+	return mounts
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// Tree converts the dotted fact names into nested maps,
+// so templates can access them like {{.facts.os.distro}}.
+func (f Facts) Tree() map[string]interface{} {
+	tree := map[string]interface{}{}
+
+	names := []string{}
+	for name := range f {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		parts := strings.Split(name, ".")
+		node := tree
+		for _, part := range parts[:len(parts)-1] {
+			child, ok := node[part].(map[string]interface{})
+			if !ok {
+				child = map[string]interface{}{}
+				node[part] = child
+			}
+			node = child
+		}
+		node[parts[len(parts)-1]] = f[name]
+	}
+
+	return tree
+}
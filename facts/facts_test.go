@@ -0,0 +1,62 @@
+package facts
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseOSRelease(t *testing.T) {
+	release := parseOSRelease(strings.NewReader(`NAME="Debian GNU/Linux"
+# comment
+ID=debian
+VERSION_ID="12"
+VERSION_CODENAME=bookworm
+`))
+
+	equals(t, "Debian GNU/Linux", release["NAME"])
+	equals(t, "debian", release["ID"])
+	equals(t, "12", release["VERSION_ID"])
+	equals(t, "bookworm", release["VERSION_CODENAME"])
+}
+
+func TestParseMemTotal(t *testing.T) {
+	total, ok := parseMemTotal(strings.NewReader("MemTotal:        2048 kB\nMemFree:  1024 kB\n"))
+	equals(t, true, ok)
+	equals(t, uint64(2048*1024), total)
+}
+
+func TestParseMounts(t *testing.T) {
+	mounts := parseMounts(strings.NewReader(`proc /proc proc rw 0 0
+/dev/sda2 /home ext4 rw 0 0
+/dev/sda1 / ext4 rw 0 0
+`))
+	equals(t, "/,/home", strings.Join(mounts, ","))
+}
+
+func TestTree(t *testing.T) {
+	tree := Facts{"hostname": "web1", "os.distro": "debian", "os.version": "12"}.Tree()
+	expected := map[string]interface{}{
+		"hostname": "web1",
+		"os":       map[string]interface{}{"distro": "debian", "version": "12"},
+	}
+
+	if !reflect.DeepEqual(expected, tree) {
+		t.Errorf("error: wanted %v, got %v", expected, tree)
+	}
+}
+
+func TestCollect(t *testing.T) {
+	facts := Collect()
+	for _, name := range []string{"arch", "os.type", "cpu.count", "hostname"} {
+		if facts[name] == "" {
+			t.Errorf("fact %q not collected", name)
+		}
+	}
+}
+
+func equals(t *testing.T, a interface{}, b interface{}) {
+	if a != b {
+		t.Errorf("error: wanted %v, got %v", a, b)
+	}
+}
@@ -11,15 +11,17 @@ var Logger *stdLogger
 
 type stdLogger struct {
 	*logrus.Logger
-	Changes  int
-	Tests    int
-	Errors   int
-	Warnings int
+	Changes    int
+	Tests      int
+	Conditions int
+	Errors     int
+	Warnings   int
 }
 
 func (p *stdLogger) Reset() {
 	p.Changes = 0
 	p.Tests = 0
+	p.Conditions = 0
 	p.Warnings = 0
 	p.Errors = 0
 }
@@ -53,6 +53,8 @@ func main() {
 	app.Commands = []cli.Command{
 		cmd.NewClientCommand(),
 		cmd.NewServerCommand(),
+		cmd.NewLibCommand(),
+		cmd.NewCACommand(),
 	}
 
 	app.Action = func(ctx *cli.Context) error {
@@ -0,0 +1,507 @@
+package modules
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/denkhaus/llconf/logging"
+	"github.com/denkhaus/llconf/util"
+	"github.com/juju/errors"
+)
+
+// LockFile records the libraries installed into a library folder.
+const LockFile = "llconf.lock"
+
+const (
+	SourceGit     = "git"
+	SourceTarball = "tarball"
+)
+
+////////////////////////////////////////////////////////////////////////////////
+type LockEntry struct {
+	Source   string `json:"source"`
+	Type     string `json:"type"`
+	Revision string `json:"revision"`
+	Checksum string `json:"checksum"`
+}
+
+////////////////////////////////////////////////////////////////////////////////
+type Lock struct {
+	Libraries map[string]LockEntry `json:"libraries"`
+}
+
+////////////////////////////////////////////////////////////////////////////////
+type Library struct {
+	dir  string
+	lock Lock
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// OpenLibrary reads the lock file of the library folder dir.
+// A missing lock file is treated as empty.
+func OpenLibrary(dir string) (*Library, error) {
+	lib := &Library{
+		dir:  dir,
+		lock: Lock{Libraries: make(map[string]LockEntry)},
+	}
+
+	data, err := ioutil.ReadFile(lib.lockPath())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return lib, nil
+		}
+		return nil, errors.Annotate(err, "read lock file")
+	}
+
+	if err := json.Unmarshal(data, &lib.lock); err != nil {
+		return nil, errors.Annotate(err, "decode lock file")
+	}
+
+	if lib.lock.Libraries == nil {
+		lib.lock.Libraries = make(map[string]LockEntry)
+	}
+
+	return lib, nil
+}
+
+////////////////////////////////////////////////////////////////////////////////
+func (p *Library) lockPath() string {
+	return filepath.Join(p.dir, LockFile)
+}
+
+////////////////////////////////////////////////////////////////////////////////
+func (p *Library) path(name string) string {
+	return filepath.Join(p.dir, name)
+}
+
+////////////////////////////////////////////////////////////////////////////////
+func (p *Library) save() error {
+	data, err := json.MarshalIndent(p.lock, "", "  ")
+	if err != nil {
+		return errors.Annotate(err, "encode lock file")
+	}
+
+	if err := ioutil.WriteFile(p.lockPath(), append(data, '\n'), 0644); err != nil {
+		return errors.Annotate(err, "write lock file")
+	}
+
+	return nil
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// Entries returns the installed libraries sorted by name.
+func (p *Library) Entries() ([]string, map[string]LockEntry) {
+	names := []string{}
+	for name := range p.lock.Libraries {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, p.lock.Libraries
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// Install fetches source into the library folder as name. Source is either
+// a git repository, checked out at revision, or a tarball path or url.
+// An empty name is derived from source.
+func (p *Library) Install(source, name, revision string) (string, error) {
+	if name == "" {
+		name = NameFromSource(source)
+	}
+
+	if name == "" || strings.ContainsAny(name, `/\`) || strings.HasPrefix(name, ".") {
+		return "", errors.Errorf("invalid library name %q", name)
+	}
+
+	if _, ok := p.lock.Libraries[name]; ok {
+		return "", errors.Errorf("library %q is already installed", name)
+	}
+
+	if util.FileExists(p.path(name)) {
+		return "", errors.Errorf("library folder %q already exists", p.path(name))
+	}
+
+	entry := LockEntry{Source: source, Type: sourceType(source)}
+	if err := p.fetch(name, &entry, revision); err != nil {
+		os.RemoveAll(p.path(name))
+		return "", errors.Annotatef(err, "fetch %s", source)
+	}
+
+	p.lock.Libraries[name] = entry
+	return name, p.save()
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// Update fetches the library name again, at revision if given. Git
+// libraries without revision are updated to the remote default branch.
+func (p *Library) Update(name, revision string) error {
+	entry, ok := p.lock.Libraries[name]
+	if !ok {
+		return errors.Errorf("library %q is not installed", name)
+	}
+
+	if err := p.fetch(name, &entry, revision); err != nil {
+		return errors.Annotatef(err, "fetch %s", entry.Source)
+	}
+
+	p.lock.Libraries[name] = entry
+	return p.save()
+}
+
+////////////////////////////////////////////////////////////////////////////////
+func (p *Library) Remove(name string) error {
+	if _, ok := p.lock.Libraries[name]; !ok {
+		return errors.Errorf("library %q is not installed", name)
+	}
+
+	if err := os.RemoveAll(p.path(name)); err != nil {
+		return errors.Annotatef(err, "remove library folder")
+	}
+
+	delete(p.lock.Libraries, name)
+	return p.save()
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// Verify checks every installed library against the checksum recorded
+// in the lock file.
+func (p *Library) Verify() error {
+	names, entries := p.Entries()
+	for _, name := range names {
+		sum, err := checksum(p.path(name))
+		if err != nil {
+			return errors.Annotatef(err, "checksum library %q", name)
+		}
+
+		if sum != entries[name].Checksum {
+			return errors.Errorf("library %q does not match its lock entry, "+
+				"please run \"llconf lib update %s\"", name, name)
+		}
+	}
+
+	return nil
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// VerifyLock verifies the libraries installed into dir.
+func VerifyLock(dir string) error {
+	lib, err := OpenLibrary(dir)
+	if err != nil {
+		return errors.Annotate(err, "open library")
+	}
+
+	return lib.Verify()
+}
+
+////////////////////////////////////////////////////////////////////////////////
+func (p *Library) fetch(name string, entry *LockEntry, revision string) error {
+	dir := p.path(name)
+
+	switch entry.Type {
+	case SourceGit:
+		if revision == "" {
+			revision = "origin/HEAD"
+			if !util.FileExists(dir) {
+				revision = "HEAD"
+			}
+		}
+
+		if util.FileExists(dir) {
+			if _, err := git(dir, "fetch", "--quiet", "--tags", "origin"); err != nil {
+				return errors.Annotate(err, "fetch")
+			}
+		}
+
+		if err := checkout(entry.Source, revision, dir); err != nil {
+			return errors.Annotate(err, "checkout")
+		}
+
+		commit, err := git(dir, "rev-parse", "HEAD")
+		if err != nil {
+			return errors.Annotate(err, "get head")
+		}
+		entry.Revision = commit
+	case SourceTarball:
+		sum, err := extractTarball(entry.Source, dir)
+		if err != nil {
+			return errors.Annotate(err, "extract tarball")
+		}
+		entry.Revision = sum
+	default:
+		return errors.Errorf("unknown source type %q", entry.Type)
+	}
+
+	sum, err := checksum(dir)
+	if err != nil {
+		return errors.Annotate(err, "checksum")
+	}
+
+	entry.Checksum = sum
+	logging.Logger.Infof("library %q at %s", name, entry.Revision)
+	return nil
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// NameFromSource derives a library name from a repository or tarball source.
+func NameFromSource(source string) string {
+	name := filepath.Base(strings.TrimRight(source, "/"))
+	for _, suffix := range []string{".git", ".tar.gz", ".tgz", ".tar"} {
+		name = strings.TrimSuffix(name, suffix)
+	}
+	return name
+}
+
+////////////////////////////////////////////////////////////////////////////////
+func sourceType(source string) string {
+	for _, suffix := range []string{".tar.gz", ".tgz", ".tar"} {
+		if strings.HasSuffix(source, suffix) {
+			return SourceTarball
+		}
+	}
+	return SourceGit
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// checksum hashes names and contents of all files below dir, except
+// for git metadata.
+func checksum(dir string) (string, error) {
+	files := []string{}
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if info.IsDir() && info.Name() == ".git" {
+			return filepath.SkipDir
+		}
+
+		if info.Mode().IsRegular() {
+			files = append(files, path)
+		}
+		return nil
+	})
+	if err != nil {
+		return "", errors.Annotate(err, "walk files")
+	}
+
+	sort.Strings(files)
+	hash := sha256.New()
+	for _, file := range files {
+		rel, err := filepath.Rel(dir, file)
+		if err != nil {
+			return "", errors.Annotate(err, "relative path")
+		}
+
+		fmt.Fprintf(hash, "%s\x00", filepath.ToSlash(rel))
+		f, err := os.Open(file)
+		if err != nil {
+			return "", errors.Annotate(err, "open file")
+		}
+		_, err = io.Copy(hash, f)
+		f.Close()
+		if err != nil {
+			return "", errors.Annotate(err, "read file")
+		}
+	}
+
+	return "sha256:" + hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+////////////////////////////////////////////////////////////////////////////////
+func readSource(source string) ([]byte, error) {
+	if strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://") {
+		resp, err := http.Get(source)
+		if err != nil {
+			return nil, errors.Annotate(err, "download")
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK {
+			return nil, errors.Errorf("download: %s", resp.Status)
+		}
+
+		return ioutil.ReadAll(resp.Body)
+	}
+
+	return ioutil.ReadFile(source)
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// extractTarball replaces dir by the contents of the tarball source.
+// A single top level folder in the tarball is stripped.
+func extractTarball(source, dir string) (string, error) {
+	data, err := readSource(source)
+	if err != nil {
+		return "", errors.Annotate(err, "read source")
+	}
+
+	sum := sha256.Sum256(data)
+
+	names, files, err := tarNames(data)
+	if err != nil {
+		return "", errors.Annotate(err, "read tarball")
+	}
+	if len(names) == 0 {
+		return "", errors.New("empty tarball")
+	}
+	prefix := commonPrefix(names, files)
+	top := strings.TrimSuffix(prefix, string(filepath.Separator))
+
+	tmpDir := filepath.Join(filepath.Dir(dir), "."+filepath.Base(dir)+".tmp")
+	if err := os.RemoveAll(tmpDir); err != nil {
+		return "", errors.Annotate(err, "remove temp dir")
+	}
+	defer os.RemoveAll(tmpDir)
+
+	if err := os.MkdirAll(tmpDir, 0755); err != nil {
+		return "", errors.Annotate(err, "create temp dir")
+	}
+
+	tr, err := tarReader(data)
+	if err != nil {
+		return "", errors.Annotate(err, "read tarball")
+	}
+
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", errors.Annotate(err, "read tarball")
+		}
+
+		name := filepath.Clean(hdr.Name)
+		if prefix != "" && name == top {
+			continue
+		}
+
+		name = strings.TrimPrefix(name, prefix)
+		if name == "" || name == "." {
+			continue
+		}
+		if filepath.IsAbs(name) || strings.HasPrefix(name, "..") {
+			return "", errors.Errorf("invalid path %q in tarball", hdr.Name)
+		}
+
+		target := filepath.Join(tmpDir, name)
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(target, 0755); err != nil {
+				return "", errors.Annotate(err, "create dir")
+			}
+		case tar.TypeReg:
+			if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+				return "", errors.Annotate(err, "create dir")
+			}
+			f, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, os.FileMode(hdr.Mode)&0755|0600)
+			if err != nil {
+				return "", errors.Annotate(err, "create file")
+			}
+			_, err = io.Copy(f, tr)
+			f.Close()
+			if err != nil {
+				return "", errors.Annotate(err, "write file")
+			}
+		default:
+			logging.Logger.Warnf("skip unsupported tarball entry %q", hdr.Name)
+		}
+	}
+
+	// the installed folder is only removed once it has been replaced
+	oldDir := filepath.Join(filepath.Dir(dir), "."+filepath.Base(dir)+".old")
+	if err := os.RemoveAll(oldDir); err != nil {
+		return "", errors.Annotate(err, "remove old dir")
+	}
+
+	if err := os.Rename(dir, oldDir); err != nil && !os.IsNotExist(err) {
+		return "", errors.Annotate(err, "move library folder aside")
+	}
+
+	if err := os.Rename(tmpDir, dir); err != nil {
+		os.Rename(oldDir, dir)
+		return "", errors.Annotate(err, "move library folder")
+	}
+
+	if err := os.RemoveAll(oldDir); err != nil {
+		logging.Logger.Warnf("unable to remove %q: %s", oldDir, err)
+	}
+
+	return "sha256:" + hex.EncodeToString(sum[:]), nil
+}
+
+////////////////////////////////////////////////////////////////////////////////
+func tarReader(data []byte) (*tar.Reader, error) {
+	var reader io.Reader = bytes.NewReader(data)
+	if len(data) > 2 && data[0] == 0x1f && data[1] == 0x8b {
+		gz, err := gzip.NewReader(reader)
+		if err != nil {
+			return nil, errors.Annotate(err, "gzip")
+		}
+		reader = gz
+	}
+
+	return tar.NewReader(reader), nil
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// tarNames returns the names of all entries and the set
+// of names that are no folders.
+func tarNames(data []byte) ([]string, map[string]bool, error) {
+	tr, err := tarReader(data)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	names := []string{}
+	files := map[string]bool{}
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return names, files, nil
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+
+		name := filepath.Clean(hdr.Name)
+		names = append(names, name)
+		if hdr.Typeflag != tar.TypeDir {
+			files[name] = true
+		}
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// commonPrefix returns "<dir>/" if all names are located below
+// the same top level folder. A top level file is never stripped.
+func commonPrefix(names []string, files map[string]bool) string {
+	if len(names) == 0 {
+		return ""
+	}
+
+	sep := string(filepath.Separator)
+	top := strings.SplitN(names[0], sep, 2)[0]
+	if files[top] {
+		return ""
+	}
+
+	for _, name := range names {
+		if name != top && !strings.HasPrefix(name, top+sep) {
+			return ""
+		}
+	}
+
+	return top + sep
+}
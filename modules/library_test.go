@@ -0,0 +1,225 @@
+package modules
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+func run(t *testing.T, dir string, name string, args ...string) {
+	cmd := exec.Command(name, args...)
+	cmd.Dir = dir
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("%s %v: %s %s", name, args, err, out)
+	}
+}
+
+// bareRepo creates a bare repository containing a single commit.
+func bareRepo(t *testing.T, root string) string {
+	work := filepath.Join(root, "work")
+	bare := filepath.Join(root, "nginx.git")
+
+	os.MkdirAll(work, 0755)
+	ioutil.WriteFile(filepath.Join(work, "module.cnf"),
+		[]byte(`(export "installed") (installed (test "true"))`), 0644)
+
+	run(t, work, "git", "init", "--quiet")
+	run(t, work, "git", "add", "-A")
+	run(t, work, "git", "-c", "user.name=test", "-c", "user.email=test@test",
+		"commit", "--quiet", "-m", "initial")
+	run(t, root, "git", "clone", "--quiet", "--bare", work, bare)
+	return bare
+}
+
+func TestLibraryGit(t *testing.T) {
+	root, err := ioutil.TempDir("", "llconf-lib")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	bare := bareRepo(t, root)
+	libDir := filepath.Join(root, "lib")
+	os.MkdirAll(libDir, 0755)
+
+	lib, err := OpenLibrary(libDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	name, err := lib.Install(bare, "", "")
+	if err != nil {
+		t.Fatalf("install: %s", err)
+	}
+	equals(t, "nginx", name)
+
+	lib, err = OpenLibrary(libDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, entries := lib.Entries()
+	if len(entries["nginx"].Revision) != 40 {
+		t.Errorf("expected commit hash as revision, found %q", entries["nginx"].Revision)
+	}
+
+	if err := VerifyLock(libDir); err != nil {
+		t.Errorf("verify: %s", err)
+	}
+
+	ioutil.WriteFile(filepath.Join(libDir, "nginx", "module.cnf"), []byte("(tampered)"), 0644)
+	if err := VerifyLock(libDir); err == nil {
+		t.Errorf("verify: expected tampered library to fail")
+	}
+
+	ioutil.WriteFile(filepath.Join(libDir, "nginx", "extra.cnf"), []byte("(tampered)"), 0644)
+	if err := lib.Update("nginx", ""); err != nil {
+		t.Errorf("update: %s", err)
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(libDir, "nginx", "module.cnf"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	equals(t, `(export "installed") (installed (test "true"))`, string(data))
+
+	if _, err := os.Stat(filepath.Join(libDir, "nginx", "extra.cnf")); !os.IsNotExist(err) {
+		t.Errorf("update: untracked file still present")
+	}
+
+	if err := VerifyLock(libDir); err != nil {
+		t.Errorf("verify after update: %s", err)
+	}
+
+	if err := lib.Remove("nginx"); err != nil {
+		t.Errorf("remove: %s", err)
+	}
+
+	if _, err := os.Stat(filepath.Join(libDir, "nginx")); !os.IsNotExist(err) {
+		t.Errorf("remove: library folder still present")
+	}
+}
+
+func TestLibraryTarball(t *testing.T) {
+	root, err := ioutil.TempDir("", "llconf-lib")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	source := filepath.Join(root, "tools-1.0.tar.gz")
+	f, err := os.Create(source)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	gz := gzip.NewWriter(f)
+	tw := tar.NewWriter(gz)
+	content := []byte(`(export "t") (t (test "true"))`)
+	tw.WriteHeader(&tar.Header{Name: "tools-1.0/", Typeflag: tar.TypeDir, Mode: 0755})
+	tw.WriteHeader(&tar.Header{Name: "tools-1.0/module.cnf", Typeflag: tar.TypeReg,
+		Mode: 0644, Size: int64(len(content))})
+	tw.Write(content)
+	tw.Close()
+	gz.Close()
+	f.Close()
+
+	lib, err := OpenLibrary(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	name, err := lib.Install(source, "tools", "")
+	if err != nil {
+		t.Fatalf("install: %s", err)
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(root, name, "module.cnf"))
+	if err != nil {
+		t.Fatalf("top level folder not stripped: %s", err)
+	}
+	equals(t, string(content), string(data))
+
+	if _, err := os.Stat(filepath.Join(root, name, "tools-1.0")); !os.IsNotExist(err) {
+		t.Errorf("top level folder extracted into the library")
+	}
+
+	if err := lib.Verify(); err != nil {
+		t.Errorf("verify: %s", err)
+	}
+}
+
+// writeTarball writes a tarball holding files to path.
+func writeTarball(t *testing.T, path string, files map[string]string) {
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	tw := tar.NewWriter(f)
+	for name, content := range files {
+		tw.WriteHeader(&tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(content))})
+		tw.Write([]byte(content))
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLibraryTarballSingleFile(t *testing.T) {
+	root, err := ioutil.TempDir("", "llconf-lib")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	source := filepath.Join(root, "tools.tar")
+	writeTarball(t, source, map[string]string{"module.cnf": `(export "t") (t (test "true"))`})
+
+	lib, err := OpenLibrary(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	name, err := lib.Install(source, "tools", "")
+	if err != nil {
+		t.Fatalf("install: %s", err)
+	}
+
+	writeTarball(t, source, map[string]string{"module.cnf": `(export "t") (t (test "false"))`})
+	if err := lib.Update(name, ""); err != nil {
+		t.Fatalf("update: %s", err)
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(root, name, "module.cnf"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	equals(t, `(export "t") (t (test "false"))`, string(data))
+
+	// a failing update keeps the installed library
+	writeTarball(t, source, map[string]string{})
+	if err := lib.Update(name, ""); err == nil {
+		t.Error("update with empty tarball succeeded")
+	}
+
+	if _, err := os.Stat(filepath.Join(root, name, "module.cnf")); err != nil {
+		t.Errorf("installed library removed: %s", err)
+	}
+}
+
+func TestNameFromSource(t *testing.T) {
+	equals(t, "nginx", NameFromSource("https://example.com/llconf/nginx.git"))
+	equals(t, "tools-1.0", NameFromSource("/tmp/tools-1.0.tar.gz"))
+	equals(t, "lib", NameFromSource("/srv/lib/"))
+}
+
+func equals(t *testing.T, a interface{}, b interface{}) {
+	if a != b {
+		t.Errorf("error: wanted %q, got %q", a, b)
+	}
+}
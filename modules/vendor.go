@@ -0,0 +1,153 @@
+package modules
+
+import (
+	"bufio"
+	"bytes"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/denkhaus/llconf/compiler"
+	"github.com/denkhaus/llconf/logging"
+	"github.com/denkhaus/llconf/util"
+	"github.com/juju/errors"
+)
+
+// VendorFile lists the modules vendored into an input folder,
+// one "<import path> <git repository> <revision>" entry per line.
+const VendorFile = "vendor.conf"
+
+////////////////////////////////////////////////////////////////////////////////
+type VendorEntry struct {
+	Path       string
+	Repository string
+	Revision   string
+}
+
+////////////////////////////////////////////////////////////////////////////////
+func ReadVendorFile(path string) ([]VendorEntry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, errors.Annotate(err, "open vendor file")
+	}
+	defer f.Close()
+
+	entries := []VendorEntry{}
+	scn := bufio.NewScanner(f)
+	for line := 1; scn.Scan(); line++ {
+		text := strings.TrimSpace(scn.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		fields := strings.Fields(text)
+		if len(fields) != 3 {
+			return nil, errors.Errorf("%s:%d: expected <path> <repository> <revision>", path, line)
+		}
+
+		if filepath.IsAbs(fields[0]) || strings.HasPrefix(filepath.Clean(fields[0]), "..") {
+			return nil, errors.Errorf("%s:%d: import path %q must be relative", path, line, fields[0])
+		}
+
+		entries = append(entries, VendorEntry{
+			Path:       fields[0],
+			Repository: fields[1],
+			Revision:   fields[2],
+		})
+	}
+
+	if err := scn.Err(); err != nil {
+		return nil, errors.Annotate(err, "read vendor file")
+	}
+
+	return entries, nil
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// Vendor checks out every module listed in the vendor file of inputDir
+// at its pinned revision below the vendor folder of inputDir.
+func Vendor(inputDir string) error {
+	entries, err := ReadVendorFile(filepath.Join(inputDir, VendorFile))
+	if err != nil {
+		return errors.Annotate(err, "read vendor file")
+	}
+
+	for _, entry := range entries {
+		dir := filepath.Join(inputDir, compiler.VendorDir, entry.Path)
+		if err := checkout(entry.Repository, entry.Revision, dir); err != nil {
+			return errors.Annotatef(err, "vendor %q", entry.Path)
+		}
+
+		if !util.FileExists(filepath.Join(dir, compiler.ModuleFile)) {
+			logging.Logger.Warnf("vendored %q has no %s and cannot be imported",
+				entry.Path, compiler.ModuleFile)
+		}
+	}
+
+	return nil
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// checkout clones repository into dir if needed and detaches its HEAD
+// at revision. Local changes and untracked files are always discarded,
+// so the work tree matches revision even if HEAD did not move.
+func checkout(repository, revision, dir string) error {
+	if !util.FileExists(dir) {
+		if err := os.MkdirAll(filepath.Dir(dir), 0755); err != nil {
+			return errors.Annotate(err, "create parent dir")
+		}
+
+		logging.Logger.Infof("clone %s into %q", repository, dir)
+		if _, err := git("", "clone", "--quiet", repository, dir); err != nil {
+			return errors.Annotate(err, "clone")
+		}
+	}
+
+	commit, err := git(dir, "rev-parse", "--verify", "--quiet", revision+"^{commit}")
+	if err != nil {
+		if _, err := git(dir, "fetch", "--quiet", "--tags", "origin"); err != nil {
+			return errors.Annotate(err, "fetch")
+		}
+
+		if commit, err = git(dir, "rev-parse", "--verify", "--quiet", revision+"^{commit}"); err != nil {
+			return errors.Errorf("revision %q not found in %s", revision, repository)
+		}
+	}
+
+	head, err := git(dir, "rev-parse", "HEAD")
+	if err != nil {
+		return errors.Annotate(err, "get head")
+	}
+
+	if head != commit {
+		logging.Logger.Infof("checkout %s in %q", revision, dir)
+	}
+
+	if _, err := git(dir, "checkout", "--quiet", "--force", "--detach", commit); err != nil {
+		return errors.Annotate(err, "checkout")
+	}
+
+	if _, err := git(dir, "clean", "--quiet", "--force", "-d", "-x"); err != nil {
+		return errors.Annotate(err, "clean")
+	}
+
+	return nil
+}
+
+////////////////////////////////////////////////////////////////////////////////
+func git(dir string, args ...string) (string, error) {
+	var stdout, stderr bytes.Buffer
+
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		return "", errors.Annotatef(err, "git %s: %s",
+			strings.Join(args, " "), strings.TrimSpace(stderr.String()))
+	}
+
+	return strings.TrimSpace(stdout.String()), nil
+}
@@ -14,7 +14,7 @@ func TestAndPromiseEvalAllTrue(t *testing.T) {
 	promise := AndPromise{[]Promise{}}
 
 	for i := 0; i < 10; i++ {
-		promise.Promises = append(promise.Promises, DummyPromise{"n:" + string(1), true})
+		promise.Promises = append(promise.Promises, DummyPromise{"n:1", true})
 	}
 
 	result := promise.Eval([]Constant{}, &Context{}, "teststack")
@@ -25,7 +25,7 @@ func TestAndPromiseEvalSomeFalse(t *testing.T) {
 	promise := AndPromise{[]Promise{}}
 	promise.Promises = append(promise.Promises, DummyPromise{"n:0", false})
 	for i := 1; i < 10; i++ {
-		promise.Promises = append(promise.Promises, DummyPromise{"n:" + string(1), true})
+		promise.Promises = append(promise.Promises, DummyPromise{"n:1", true})
 	}
 
 	result := promise.Eval([]Constant{}, &Context{}, "teststack")
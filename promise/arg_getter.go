@@ -13,8 +13,8 @@ type ArgGetter struct {
 }
 
 func (p ArgGetter) GetValue(arguments []Constant, vars *Variables) string {
-	if len(arguments) <= p.Position {
-		return ""
+	if p.Position < 0 || len(arguments) <= p.Position {
+		raiseEvalError("argument %d out of range, %d arguments given", p.Position, len(arguments))
 	}
 	return string(arguments[p.Position])
 }
@@ -0,0 +1,51 @@
+package promise
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// canceled reports whether the evaluation in ctx has been canceled.
+func canceled(ctx *Context) bool {
+	if ctx.Cancel == nil {
+		return false
+	}
+
+	select {
+	case <-ctx.Cancel:
+		return true
+	default:
+		return false
+	}
+}
+
+// checkCanceled aborts the evaluation at a promise boundary
+// if it has been canceled.
+func checkCanceled(ctx *Context) {
+	if canceled(ctx) {
+		raiseEvalError("evaluation canceled")
+	}
+}
+
+// killOnCancel kills the process groups of the started cmds once the
+// evaluation in ctx is canceled, until the returned func is called.
+func killOnCancel(ctx *Context, cmds ...*exec.Cmd) (stop func()) {
+	if ctx.Cancel == nil {
+		return func() {}
+	}
+
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-done:
+		case <-ctx.Cancel:
+			for _, cmd := range cmds {
+				if cmd.Process != nil {
+					syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+				}
+			}
+		}
+	}()
+
+	return func() { close(done) }
+}
@@ -0,0 +1,47 @@
+package promise
+
+import "fmt"
+
+// EvalError aborts the evaluation of a promise tree. It is raised as panic
+// by getters and carries the stack of the innermost named promise.
+type EvalError struct {
+	Err   error
+	Stack string
+}
+
+func (e *EvalError) Error() string {
+	if e.Stack == "" {
+		return e.Err.Error()
+	}
+	return fmt.Sprintf("%s in %s", e.Err, e.Stack)
+}
+
+func raiseEvalError(format string, args ...interface{}) {
+	panic(&EvalError{Err: fmt.Errorf(format, args...)})
+}
+
+// annotateEvalError adds stack to an EvalError that has none yet
+// and raises it again. Use it deferred.
+func annotateEvalError(stack string) {
+	if e := recover(); e != nil {
+		if evalErr, ok := e.(*EvalError); ok && evalErr.Stack == "" {
+			evalErr.Stack = stack
+		}
+		panic(e)
+	}
+}
+
+// descValue returns the value of arg for descriptions, which
+// are built without variables, or arg itself if it has none.
+func descValue(arg Argument, arguments []Constant) (value string) {
+	defer func() {
+		if e := recover(); e != nil {
+			if _, ok := e.(*EvalError); !ok {
+				panic(e)
+			}
+			value = arg.String()
+		}
+	}()
+
+	return arg.GetValue(arguments, &Variables{})
+}
@@ -1,14 +1,11 @@
 package promise
 
 import (
-	"bufio"
 	"bytes"
-	"io"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"strings"
-	"sync"
 	"syscall"
 	"time"
 
@@ -35,13 +32,17 @@ func (t ExecType) Name() string {
 	}
 }
 
-func (t ExecType) IncrementExecCounter() {
+func (t ExecType) IncrementExecCounter(ctx *Context) {
 	if t == ExecChange {
 		logging.Logger.Changes++
 	}
 
 	if t == ExecTest {
-		logging.Logger.Tests++
+		if ctx.Condition {
+			logging.Logger.Conditions++
+		} else {
+			logging.Logger.Tests++
+		}
 	}
 }
 
@@ -52,7 +53,6 @@ func (t ExecType) String() string {
 type ExecPromise struct {
 	Type      ExecType
 	Arguments []Argument
-	wgOutput  sync.WaitGroup
 }
 
 func (p ExecPromise) New(children []Promise, args []Argument) (Promise, error) {
@@ -89,9 +89,11 @@ func (p ExecPromise) getCommand(arguments []Constant, ctx *Context) (*exec.Cmd,
 		cmd.Dir = os.Getenv("PWD")
 	}
 
-	if ctx.Credential != nil {
+	if ctx.Credential != nil || ctx.Cancel != nil {
 		cmd.SysProcAttr = &syscall.SysProcAttr{
 			Credential: ctx.Credential,
+			// own process group, so cancellation kills the children too
+			Setpgid: ctx.Cancel != nil,
 		}
 	}
 
@@ -108,58 +110,27 @@ func (p ExecPromise) Desc(arguments []Constant) string {
 		return "(" + p.Type.Name() + ")"
 	}
 
-	cmd := p.Arguments[0].GetValue(arguments, &Variables{})
+	cmd := descValue(p.Arguments[0], arguments)
 	largs := p.Arguments[1:]
 
 	args := make([]string, len(largs))
 	for i, v := range largs {
-		args[i] = v.GetValue(arguments, &Variables{})
+		args[i] = descValue(v, arguments)
 	}
 
 	return "(" + p.Type.Name() + " <" + cmd + " [" + strings.Join(args, ", ") + "] >)"
 }
 
-////////////////////////////////////////////////////////////////////////////////
-func (p ExecPromise) processOutput(ctx *Context, cmd *exec.Cmd) error {
-	ctx.ExecStdout.Reset()
-	ctx.ExecStderr.Reset()
-
-	process := func(reader io.Reader, writer io.Writer) {
-		cw := bufio.NewWriter(writer)
-		p.wgOutput.Add(1)
-		defer func() {
-			cw.Flush()
-			p.wgOutput.Done()
-		}()
-
-		scn := bufio.NewScanner(reader)
-		for scn.Scan() {
-			cw.WriteString(scn.Text())
-		}
-	}
-
-	outReader, err := cmd.StdoutPipe()
-	if err != nil {
-		return errors.Annotate(err, "get stdout pipe")
-	}
-
-	errReader, err := cmd.StderrPipe()
-	if err != nil {
-		return errors.Annotate(err, "get stderr pipe")
-	}
-
-	go process(outReader, ctx.ExecStdout)
-	go process(errReader, ctx.ExecStderr)
-
-	return nil
-}
-
 func (p ExecPromise) Eval(arguments []Constant, ctx *Context, stack string) bool {
 	cmd, err := p.getCommand(arguments, ctx)
 	if err != nil {
 		panic(errors.Annotate(err, "get command"))
 	}
 
+	if p.Type == ExecChange && skipReadOnly(ctx, stack, strings.Join(cmd.Args, " ")) {
+		return true
+	}
+
 	quit := make(chan bool)
 	defer func() { quit <- true }()
 
@@ -172,16 +143,22 @@ func (p ExecPromise) Eval(arguments []Constant, ctx *Context, stack string) bool
 		}
 	}(quit)
 
-	if err := p.processOutput(ctx, cmd); err != nil {
-		panic(errors.Annotate(err, "process output"))
-	}
+	checkCanceled(ctx)
+
+	var flush func()
+	cmd.Stdout, cmd.Stderr, flush = outputStreams(ctx, stack, ctx.Verbose || p.Type == ExecChange)
 	if err := cmd.Start(); err != nil {
 		panic(errors.Annotate(err, "cmd start"))
 	}
 
+	stop := killOnCancel(ctx, cmd)
 	ret := (cmd.Wait() == nil)
-	//wait until output is processed
-	p.wgOutput.Wait()
+	stop()
+	flush()
+
+	if canceled(ctx) {
+		raiseEvalError("canceled while running %s", strings.Join(cmd.Args, " "))
+	}
 
 	if ctx.Verbose || p.Type == ExecChange {
 		logging.Logger.Info(stack)
@@ -189,7 +166,7 @@ func (p ExecPromise) Eval(arguments []Constant, ctx *Context, stack string) bool
 		processCmdOutput(ctx)
 	}
 
-	p.Type.IncrementExecCounter()
+	p.Type.IncrementExecCounter(ctx)
 	return ret
 }
 
@@ -260,6 +237,12 @@ func (p PipePromise) Eval(arguments []Constant, ctx *Context, stack string) bool
 		}
 	}
 
+	if pipe_contains_change && skipReadOnly(ctx, stack, strings.Join(cstrings, " | ")) {
+		return true
+	}
+
+	checkCanceled(ctx)
+
 	nCommands := len(commands)
 	for i, command := range commands[:nCommands-1] {
 		out, err := command.StdoutPipe()
@@ -271,22 +254,31 @@ func (p PipePromise) Eval(arguments []Constant, ctx *Context, stack string) bool
 			panic(errors.Annotate(err, "start"))
 		}
 
-		p.Execs[i].Type.IncrementExecCounter()
+		p.Execs[i].Type.IncrementExecCounter(ctx)
 		commands[i+1].Stdin = out
 	}
 
 	last_cmd := commands[len(commands)-1]
 
-	ctx.ExecStdout.Reset()
-	ctx.ExecStderr.Reset()
+	var flush func()
+	last_cmd.Stdout, last_cmd.Stderr, flush = outputStreams(ctx, stack, ctx.Verbose || pipe_contains_change)
 
-	last_cmd.Stdout = ctx.ExecStdout
-	last_cmd.Stderr = ctx.ExecStderr
-	ret := (last_cmd.Run() == nil)
+	ret := false
+	stop := func() {}
+	if err := last_cmd.Start(); err == nil {
+		stop = killOnCancel(ctx, commands...)
+		ret = (last_cmd.Wait() == nil)
+	}
 
 	for _, command := range commands[:nCommands-1] {
 		command.Wait()
 	}
+	stop()
+	flush()
+
+	if canceled(ctx) {
+		raiseEvalError("canceled while running %s", strings.Join(cstrings, " | "))
+	}
 
 	if ctx.Verbose || pipe_contains_change {
 		logging.Logger.Info(stack)
@@ -355,7 +347,7 @@ func (p SPipePromise) Eval(arguments []Constant, ctx *Context, stack string) boo
 			panic(errors.Annotate(err, "get command"))
 		}
 
-		v.Type.IncrementExecCounter()
+		v.Type.IncrementExecCounter(ctx)
 		cstrings = append(cstrings, "["+v.Type.String()+"] "+strings.Join(cmd.Args, " "))
 		commands = append(commands, cmd)
 
@@ -364,6 +356,12 @@ func (p SPipePromise) Eval(arguments []Constant, ctx *Context, stack string) boo
 		}
 	}
 
+	if pipe_contains_change && skipReadOnly(ctx, stack, strings.Join(cstrings, " | ")) {
+		return true
+	}
+
+	checkCanceled(ctx)
+
 	nCommands := len(commands)
 	for i, command := range commands[:nCommands-1] {
 		out, err := command.StdoutPipe()
@@ -380,16 +378,25 @@ func (p SPipePromise) Eval(arguments []Constant, ctx *Context, stack string) boo
 
 	last_cmd := commands[len(commands)-1]
 
-	ctx.ExecStdout.Reset()
-	ctx.ExecStderr.Reset()
+	var flush func()
+	last_cmd.Stdout, last_cmd.Stderr, flush = outputStreams(ctx, stack, ctx.Verbose || pipe_contains_change)
 
-	last_cmd.Stdout = ctx.ExecStdout
-	last_cmd.Stderr = ctx.ExecStderr
-	ret := (last_cmd.Run() == nil)
+	ret := false
+	stop := func() {}
+	if err := last_cmd.Start(); err == nil {
+		stop = killOnCancel(ctx, commands...)
+		ret = (last_cmd.Wait() == nil)
+	}
 
 	for _, command := range commands[:nCommands-1] {
 		command.Wait()
 	}
+	stop()
+	flush()
+
+	if canceled(ctx) {
+		raiseEvalError("canceled while running %s", strings.Join(cstrings, " | "))
+	}
 
 	if ctx.Verbose || pipe_contains_change {
 		logging.Logger.Info(stack)
@@ -401,6 +408,14 @@ func (p SPipePromise) Eval(arguments []Constant, ctx *Context, stack string) boo
 
 ////////////////////////////////////////////////////////////////////////////////
 func processCmdOutput(ctx *Context) {
+	if ctx.Output != nil {
+		// the output has been streamed already
+		if len(bytes.TrimSpace(ctx.ExecStderr.Bytes())) > 0 {
+			logging.Logger.Warnings++
+		}
+		return
+	}
+
 	process := func(prefix string, buf *bytes.Buffer, outFunc func(string, ...interface{})) {
 		str := util.NewStriplines()
 		str.Write(buf.Bytes())
@@ -2,13 +2,22 @@ package promise
 
 import (
 	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
 	"strconv"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/denkhaus/llconf/logging"
 )
 
 func TestExecPromise(t *testing.T) {
 	var promise Promise
-	promise = ExecPromise{ExecTest, []Argument{
+	promise = ExecPromise{Type: ExecTest, Arguments: []Argument{
 		Constant("/bin/echo"),
 		Constant("Hello"),
 		ArgGetter{0}}}
@@ -17,7 +26,7 @@ func TestExecPromise(t *testing.T) {
 	ctx := NewContext()
 	ctx.ExecStdout = &out
 
-	res := promise.Eval([]Constant{}, &ctx, "teststack")
+	res := promise.Eval([]Constant{""}, &ctx, "teststack")
 	equals(t, true, res)
 
 	equals(t, strconv.Itoa(7), strconv.Itoa(len(out.String())))
@@ -25,9 +34,9 @@ func TestExecPromise(t *testing.T) {
 }
 
 func TestPipePromise(t *testing.T) {
-	exec1 := ExecPromise{ExecTest, []Argument{Constant("/bin/echo"),
+	exec1 := ExecPromise{Type: ExecTest, Arguments: []Argument{Constant("/bin/echo"),
 		Constant("hello world")}}
-	exec2 := ExecPromise{ExecChange, []Argument{Constant("/usr/bin/rev")}}
+	exec2 := ExecPromise{Type: ExecChange, Arguments: []Argument{Constant("/usr/bin/rev")}}
 
 	var promise Promise
 
@@ -55,17 +64,122 @@ func TestExecReporting(t *testing.T) {
 		promise ExecPromise
 		changes int
 	}{
-		{ExecPromise{ExecChange, arguments}, 1},
-		{ExecPromise{ExecTest, arguments}, 0},
+		{ExecPromise{Type: ExecChange, Arguments: arguments}, 1},
+		{ExecPromise{Type: ExecTest, Arguments: arguments}, 0},
 	}
 
 	for _, test := range tests {
+		logging.Logger.Reset()
+
 		var out bytes.Buffer
 		ctx := NewContext()
 		ctx.ExecStdout = &out
 
-		res := test.promise.Eval([]Constant{}, &ctx, "teststack")
+		res := test.promise.Eval([]Constant{""}, &ctx, "teststack")
 		equals(t, true, res)
 		equals(t, strconv.Itoa(test.changes), strconv.Itoa(logging.Logger.Changes))
 	}
 }
+
+func TestReadOnlyChange(t *testing.T) {
+	dir, err := ioutil.TempDir("", "llconf-readonly")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "touched")
+	change := ExecPromise{Type: ExecChange, Arguments: []Argument{
+		Constant("/usr/bin/touch"), Constant(file)}}
+	pipe := PipePromise{[]ExecPromise{
+		{Type: ExecTest, Arguments: []Argument{Constant("/bin/echo")}},
+		change,
+	}}
+
+	ctx := NewContext()
+	ctx.ReadOnly = true
+
+	equals(t, true, change.Eval([]Constant{}, &ctx, "teststack"))
+	equals(t, true, pipe.Eval([]Constant{}, &ctx, "teststack"))
+
+	if _, err := os.Stat(file); !os.IsNotExist(err) {
+		t.Errorf("read-only change has been executed")
+	}
+}
+
+func TestExecOutputStream(t *testing.T) {
+	var out bytes.Buffer
+	ctx := NewContext()
+	ctx.Output = &out
+
+	change := ExecPromise{Type: ExecChange, Arguments: []Argument{
+		Constant("/bin/sh"), Constant("-c"), Constant("echo one; echo two >&2; printf three")}}
+
+	equals(t, true, change.Eval([]Constant{}, &ctx, "stack"))
+	equals(t, "one\nthree", ctx.ExecStdout.String())
+	equals(t, "two\n", ctx.ExecStderr.String())
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	sort.Strings(lines)
+	equals(t, "stack stderr: two|stack stdout: one|stack stdout: three", strings.Join(lines, "|"))
+
+	out.Reset()
+	test := ExecPromise{Type: ExecTest, Arguments: []Argument{Constant("/bin/echo"), Constant("quiet")}}
+	equals(t, true, test.Eval([]Constant{}, &ctx, "stack"))
+	equals(t, "", out.String())
+}
+
+// failingWriter fails every write, like a disconnected client.
+type failingWriter struct {
+	writes int
+}
+
+func (w *failingWriter) Write(p []byte) (int, error) {
+	w.writes++
+	return 0, errors.New("client disconnected")
+}
+
+func TestExecOutputStreamFails(t *testing.T) {
+	out := &failingWriter{}
+	ctx := NewContext()
+	ctx.Output = out
+
+	change := ExecPromise{Type: ExecChange, Arguments: []Argument{
+		Constant("/bin/sh"), Constant("-c"), Constant("echo one; echo two; echo three >&2; printf four")}}
+
+	equals(t, true, change.Eval([]Constant{}, &ctx, "stack"))
+	equals(t, "one\ntwo\nfour", ctx.ExecStdout.String())
+	equals(t, "three\n", ctx.ExecStderr.String())
+	equals(t, 1, out.writes)
+}
+
+func TestExecCancel(t *testing.T) {
+	cancel := make(chan struct{})
+	ctx := NewContext()
+	ctx.Cancel = cancel
+
+	tree := NamedPromise{Name: "build", Promise: ExecPromise{Type: ExecChange, Arguments: []Argument{
+		Constant("/bin/sh"), Constant("-c"), Constant("sleep 10; echo done")}}}
+
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		close(cancel)
+	}()
+
+	start := time.Now()
+	defer func() {
+		evalErr, ok := recover().(*EvalError)
+		if !ok {
+			t.Fatal("expected evaluation to be canceled")
+		}
+		if !strings.Contains(evalErr.Error(), "canceled while running") ||
+			!strings.HasSuffix(evalErr.Error(), "in ->build") {
+			t.Errorf("unexpected error %q", evalErr)
+		}
+		if time.Since(start) > 5*time.Second {
+			t.Error("command has not been killed")
+		}
+	}()
+
+	tree.Eval([]Constant{}, &ctx, "")
+}
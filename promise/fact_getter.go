@@ -0,0 +1,41 @@
+package promise
+
+import (
+	"strings"
+
+	"github.com/denkhaus/llconf/facts"
+)
+
+// FactPrefix prefixes the names of host facts in the variables.
+// Facts are collected when a run starts.
+const FactPrefix = "fact:"
+
+type FactGetter struct {
+	Name string
+}
+
+func (getter FactGetter) GetValue(arguments []Constant, vars *Variables) string {
+	return (*vars)[FactPrefix+getter.Name]
+}
+
+func (getter FactGetter) String() string {
+	return "[fact:" + getter.Name + "]"
+}
+
+// SetFacts stores facts in vars.
+func SetFacts(vars Variables, f facts.Facts) {
+	for name, value := range f {
+		vars[FactPrefix+name] = value
+	}
+}
+
+// GetFacts returns the facts stored in vars.
+func GetFacts(vars Variables) facts.Facts {
+	f := facts.Facts{}
+	for name, value := range vars {
+		if strings.HasPrefix(name, FactPrefix) {
+			f[strings.TrimPrefix(name, FactPrefix)] = value
+		}
+	}
+	return f
+}
@@ -0,0 +1,20 @@
+package promise
+
+import (
+	"testing"
+
+	"github.com/denkhaus/llconf/facts"
+)
+
+func TestFactGetter(t *testing.T) {
+	vars := Variables{"distro": "var"}
+	SetFacts(vars, facts.Facts{"os.distro": "debian"})
+
+	equals(t, "debian", FactGetter{"os.distro"}.GetValue([]Constant{}, &vars))
+	equals(t, "", FactGetter{"os.version"}.GetValue([]Constant{}, &vars))
+	equals(t, "[fact:os.distro]", FactGetter{"os.distro"}.String())
+
+	f := GetFacts(vars)
+	equals(t, 1, len(f))
+	equals(t, "debian", f["os.distro"])
+}
@@ -0,0 +1,133 @@
+package promise
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/juju/errors"
+)
+
+const (
+	ForeachStop     = "stop"
+	ForeachContinue = "continue"
+)
+
+// ForeachPromise evaluates Promise once for every element of List,
+// with the element bound to the variable VarName.
+type ForeachPromise struct {
+	VarName Argument
+	List    Argument
+	Mode    Argument
+	Promise Promise
+}
+
+func (p ForeachPromise) New(children []Promise, args []Argument) (Promise, error) {
+	if len(children) != 1 {
+		return nil, errors.New("(foreach) needs exactly one nested promise")
+	}
+
+	if len(args) != 2 && len(args) != 3 {
+		return nil, errors.New("use (foreach \"varname\" \"list\" [\"stop|continue\"] (promise))")
+	}
+
+	promise := ForeachPromise{
+		VarName: args[0],
+		List:    args[1],
+		Mode:    Constant(ForeachStop),
+		Promise: children[0],
+	}
+
+	if len(args) == 3 {
+		promise.Mode = args[2]
+	}
+
+	if mode, ok := promise.Mode.(Constant); ok {
+		if mode != ForeachStop && mode != ForeachContinue {
+			return nil, errors.Errorf("(foreach) unknown mode %q", string(mode))
+		}
+	}
+
+	return promise, nil
+}
+
+func (p ForeachPromise) Desc(arguments []Constant) string {
+	return fmt.Sprintf("(foreach %s %s %s %s)", p.VarName, p.List, p.Mode, p.Promise.Desc(arguments))
+}
+
+func (p ForeachPromise) Eval(arguments []Constant, ctx *Context, stack string) bool {
+	name := p.VarName.GetValue(arguments, &ctx.Vars)
+	list := p.List.GetValue(arguments, &ctx.Vars)
+	mode := p.Mode.GetValue(arguments, &ctx.Vars)
+
+	if mode != ForeachStop && mode != ForeachContinue {
+		raiseEvalError("(foreach) unknown mode %q", mode)
+	}
+
+	items, err := SplitList(list)
+	if err != nil {
+		raiseEvalError("(foreach) split list: %s", err)
+	}
+
+	result := true
+	for _, item := range items {
+		copyied_vars := Variables{}
+		for k, v := range ctx.Vars {
+			copyied_vars[k] = v
+		}
+		copyied_vars[name] = item
+
+		copyied_ctx := *ctx
+		copyied_ctx.Vars = copyied_vars
+
+		if !p.Promise.Eval(arguments, &copyied_ctx, stack+"->"+name+"="+item) {
+			result = false
+			if mode == ForeachStop {
+				break
+			}
+		}
+	}
+
+	return result
+}
+
+// SplitList splits a list given as JSON array, as lines or as
+// comma separated values. Empty elements are dropped.
+func SplitList(list string) ([]string, error) {
+	list = strings.TrimSpace(list)
+
+	var elements []string
+	switch {
+	case strings.HasPrefix(list, "["):
+		var values []interface{}
+		if err := json.Unmarshal([]byte(list), &values); err != nil {
+			return nil, errors.Annotate(err, "unmarshal json array")
+		}
+
+		for _, v := range values {
+			if s, ok := v.(string); ok {
+				elements = append(elements, s)
+				continue
+			}
+
+			data, err := json.Marshal(v)
+			if err != nil {
+				return nil, errors.Annotate(err, "marshal json element")
+			}
+			elements = append(elements, string(data))
+		}
+	case strings.Contains(list, "\n"):
+		elements = strings.Split(list, "\n")
+	default:
+		elements = strings.Split(list, ",")
+	}
+
+	items := []string{}
+	for _, e := range elements {
+		if e = strings.TrimSpace(e); e != "" {
+			items = append(items, e)
+		}
+	}
+
+	return items, nil
+}
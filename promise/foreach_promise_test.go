@@ -0,0 +1,82 @@
+package promise
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSplitList(t *testing.T) {
+	var tests = []struct {
+		list   string
+		result string
+	}{
+		{"alice, bob,carol", "alice|bob|carol"},
+		{"alice\nbob, jr.\n\ncarol\n", "alice|bob, jr.|carol"},
+		{`["alice", "bob", 3, {"name": "carol"}]`, `alice|bob|3|{"name":"carol"}`},
+		{"", ""},
+	}
+
+	for _, test := range tests {
+		items, err := SplitList(test.list)
+		if err != nil {
+			t.Errorf("SplitList %q: %s", test.list, err)
+			continue
+		}
+		equals(t, test.result, strings.Join(items, "|"))
+	}
+}
+
+// CollectPromise records the value of a variable for every evaluation.
+type CollectPromise struct {
+	Name   string
+	Values *[]string
+	Result bool
+}
+
+func (p CollectPromise) New(children []Promise, args []Argument) (Promise, error) {
+	return p, nil
+}
+
+func (p CollectPromise) Desc(arguments []Constant) string {
+	return "(collect)"
+}
+
+func (p CollectPromise) Eval(arguments []Constant, ctx *Context, stack string) bool {
+	*p.Values = append(*p.Values, ctx.Vars[p.Name])
+	return p.Result
+}
+
+func TestForeachPromise(t *testing.T) {
+	values := []string{}
+	promise := ForeachPromise{Constant("user"), VarGetter{Name: "users"}, Constant(ForeachStop),
+		CollectPromise{"user", &values, true}}
+
+	ctx := NewContext()
+	ctx.Vars["users"] = "alice,bob"
+
+	equals(t, true, promise.Eval([]Constant{}, &ctx, "foreach"))
+	equals(t, "alice|bob", strings.Join(values, "|"))
+
+	if _, ok := ctx.Vars["user"]; ok {
+		t.Errorf("(foreach) loop variable leaked into outer scope")
+	}
+}
+
+func TestForeachPromiseMode(t *testing.T) {
+	for mode, count := range map[string]int{ForeachStop: 1, ForeachContinue: 3} {
+		values := []string{}
+		promise := ForeachPromise{Constant("item"), Constant("a,b,c"), Constant(mode),
+			CollectPromise{"item", &values, false}}
+
+		ctx := NewContext()
+		equals(t, false, promise.Eval([]Constant{}, &ctx, "foreach"))
+		equals(t, count, len(values))
+	}
+}
+
+func TestForeachPromiseNew(t *testing.T) {
+	if _, err := (ForeachPromise{}).New([]Promise{DummyPromise{}},
+		[]Argument{Constant("item"), Constant("a,b"), Constant("sometimes")}); err == nil {
+		t.Errorf("(foreach) TestNew: expected exception for unknown mode")
+	}
+}
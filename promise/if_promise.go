@@ -0,0 +1,85 @@
+package promise
+
+import "github.com/juju/errors"
+
+// IfPromise evaluates Then if Condition is kept and Else otherwise.
+// Tests evaluated as condition are counted as conditions, not as tests.
+type IfPromise struct {
+	Condition Promise
+	Then      Promise
+	Else      Promise
+}
+
+func (p IfPromise) New(children []Promise, args []Argument) (Promise, error) {
+	if len(children) != 2 && len(children) != 3 {
+		return nil, errors.New("use (if (condition) (then) [(else)])")
+	}
+
+	if len(args) != 0 {
+		return nil, errors.New("string args are not allowed in (if) promises")
+	}
+
+	promise := IfPromise{Condition: children[0], Then: children[1]}
+	if len(children) == 3 {
+		promise.Else = children[2]
+	}
+
+	return promise, nil
+}
+
+func (p IfPromise) Desc(arguments []Constant) string {
+	desc := "(if " + p.Condition.Desc(arguments) + " " + p.Then.Desc(arguments)
+	if p.Else != nil {
+		desc += " " + p.Else.Desc(arguments)
+	}
+	return desc + ")"
+}
+
+func (p IfPromise) Eval(arguments []Constant, ctx *Context, stack string) bool {
+	if evalCondition(p.Condition, arguments, ctx, stack) {
+		return p.Then.Eval(arguments, ctx, stack)
+	}
+
+	if p.Else != nil {
+		return p.Else.Eval(arguments, ctx, stack)
+	}
+
+	return true
+}
+
+// WhenPromise evaluates Promise only if Condition is kept.
+// An unmet condition is not a failure.
+type WhenPromise struct {
+	Condition Promise
+	Promise   Promise
+}
+
+func (p WhenPromise) New(children []Promise, args []Argument) (Promise, error) {
+	if len(children) != 2 {
+		return nil, errors.New("use (when (condition) (promise))")
+	}
+
+	if len(args) != 0 {
+		return nil, errors.New("string args are not allowed in (when) promises")
+	}
+
+	return WhenPromise{children[0], children[1]}, nil
+}
+
+func (p WhenPromise) Desc(arguments []Constant) string {
+	return "(when " + p.Condition.Desc(arguments) + " " + p.Promise.Desc(arguments) + ")"
+}
+
+func (p WhenPromise) Eval(arguments []Constant, ctx *Context, stack string) bool {
+	if evalCondition(p.Condition, arguments, ctx, stack) {
+		return p.Promise.Eval(arguments, ctx, stack)
+	}
+
+	return true
+}
+
+func evalCondition(condition Promise, arguments []Constant, ctx *Context, stack string) bool {
+	copyied_ctx := *ctx
+	copyied_ctx.Condition = true
+	return condition.Eval(arguments, &copyied_ctx, stack)
+}
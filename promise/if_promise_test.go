@@ -0,0 +1,67 @@
+package promise
+
+import (
+	"testing"
+
+	"github.com/denkhaus/llconf/logging"
+)
+
+func TestIfPromiseDesc(t *testing.T) {
+	promise := IfPromise{DummyPromise{"cond", true}, DummyPromise{"then", true}, DummyPromise{"else", true}}
+	equals(t, "(if (dummy [cond]) (dummy [then]) (dummy [else]))", promise.Desc([]Constant{}))
+}
+
+func TestIfPromiseEval(t *testing.T) {
+	var tests = []struct {
+		condition bool
+		then      bool
+		els       Promise
+		result    bool
+	}{
+		{true, true, DummyPromise{"else", false}, true},
+		{true, false, DummyPromise{"else", true}, false},
+		{false, false, DummyPromise{"else", true}, true},
+		{false, true, DummyPromise{"else", false}, false},
+		{false, false, nil, true},
+	}
+
+	for _, test := range tests {
+		promise := IfPromise{DummyPromise{"cond", test.condition}, DummyPromise{"then", test.then}, test.els}
+		equals(t, test.result, promise.Eval([]Constant{}, &Context{}, "if_promise"))
+	}
+}
+
+func TestIfPromiseNew(t *testing.T) {
+	if _, err := (IfPromise{}).New([]Promise{DummyPromise{}}, []Argument{}); err == nil {
+		t.Errorf("(if) TestNew: expected exception for missing branch")
+	}
+
+	p, err := (IfPromise{}).New([]Promise{DummyPromise{}, DummyPromise{}}, []Argument{})
+	if err != nil {
+		t.Errorf("(if) TestNew: %s", err)
+	} else if p.(IfPromise).Else != nil {
+		t.Errorf("(if) TestNew: else branch should be empty")
+	}
+}
+
+func TestWhenPromiseEval(t *testing.T) {
+	promise := WhenPromise{DummyPromise{"cond", false}, DummyPromise{"action", false}}
+	equals(t, true, promise.Eval([]Constant{}, &Context{}, "when_promise"))
+
+	promise = WhenPromise{DummyPromise{"cond", true}, DummyPromise{"action", false}}
+	equals(t, false, promise.Eval([]Constant{}, &Context{}, "when_promise"))
+}
+
+func TestConditionCounter(t *testing.T) {
+	defer logging.Logger.Reset()
+	logging.Logger.Reset()
+
+	cond := ExecPromise{Type: ExecTest, Arguments: []Argument{Constant("false")}}
+	promise := WhenPromise{cond, DummyPromise{"action", true}}
+
+	ctx := NewContext()
+	promise.Eval([]Constant{}, &ctx, "when_promise")
+
+	equals(t, 1, logging.Logger.Conditions)
+	equals(t, 0, logging.Logger.Tests)
+}
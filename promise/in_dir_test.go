@@ -22,7 +22,7 @@ func TestEval(t *testing.T) {
 	arguments := []Argument{
 		Constant("pwd"),
 	}
-	exec := ExecPromise{ExecTest, arguments}
+	exec := ExecPromise{Type: ExecTest, Arguments: arguments}
 
 	d := InDir{Constant("/var"), exec}
 
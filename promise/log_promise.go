@@ -35,18 +35,18 @@ func (p LogPromise) New(children []Promise, args []Argument) (Promise, error) {
 func (p LogPromise) Desc(arguments []Constant) string {
 	args := make([]string, len(p.Args))
 	for i, v := range p.Args {
-		args[i] = v.GetValue(arguments, &Variables{})
+		args[i] = descValue(v, arguments)
 	}
 
 	return "(info|error|warn " + strings.Join(args, " ") + ")"
 }
 
 func (p LogPromise) Eval(arguments []Constant, ctx *Context, stack string) bool {
-	fmtString := p.Args[0].GetValue(arguments, &Variables{})
+	fmtString := p.Args[0].GetValue(arguments, &ctx.Vars)
 
 	args := make([]interface{}, len(p.Args)-1)
 	for i, v := range p.Args[1:] {
-		args[i] = v.GetValue(arguments, &Variables{})
+		args[i] = v.GetValue(arguments, &ctx.Vars)
 	}
 
 	switch p.Type {
@@ -6,6 +6,7 @@ type NamedPromise struct {
 	Name      string
 	Promise   Promise
 	Arguments []Argument
+	Params    []Param
 }
 
 type NewNotSupported string
@@ -32,11 +33,18 @@ func (p NamedPromise) Desc(arguments []Constant) string {
 }
 
 func (p NamedPromise) Eval(arguments []Constant, ctx *Context, stack string) bool {
+	defer annotateEvalError(stack + "->" + p.Name)
+	checkCanceled(ctx)
+
 	parsed_arguments := []Constant{}
 	for _, argument := range p.Arguments {
 		parsed_arguments = append(parsed_arguments, Constant(argument.GetValue(arguments, &ctx.Vars)))
 	}
 
+	for i := len(parsed_arguments); i < len(p.Params); i++ {
+		parsed_arguments = append(parsed_arguments, Constant(p.Params[i].Default))
+	}
+
 	copyied_vars := Variables{}
 	for k, v := range ctx.Vars {
 		copyied_vars[k] = v
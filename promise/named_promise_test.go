@@ -3,12 +3,12 @@ package promise
 import "testing"
 
 func TestNamedPromiseDesc(t *testing.T) {
-	promise := NamedPromise{"test", DummyPromise{"Hello", true}, []Argument{}}
+	promise := NamedPromise{Name: "test", Promise: DummyPromise{"Hello", true}, Arguments: []Argument{}}
 	equals(t, promise.Desc([]Constant{}), "(test (dummy [Hello]))")
 }
 
 func TestNamedPromiseEval(t *testing.T) {
-	promise := NamedPromise{"test", DummyPromise{"Hello", true}, []Argument{}}
+	promise := NamedPromise{Name: "test", Promise: DummyPromise{"Hello", true}, Arguments: []Argument{}}
 	result := promise.Eval([]Constant{}, &Context{}, "namedpromise")
 	equals(t, result, true)
 }
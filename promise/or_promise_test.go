@@ -15,7 +15,7 @@ func TestOrPromiseEvalAllTrue(t *testing.T) {
 	promise := OrPromise{[]Promise{}}
 
 	for i := 0; i < 10; i++ {
-		promise.Promises = append(promise.Promises, DummyPromise{"n:" + string(1), true})
+		promise.Promises = append(promise.Promises, DummyPromise{"n:1", true})
 	}
 
 	result := promise.Eval([]Constant{}, &Context{}, "or_promise")
@@ -27,7 +27,7 @@ func TestOrPromiseEvalSomeFalse(t *testing.T) {
 	promise.Promises = append(promise.Promises, DummyPromise{"n:0", false})
 
 	for i := 1; i < 10; i++ {
-		promise.Promises = append(promise.Promises, DummyPromise{"n:" + string(1), true})
+		promise.Promises = append(promise.Promises, DummyPromise{"n:1", true})
 	}
 
 	result := promise.Eval([]Constant{}, &Context{}, "or_promise")
@@ -38,7 +38,7 @@ func TestOrPromiseEvalAllFalse(t *testing.T) {
 	promise := OrPromise{[]Promise{}}
 
 	for i := 0; i < 10; i++ {
-		promise.Promises = append(promise.Promises, DummyPromise{"n:" + string(1), false})
+		promise.Promises = append(promise.Promises, DummyPromise{"n:1", false})
 	}
 
 	result := promise.Eval([]Constant{}, &Context{}, "or_promise")
@@ -0,0 +1,98 @@
+package promise
+
+import (
+	"bytes"
+	"io"
+	"sync"
+
+	"github.com/denkhaus/llconf/logging"
+)
+
+////////////////////////////////////////////////////////////////////////////////
+// outputStream is the destination lines of a command are streamed to.
+// Streaming is best effort: after the first failed write the stream
+// is dropped, the exec buffers and the exit status stay authoritative.
+type outputStream struct {
+	mu  sync.Mutex
+	out io.Writer
+}
+
+func (s *outputStream) writeLine(line []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.out == nil {
+		return
+	}
+
+	if _, err := s.out.Write(line); err != nil {
+		logging.Logger.Warnf("stop streaming command output: %s", err)
+		s.out = nil
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// lineWriter writes every complete line written to it to stream,
+// prefixed with prefix. Writers of stdout and stderr share stream, so
+// their lines are not interleaved.
+type lineWriter struct {
+	stream *outputStream
+	prefix string
+	buf    []byte
+}
+
+func (w *lineWriter) Write(p []byte) (int, error) {
+	w.buf = append(w.buf, p...)
+
+	for {
+		i := bytes.IndexByte(w.buf, '\n')
+		if i < 0 {
+			break
+		}
+
+		w.writeLine(w.buf[:i+1])
+		w.buf = w.buf[i+1:]
+	}
+
+	return len(p), nil
+}
+
+// Flush writes a trailing incomplete line.
+func (w *lineWriter) Flush() {
+	if len(w.buf) == 0 {
+		return
+	}
+
+	line := append(w.buf, '\n')
+	w.buf = nil
+	w.writeLine(line)
+}
+
+func (w *lineWriter) writeLine(line []byte) {
+	w.stream.writeLine(append([]byte(w.prefix), line...))
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// outputStreams returns the writers the stdout and stderr of a command
+// evaluated in stack are written to. Besides the exec buffers of ctx,
+// every line is streamed to ctx.Output if it is set and report is true.
+// flush has to be called after the command exited.
+func outputStreams(ctx *Context, stack string, report bool) (stdout io.Writer, stderr io.Writer, flush func()) {
+	ctx.ExecStdout.Reset()
+	ctx.ExecStderr.Reset()
+
+	if ctx.Output == nil || !report {
+		return ctx.ExecStdout, ctx.ExecStderr, func() {}
+	}
+
+	stream := &outputStream{out: ctx.Output}
+	out := &lineWriter{stream: stream, prefix: stack + " stdout: "}
+	err := &lineWriter{stream: stream, prefix: stack + " stderr: "}
+
+	flush = func() {
+		out.Flush()
+		err.Flush()
+	}
+
+	return io.MultiWriter(ctx.ExecStdout, out), io.MultiWriter(ctx.ExecStderr, err), flush
+}
@@ -0,0 +1,78 @@
+package promise
+
+import (
+	"strconv"
+
+	"github.com/juju/errors"
+)
+
+// Param is a declared parameter of a named promise.
+type Param struct {
+	Name       string
+	Default    string
+	HasDefault bool
+}
+
+// ParamGetter returns the value of a declared parameter. The parameter
+// is bound to its argument position at compile time by BindParams.
+type ParamGetter struct {
+	Name     string
+	Position int
+}
+
+func (p ParamGetter) GetValue(arguments []Constant, vars *Variables) string {
+	if p.Position < 0 || len(arguments) <= p.Position {
+		return ""
+	}
+	return string(arguments[p.Position])
+}
+
+func (p ParamGetter) String() string {
+	return "param->" + p.Name + "(" + strconv.Itoa(p.Position) + ")"
+}
+
+// BindParams resolves all parameter getters in arg
+// to the positions of the declared params.
+func BindParams(arg Argument, params []Param) (Argument, error) {
+	switch a := arg.(type) {
+	case ParamGetter:
+		for i, param := range params {
+			if param.Name == a.Name {
+				return ParamGetter{Name: a.Name, Position: i}, nil
+			}
+		}
+		return nil, errors.Errorf("unknown parameter %q", a.Name)
+	case JoinArgument:
+		args, err := bindParamsAll(a.Args, params)
+		if err != nil {
+			return nil, err
+		}
+		return JoinArgument{Args: args}, nil
+	case StringGetter:
+		args, err := bindParamsAll(a.Args, params)
+		if err != nil {
+			return nil, err
+		}
+		return StringGetter{Name: a.Name, Args: args}, nil
+	case DefaultGetter:
+		args, err := bindParamsAll([]Argument{a.Value, a.Fallback}, params)
+		if err != nil {
+			return nil, err
+		}
+		return DefaultGetter{Value: args[0], Fallback: args[1]}, nil
+	default:
+		return arg, nil
+	}
+}
+
+func bindParamsAll(args []Argument, params []Param) ([]Argument, error) {
+	bound := []Argument{}
+	for _, v := range args {
+		b, err := BindParams(v, params)
+		if err != nil {
+			return nil, err
+		}
+		bound = append(bound, b)
+	}
+	return bound, nil
+}
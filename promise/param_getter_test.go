@@ -0,0 +1,53 @@
+package promise
+
+import (
+	"testing"
+)
+
+func TestBindParams(t *testing.T) {
+	params := []Param{{Name: "name"}, {Name: "port", Default: "80", HasDefault: true}}
+
+	arg, err := BindParams(JoinArgument{[]Argument{ParamGetter{"name", -1}, Constant(":"),
+		ParamGetter{"port", -1}}}, params)
+	if err != nil {
+		t.Fatalf("BindParams: %s", err)
+	}
+
+	result := arg.GetValue([]Constant{Constant("localhost"), Constant("8080")}, &Variables{})
+	equals(t, "localhost:8080", result)
+
+	if _, err := BindParams(ParamGetter{"unknown", -1}, params); err == nil {
+		t.Errorf("BindParams: expected exception for unknown parameter")
+	}
+}
+
+func TestNamedPromiseParamDefaults(t *testing.T) {
+	setvar := SetvarPromise{Constant("port"), ParamGetter{"port", 1}}
+	promise := NamedPromise{
+		Name:      "site",
+		Promise:   ReadParamPromise{setvar},
+		Arguments: []Argument{Constant("example.com")},
+		Params:    []Param{{Name: "name"}, {Name: "port", Default: "80", HasDefault: true}},
+	}
+
+	ctx := NewContext()
+	equals(t, true, promise.Eval([]Constant{}, &ctx, "params"))
+}
+
+// ReadParamPromise checks the variable set by its child against the default.
+type ReadParamPromise struct {
+	Child Promise
+}
+
+func (p ReadParamPromise) New(children []Promise, args []Argument) (Promise, error) {
+	return p, nil
+}
+
+func (p ReadParamPromise) Desc(arguments []Constant) string {
+	return "(readparam)"
+}
+
+func (p ReadParamPromise) Eval(arguments []Constant, ctx *Context, stack string) bool {
+	p.Child.Eval(arguments, ctx, stack)
+	return ctx.Vars["port"] == "80"
+}
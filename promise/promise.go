@@ -2,7 +2,10 @@ package promise
 
 import (
 	"bytes"
+	"io"
 	"syscall"
+
+	"github.com/denkhaus/llconf/logging"
 )
 
 type compileFunc func(folders ...string) (map[string]Promise, error)
@@ -22,17 +25,41 @@ type Context struct {
 	Compile    compileFunc
 	ExecStdout *bytes.Buffer
 	ExecStderr *bytes.Buffer
+	// Output receives the stdout and stderr lines of commands
+	// while they run, prefixed with the promise stack
+	Output     io.Writer
 	Credential *syscall.Credential
 	Vars       Variables
 	Args       []string
 	Env        []string
 	InDir      string
 	Verbose    bool
+	// Condition is set while evaluating the condition of (if) and (when)
+	Condition bool
+	// ReadOnly skips all promises changing the system
+	ReadOnly bool
+	// Cancel is closed to abort the evaluation at the next
+	// promise boundary and kill the running commands
+	Cancel <-chan struct{}
 }
 
 func NewContext() Context {
 	return Context{
-		Vars:  make(map[string]string),
-		InDir: "",
+		ExecStdout: &bytes.Buffer{},
+		ExecStderr: &bytes.Buffer{},
+		Vars:       make(map[string]string),
+		InDir:      "",
 	}
 }
+
+// skipReadOnly reports whether a promise changing the system
+// has to be skipped, because ctx is read-only.
+func skipReadOnly(ctx *Context, stack string, desc string) bool {
+	if !ctx.ReadOnly {
+		return false
+	}
+
+	logging.Logger.Info(stack)
+	logging.Logger.Infof("[read-only] skipped %s", desc)
+	return true
+}
@@ -11,7 +11,7 @@ func TestReadvarPromise(t *testing.T) {
 		Constant("Hello World"),
 	}
 
-	exec := ExecPromise{ExecTest, arguments}
+	exec := ExecPromise{Type: ExecTest, Arguments: arguments}
 	promise := ReadvarPromise{Constant("test"), exec}
 
 	var sout bytes.Buffer
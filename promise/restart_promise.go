@@ -35,6 +35,10 @@ func (p RestartPromise) Desc(arguments []Constant) string {
 }
 
 func (p RestartPromise) Eval(arguments []Constant, ctx *Context, stack string) bool {
+	if skipReadOnly(ctx, stack, p.Desc(arguments)) {
+		return true
+	}
+
 	var newExe string
 	if len(p.Args) == 1 {
 		newExe = p.Args[0].GetValue(arguments, &ctx.Vars)
@@ -1,14 +1,21 @@
 package promise
 
 import (
-	"bytes"
 	"testing"
 )
 
-func TestRestartPromise(t *testing.T) {
+func TestRestartPromiseNew(t *testing.T) {
 	promise := RestartPromise{}
-	var sout, serr bytes.Buffer
-	cmd, _ := promise.restartLLConf("/bin/echo", []string{"-n", "hello world"}, &sout, &serr)
-	cmd.Wait()
-	equals(t, "hello world", sout.String())
+
+	if _, err := promise.New([]Promise{}, []Argument{Constant("/bin/llconf")}); err != nil {
+		t.Errorf("(restart) TestNew: %s", err)
+	}
+
+	if _, err := promise.New([]Promise{}, []Argument{Constant("a"), Constant("b")}); err == nil {
+		t.Errorf("(restart) TestNew: expected exception for 2 arguments")
+	}
+
+	if _, err := promise.New([]Promise{DummyPromise{}}, []Argument{}); err == nil {
+		t.Errorf("(restart) TestNew: expected exception for nested promise")
+	}
 }
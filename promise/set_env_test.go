@@ -29,7 +29,7 @@ func TestSetNewEval(t *testing.T) {
 		Constant("-c"),
 		Constant("echo $setenv"),
 	}
-	exec := ExecPromise{ExecTest, arguments}
+	exec := ExecPromise{Type: ExecTest, Arguments: arguments}
 
 	var sout bytes.Buffer
 	ctx := NewContext()
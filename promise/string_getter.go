@@ -0,0 +1,150 @@
+package promise
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/juju/errors"
+)
+
+type stringFunc struct {
+	MinArgs int
+	MaxArgs int // -1 for any number of arguments
+	Apply   func(args []string) string
+}
+
+var stringFuncs = map[string]stringFunc{
+	"upper": {1, 1, func(args []string) string {
+		return strings.ToUpper(args[0])
+	}},
+	"lower": {1, 1, func(args []string) string {
+		return strings.ToLower(args[0])
+	}},
+	"trim": {1, 2, func(args []string) string {
+		if len(args) == 2 {
+			return strings.Trim(args[0], args[1])
+		}
+		return strings.TrimSpace(args[0])
+	}},
+	"replace": {3, 3, func(args []string) string {
+		return strings.Replace(args[0], args[1], args[2], -1)
+	}},
+	"split": {3, 3, func(args []string) string {
+		idx, err := strconv.Atoi(args[2])
+		if err != nil {
+			raiseEvalError("[split] index %q is no number", args[2])
+		}
+
+		parts := strings.Split(args[0], args[1])
+		if idx < 0 {
+			idx += len(parts)
+		}
+		if idx < 0 || len(parts) <= idx {
+			return ""
+		}
+		return parts[idx]
+	}},
+	"sha256": {1, 1, func(args []string) string {
+		sum := sha256.Sum256([]byte(args[0]))
+		return hex.EncodeToString(sum[:])
+	}},
+	"base64": {1, 1, func(args []string) string {
+		return base64.StdEncoding.EncodeToString([]byte(args[0]))
+	}},
+	"path-join": {1, -1, func(args []string) string {
+		return filepath.Join(args...)
+	}},
+}
+
+// IsStringGetter reports whether name is the type of a string getter.
+func IsStringGetter(name string) bool {
+	_, ok := stringFuncs[name]
+	return ok
+}
+
+// StringGetter applies the string function Name
+// to the values of its arguments.
+type StringGetter struct {
+	Name string
+	Args []Argument
+}
+
+func NewStringGetter(name string, args []Argument) (Argument, error) {
+	fn, ok := stringFuncs[name]
+	if !ok {
+		return nil, errors.Errorf("unknown string getter %q", name)
+	}
+
+	if len(args) < fn.MinArgs || (fn.MaxArgs >= 0 && len(args) > fn.MaxArgs) {
+		return nil, errors.Errorf("[%s] called with %d arguments", name, len(args))
+	}
+
+	if name == "split" {
+		if idx, ok := args[2].(Constant); ok {
+			if _, err := strconv.Atoi(string(idx)); err != nil {
+				return nil, errors.Errorf("[split] index %q is no number", string(idx))
+			}
+		}
+	}
+
+	return StringGetter{Name: name, Args: args}, nil
+}
+
+func (p StringGetter) GetValue(arguments []Constant, vars *Variables) string {
+	values := []string{}
+	for _, arg := range p.Args {
+		values = append(values, arg.GetValue(arguments, vars))
+	}
+
+	return stringFuncs[p.Name].Apply(values)
+}
+
+func (p StringGetter) String() string {
+	args := []string{}
+	for _, arg := range p.Args {
+		args = append(args, arg.String())
+	}
+	return p.Name + "-> " + strings.Join(args, ", ")
+}
+
+// DefaultGetter returns the value of Value, or Fallback if Value
+// is an undefined variable, a missing argument or empty.
+type DefaultGetter struct {
+	Value    Argument
+	Fallback Argument
+}
+
+func NewDefaultGetter(args []Argument) (Argument, error) {
+	if len(args) != 2 {
+		return nil, errors.Errorf("[default] called with %d arguments", len(args))
+	}
+
+	return DefaultGetter{Value: args[0], Fallback: args[1]}, nil
+}
+
+func (p DefaultGetter) GetValue(arguments []Constant, vars *Variables) string {
+	switch v := p.Value.(type) {
+	case VarGetter:
+		if _, present := (*vars)[v.Name]; !present {
+			return p.Fallback.GetValue(arguments, vars)
+		}
+	case ArgGetter:
+		if len(arguments) <= v.Position {
+			return p.Fallback.GetValue(arguments, vars)
+		}
+	}
+
+	if value := p.Value.GetValue(arguments, vars); value != "" {
+		return value
+	}
+
+	return p.Fallback.GetValue(arguments, vars)
+}
+
+func (p DefaultGetter) String() string {
+	return "default-> " + p.Value.String() + " | " + p.Fallback.String()
+}
@@ -0,0 +1,56 @@
+package promise
+
+import (
+	"testing"
+)
+
+func TestStringGetter(t *testing.T) {
+	var tests = []struct {
+		name   string
+		args   []Argument
+		result string
+	}{
+		{"upper", []Argument{Constant("Hello")}, "HELLO"},
+		{"lower", []Argument{Constant("Hello")}, "hello"},
+		{"trim", []Argument{Constant("  hello\n")}, "hello"},
+		{"trim", []Argument{Constant("/srv/www/"), Constant("/")}, "srv/www"},
+		{"replace", []Argument{Constant("a-b-c"), Constant("-"), Constant(".")}, "a.b.c"},
+		{"split", []Argument{Constant("a,b,c"), Constant(","), Constant("1")}, "b"},
+		{"split", []Argument{Constant("a,b,c"), Constant(","), Constant("-1")}, "c"},
+		{"split", []Argument{Constant("a,b,c"), Constant(","), Constant("3")}, ""},
+		{"sha256", []Argument{Constant("hello")},
+			"2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824"},
+		{"base64", []Argument{Constant("hello")}, "aGVsbG8="},
+		{"path-join", []Argument{Constant("/srv"), VarGetter{Name: "site"}, Constant("index.html")},
+			"/srv/www/index.html"},
+	}
+
+	vars := Variables{"site": "www"}
+	for _, test := range tests {
+		getter, err := NewStringGetter(test.name, test.args)
+		if err != nil {
+			t.Errorf("[%s]: %s", test.name, err)
+			continue
+		}
+		equals(t, test.result, getter.GetValue([]Constant{}, &vars))
+	}
+}
+
+func TestStringGetterArity(t *testing.T) {
+	if _, err := NewStringGetter("upper", []Argument{}); err == nil {
+		t.Errorf("[upper]: expected exception for missing argument")
+	}
+
+	if _, err := NewStringGetter("split", []Argument{Constant("a"), Constant(","), Constant("x")}); err == nil {
+		t.Errorf("[split]: expected exception for invalid index")
+	}
+}
+
+func TestDefaultGetter(t *testing.T) {
+	vars := Variables{"set": "value", "empty": ""}
+
+	equals(t, "value", DefaultGetter{VarGetter{Name: "set"}, Constant("fallback")}.GetValue([]Constant{}, &vars))
+	equals(t, "fallback", DefaultGetter{VarGetter{Name: "empty"}, Constant("fallback")}.GetValue([]Constant{}, &vars))
+	equals(t, "fallback", DefaultGetter{VarGetter{Name: "unset"}, Constant("fallback")}.GetValue([]Constant{}, &vars))
+	equals(t, "fallback", DefaultGetter{ArgGetter{0}, Constant("fallback")}.GetValue([]Constant{}, &vars))
+}
@@ -4,7 +4,9 @@ import (
 	"bufio"
 	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"os"
+	"path/filepath"
 	"strings"
 	"text/template"
 
@@ -12,6 +14,14 @@ import (
 	"github.com/juju/errors"
 )
 
+// SourceDirVar holds the folder a source bundle is staged in. Relative
+// template files are looked up in this folder if it is set.
+const SourceDirVar = "source_dir"
+
+// BundleDirVar holds the folder the files attached to a promise tree
+// are staged in. Relative template files are looked up there first.
+const BundleDirVar = "bundle_dir"
+
 type TemplatePromise struct {
 	JsonInput    Argument
 	TemplateFile Argument
@@ -37,6 +47,7 @@ func (t TemplatePromise) Eval(arguments []Constant, ctx *Context, stack string)
 	replacer := strings.NewReplacer("'", "\"")
 	json_input := replacer.Replace(t.JsonInput.GetValue(arguments, &ctx.Vars))
 	template_file := t.TemplateFile.GetValue(arguments, &ctx.Vars)
+	template_file = resolveFile(template_file, ctx.Vars)
 	output := t.Output.GetValue(arguments, &ctx.Vars)
 
 	var input interface{}
@@ -45,12 +56,26 @@ func (t TemplatePromise) Eval(arguments []Constant, ctx *Context, stack string)
 		return false
 	}
 
+	if data, ok := input.(map[string]interface{}); ok {
+		if _, present := data["facts"]; !present {
+			data["facts"] = GetFacts(ctx.Vars).Tree()
+		}
+	}
+
 	tmpl, err := template.ParseFiles(template_file)
 	if err != nil {
 		logging.Logger.Error(errors.Annotate(err, "parse files"))
 		return false
 	}
 
+	if ctx.ReadOnly {
+		if err := tmpl.Execute(ioutil.Discard, input); err != nil {
+			logging.Logger.Error(errors.Annotate(err, "exec template"))
+			return false
+		}
+		return skipReadOnly(ctx, stack, "writing template output "+output)
+	}
+
 	fo, err := os.Create(output)
 	if err != nil {
 		logging.Logger.Error(errors.Annotate(err, "create output file"))
@@ -67,3 +92,24 @@ func (t TemplatePromise) Eval(arguments []Constant, ctx *Context, stack string)
 	bfo.Flush()
 	return true
 }
+
+// resolveFile returns the path of the relative file in the bundle
+// folder if it was attached, else in the source folder if one is set.
+func resolveFile(file string, vars Variables) string {
+	if filepath.IsAbs(file) {
+		return file
+	}
+
+	if dir, ok := vars[BundleDirVar]; ok {
+		path := filepath.Join(dir, file)
+		if _, err := os.Stat(path); err == nil {
+			return path
+		}
+	}
+
+	if dir, ok := vars[SourceDirVar]; ok {
+		return filepath.Join(dir, file)
+	}
+
+	return file
+}
@@ -2,18 +2,25 @@ package promise
 
 type Variables map[string]string
 
+// VarGetter returns the value of a variable. Reading an undefined
+// variable is an evaluation error unless the getter is Optional.
 type VarGetter struct {
-	Name string
+	Name     string
+	Optional bool
 }
 
 func (getter VarGetter) String() string {
+	if getter.Optional {
+		return "[var?:" + getter.Name + "]"
+	}
 	return "[var:" + getter.Name + "]"
 }
 
 func (getter VarGetter) GetValue(arguments []Constant, vars *Variables) string {
 	if v, present := (*vars)[getter.Name]; present {
 		return v
-	} else {
-		return "missing"
+	} else if !getter.Optional {
+		raiseEvalError("undefined variable %q", getter.Name)
 	}
+	return ""
 }
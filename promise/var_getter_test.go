@@ -0,0 +1,61 @@
+package promise
+
+import (
+	"strings"
+	"testing"
+)
+
+func evalError(f func()) (err *EvalError) {
+	defer func() {
+		if e := recover(); e != nil {
+			err = e.(*EvalError)
+		}
+	}()
+
+	f()
+	return nil
+}
+
+func TestVarGetterUndefined(t *testing.T) {
+	vars := Variables{"name": "value"}
+
+	equals(t, "value", VarGetter{Name: "name"}.GetValue([]Constant{}, &vars))
+	equals(t, "", VarGetter{Name: "other", Optional: true}.GetValue([]Constant{}, &vars))
+	equals(t, "[var?:other]", VarGetter{Name: "other", Optional: true}.String())
+
+	err := evalError(func() { VarGetter{Name: "other"}.GetValue([]Constant{}, &vars) })
+	if err == nil {
+		t.Fatalf("undefined variable: expected eval error")
+	}
+	equals(t, `undefined variable "other"`, err.Error())
+}
+
+func TestArgGetterOutOfRange(t *testing.T) {
+	equals(t, "a", ArgGetter{0}.GetValue([]Constant{"a"}, &Variables{}))
+
+	if err := evalError(func() { ArgGetter{1}.GetValue([]Constant{"a"}, &Variables{}) }); err == nil {
+		t.Errorf("argument out of range: expected eval error")
+	}
+}
+
+func TestEvalErrorStack(t *testing.T) {
+	inner := NamedPromise{Name: "inner", Promise: ExecPromise{Type: ExecTest,
+		Arguments: []Argument{Constant("echo"), VarGetter{Name: "undefined"}}}}
+	outer := NamedPromise{Name: "outer", Promise: inner}
+
+	ctx := NewContext()
+	err := evalError(func() { outer.Eval([]Constant{}, &ctx, "") })
+	if err == nil {
+		t.Fatalf("undefined variable: expected eval error")
+	}
+
+	equals(t, "->outer->inner", err.Stack)
+	if !strings.Contains(err.Error(), `undefined variable "undefined"`) {
+		t.Errorf("unexpected error %q", err.Error())
+	}
+
+	desc := inner.Promise.Desc([]Constant{})
+	if !strings.Contains(desc, "[var:undefined]") {
+		t.Errorf("unexpected description %q", desc)
+	}
+}
@@ -0,0 +1,170 @@
+package promise
+
+////////////////////////////////////////////////////////////////////////////////
+// BuiltinName returns the name p is written as in promise files,
+// or "" for named promises.
+func BuiltinName(p Promise) string {
+	switch t := p.(type) {
+	case AndPromise:
+		return "and"
+	case OrPromise:
+		return "or"
+	case NotPromise:
+		return "not"
+	case IfPromise:
+		return "if"
+	case WhenPromise:
+		return "when"
+	case ForeachPromise:
+		return "foreach"
+	case ExecPromise:
+		return t.Type.Name()
+	case InDir:
+		return "indir"
+	case SetEnv:
+		return "setenv"
+	case PipePromise:
+		return "pipe"
+	case SPipePromise:
+		return "spipe"
+	case SetvarPromise:
+		return "setvar"
+	case ReadvarPromise:
+		return "readvar"
+	case TemplatePromise:
+		return "template"
+	case RestartPromise:
+		return "restart"
+	case TruePromise:
+		return "true"
+	case FalsePromise:
+		return "false"
+	case EvalPromise:
+		return "eval"
+	case AsUser:
+		return "asuser"
+	case LogPromise:
+		switch t.Type {
+		case LogTypeError:
+			return "error"
+		case LogTypeWarning:
+			return "warn"
+		default:
+			return "info"
+		}
+	}
+
+	return ""
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// Children returns the promises nested in p.
+func Children(p Promise) []Promise {
+	children := []Promise{}
+
+	switch t := p.(type) {
+	case AndPromise:
+		children = append(children, t.Promises...)
+	case OrPromise:
+		children = append(children, t.Promises...)
+	case NotPromise:
+		children = append(children, t.Promise)
+	case TruePromise:
+		children = append(children, t.Promise)
+	case FalsePromise:
+		children = append(children, t.Promise)
+	case IfPromise:
+		children = append(children, t.Condition, t.Then, t.Else)
+	case WhenPromise:
+		children = append(children, t.Condition, t.Promise)
+	case ForeachPromise:
+		children = append(children, t.Promise)
+	case InDir:
+		children = append(children, t.Promise)
+	case SetEnv:
+		children = append(children, t.Child)
+	case ReadvarPromise:
+		children = append(children, t.Exec)
+	case AsUser:
+		children = append(children, t.Promise)
+	case NamedPromise:
+		children = append(children, t.Promise)
+	case PipePromise:
+		for _, e := range t.Execs {
+			children = append(children, e)
+		}
+	case SPipePromise:
+		for _, e := range t.Execs {
+			children = append(children, e)
+		}
+	}
+
+	nested := children[:0]
+	for _, c := range children {
+		if c != nil {
+			nested = append(nested, c)
+		}
+	}
+
+	return nested
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// Arguments returns the string arguments of p in the order
+// they are passed to New.
+func Arguments(p Promise) []Argument {
+	args := []Argument{}
+
+	switch t := p.(type) {
+	case ExecPromise:
+		args = append(args, t.Arguments...)
+	case LogPromise:
+		args = append(args, t.Args...)
+	case RestartPromise:
+		args = append(args, t.Args...)
+	case NamedPromise:
+		args = append(args, t.Arguments...)
+	case ForeachPromise:
+		args = append(args, t.VarName, t.List, t.Mode)
+	case InDir:
+		args = append(args, t.Dir)
+	case AsUser:
+		args = append(args, t.UserName)
+	case SetEnv:
+		args = append(args, t.Name, t.Value)
+	case SetvarPromise:
+		args = append(args, t.Name, t.Value)
+	case ReadvarPromise:
+		args = append(args, t.VarName)
+	case TemplatePromise:
+		args = append(args, t.JsonInput, t.TemplateFile, t.Output)
+	case EvalPromise:
+		args = append(args, t.RootPromise, t.InputPath)
+	}
+
+	present := args[:0]
+	for _, a := range args {
+		if a != nil {
+			present = append(present, a)
+		}
+	}
+
+	return present
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// Walk calls fn for p and all promises nested in p, depth first.
+// It stops at the first error returned by fn.
+func Walk(p Promise, fn func(Promise) error) error {
+	if err := fn(p); err != nil {
+		return err
+	}
+
+	for _, c := range Children(p) {
+		if err := Walk(c, fn); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
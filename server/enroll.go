@@ -0,0 +1,217 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/denkhaus/goagain"
+	"github.com/denkhaus/llconf/logging"
+	"github.com/juju/errors"
+)
+
+const (
+	enrollTimeout = 30 * time.Second
+	enrollDelay   = 1 * time.Second
+)
+
+// MinEnrollTokenLength is the minimum length of enrollment tokens. Proofs
+// allow to guess the token offline, so it needs 128 bits of entropy,
+// eg. 32 hex digits.
+const MinEnrollTokenLength = 32
+
+//////////////////////////////////////////////////////////////////////////////////
+// EnrollRequest is sent by the client right after the handshake and
+// proves the client knows the enrollment token.
+type EnrollRequest struct {
+	ID    string
+	Proof []byte
+}
+
+//////////////////////////////////////////////////////////////////////////////////
+// EnrollResponse proves the server knows the enrollment token, if
+// the request has been accepted. Denied clients get no proof.
+type EnrollResponse struct {
+	Status string
+	Error  string
+	ID     string
+	Proof  []byte
+}
+
+//////////////////////////////////////////////////////////////////////////////////
+// CheckEnrollToken returns an error if token is too short to be used.
+func CheckEnrollToken(token string) error {
+	if len(token) < MinEnrollTokenLength {
+		return errors.Errorf("enrollment token needs at least %d characters, eg. from \"openssl rand -hex 16\"",
+			MinEnrollTokenLength)
+	}
+
+	return nil
+}
+
+//////////////////////////////////////////////////////////////////////////////////
+// EnrollProof binds token to the certificates of both sides of an
+// enrollment connection, so the token itself never crosses the wire.
+func EnrollProof(token, role string, ownCert, peerCert []byte) []byte {
+	mac := hmac.New(sha256.New, []byte(token))
+	mac.Write([]byte(role))
+	mac.Write(ownCert)
+	mac.Write(peerCert)
+	return mac.Sum(nil)
+}
+
+//////////////////////////////////////////////////////////////////////////////////
+// RunEnrollment accepts enrollments on a separate listener, that only
+// exchanges certificates, until the token is used or expires.
+func (p *Server) RunEnrollment(hostPort string, cert *tls.Certificate, token string, ttl time.Duration) error {
+	if err := CheckEnrollToken(token); err != nil {
+		return err
+	}
+
+	entry, err := p.dataStore.AddToken(token, time.Now().Add(ttl))
+	if err != nil {
+		return errors.Annotate(err, "add token")
+	}
+
+	if err := p.dataStore.CheckToken(token); err != nil {
+		logging.Logger.Warnf("enrollment disabled: %s", err)
+		return nil
+	}
+	p.enrolling = true
+
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return errors.Annotate(err, "parse server certificate")
+	}
+
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{*cert},
+		// the client certificate is trusted after the token is proven
+		ClientAuth: tls.RequireAnyClientCert,
+		MinVersion: tls.VersionTLS12,
+	}
+
+	ln, err := tls.Listen("tcp", hostPort, tlsConfig)
+	if err != nil {
+		return errors.Annotate(err, "listen")
+	}
+
+	var once sync.Once
+	closeListener := func() {
+		once.Do(func() { ln.Close() })
+	}
+
+	timer := time.AfterFunc(entry.Expires.Sub(time.Now()), func() {
+		logging.Logger.Info("enrollment token expired")
+		closeListener()
+	})
+
+	logging.Logger.Infof("enrollment listening on %s until %s", hostPort,
+		entry.Expires.Format(time.RFC3339))
+
+	p.tomb.Go(func() error {
+		<-p.tomb.Dying()
+		closeListener()
+		return nil
+	})
+
+	p.tomb.Go(func() error {
+		defer timer.Stop()
+		defer closeListener()
+
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				if netErr, ok := err.(net.Error); ok && netErr.Temporary() {
+					continue
+				}
+				if goagain.IsErrClosing(err) {
+					return nil
+				}
+				return errors.Annotate(err, "enrollment accept")
+			}
+
+			if err := p.enroll(c.(*tls.Conn), leaf, token); err != nil {
+				logging.Logger.Warnf("enrollment from %s failed: %s", c.RemoteAddr(), err)
+				time.Sleep(enrollDelay)
+				continue
+			}
+
+			logging.Logger.Info("enrollment token used, close enrollment")
+			return nil
+		}
+	})
+
+	return nil
+}
+
+//////////////////////////////////////////////////////////////////////////////////
+func (p *Server) enroll(conn *tls.Conn, leaf *x509.Certificate, token string) error {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(enrollTimeout))
+
+	if err := conn.Handshake(); err != nil {
+		return errors.Annotate(err, "handshake")
+	}
+
+	peer := conn.ConnectionState().PeerCertificates[0]
+
+	enc := json.NewEncoder(conn)
+	dec := json.NewDecoder(conn)
+
+	req := EnrollRequest{}
+	if err := dec.Decode(&req); err != nil {
+		return errors.Annotate(err, "receive request")
+	}
+
+	// the server proves the token only to clients that proved it
+	res := EnrollResponse{Status: "enrollment successfull"}
+	err := p.acceptEnrollment(req, peer, leaf, token)
+	if err != nil {
+		res.Status = "enrollment denied"
+		res.Error = err.Error()
+	} else {
+		res.ID = leaf.Subject.CommonName
+		res.Proof = EnrollProof(token, "server", leaf.Raw, peer.Raw)
+	}
+
+	if err := enc.Encode(&res); err != nil {
+		return errors.Annotate(err, "send response")
+	}
+
+	return err
+}
+
+//////////////////////////////////////////////////////////////////////////////////
+func (p *Server) acceptEnrollment(req EnrollRequest, peer, leaf *x509.Certificate, token string) error {
+	if !hmac.Equal(req.Proof, EnrollProof(token, "client", peer.Raw, leaf.Raw)) {
+		return errors.New("invalid token")
+	}
+
+	if err := p.dataStore.CheckToken(token); err != nil {
+		return errors.Annotate(err, "check token")
+	}
+
+	id := req.ID
+	if id == "" {
+		id = peer.Subject.CommonName
+	}
+
+	data := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: peer.Raw})
+	if err := p.dataStore.StoreCertData(id, data); err != nil {
+		return errors.Annotate(err, "store client cert")
+	}
+
+	if err := p.dataStore.UseToken(token); err != nil {
+		return errors.Annotate(err, "use token")
+	}
+
+	logging.Logger.Infof("client certificate for id %q enrolled", id)
+	return nil
+}
@@ -0,0 +1,114 @@
+package server
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/denkhaus/llconf/ca"
+	"github.com/denkhaus/llconf/store"
+)
+
+// testCert returns a key pair for role signed by a.
+func testCert(t *testing.T, a *ca.Authority, role, commonName string) tls.Certificate {
+	certPEM, keyPEM, err := a.Sign(ca.Request{Role: role, CommonName: commonName, Validity: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return cert
+}
+
+func freeAddr(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	return ln.Addr().String()
+}
+
+func TestRunEnrollmentShortToken(t *testing.T) {
+	srv := New("127.0.0.1", 0, nil, nil, true, "test")
+	if err := srv.RunEnrollment("127.0.0.1:0", nil, "8f3c9e", time.Hour); err == nil {
+		t.Error("short enrollment token accepted")
+	}
+}
+
+func TestEnrollClientProvesFirst(t *testing.T) {
+	dir, err := ioutil.TempDir("", "llconf-enroll")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	a, err := ca.Init(dir, "test", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverCert := testCert(t, a, ca.RoleServer, "server")
+	clientCert := testCert(t, a, ca.RoleClient, "client")
+
+	ds, err := store.New("server", "client", dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ds.Close()
+
+	token := "0123456789abcdef0123456789abcdef"
+	addr := freeAddr(t)
+
+	srv := New("127.0.0.1", 0, ds, nil, true, "test")
+	if err := srv.RunEnrollment(addr, &serverCert, token, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	enroll := func(token string) EnrollResponse {
+		conn, err := tls.Dial("tcp", addr, &tls.Config{
+			Certificates:       []tls.Certificate{clientCert},
+			InsecureSkipVerify: true,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+
+		peer := conn.ConnectionState().PeerCertificates[0]
+		own := clientCert.Certificate[0]
+
+		req := EnrollRequest{ID: "client", Proof: EnrollProof(token, "client", own, peer.Raw)}
+		if err := json.NewEncoder(conn).Encode(&req); err != nil {
+			t.Fatal(err)
+		}
+
+		res := EnrollResponse{}
+		if err := json.NewDecoder(conn).Decode(&res); err != nil {
+			t.Fatal(err)
+		}
+
+		if res.Error == "" && !bytes.Equal(res.Proof, EnrollProof(token, "server", peer.Raw, own)) {
+			t.Error("invalid server proof")
+		}
+		return res
+	}
+
+	if res := enroll("fedcba9876543210fedcba9876543210"); res.Error == "" || len(res.Proof) > 0 {
+		t.Errorf("wrong token: expected denial without proof, got %+v", res)
+	}
+
+	if res := enroll(token); res.Error != "" {
+		t.Errorf("enrollment failed: %s", res.Error)
+	}
+}
@@ -0,0 +1,155 @@
+package server
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"os"
+	"os/user"
+	"syscall"
+
+	"github.com/denkhaus/llconf/logging"
+	"github.com/denkhaus/llconf/store"
+	"github.com/denkhaus/llconf/util"
+	"github.com/juju/errors"
+)
+
+//////////////////////////////////////////////////////////////////////////////////
+// listener accepts connections on one listen address. Connections to tcp
+// addresses are authenticated with tls, connections to unix sockets by
+// the file permissions of the socket.
+type listener struct {
+	addr   util.Address
+	raw    *util.TimeoutListener
+	accept net.Listener
+	// socket is the unix socket file created by the listener
+	socket os.FileInfo
+}
+
+// listen creates a listener for addr. If inherited is set,
+// it is used instead of binding addr again.
+func listen(addr util.Address, inherited net.Listener, tlsConfig *tls.Config) (*listener, error) {
+	l := &listener{addr: addr}
+
+	switch {
+	case inherited != nil:
+		l.raw = util.NewTimeoutListener(inherited)
+	case addr.Network == "unix":
+		if err := removeStaleSocket(addr.Addr); err != nil {
+			return nil, err
+		}
+
+		ln, err := net.ListenUnix("unix", &net.UnixAddr{Name: addr.Addr, Net: "unix"})
+		if err != nil {
+			return nil, errors.Annotate(err, "listen unix")
+		}
+		// the socket may have been replaced by a restarted process
+		// when this listener is closed, so it is removed explicitly
+		ln.SetUnlinkOnClose(false)
+
+		if err := os.Chmod(addr.Addr, 0660); err != nil {
+			ln.Close()
+			return nil, errors.Annotate(err, "chmod socket")
+		}
+
+		if l.socket, err = os.Stat(addr.Addr); err != nil {
+			ln.Close()
+			return nil, errors.Annotate(err, "stat socket")
+		}
+		l.raw = util.NewTimeoutListener(ln)
+	default:
+		laddr, err := net.ResolveTCPAddr("tcp", addr.Addr)
+		if err != nil {
+			return nil, errors.Annotate(err, "resolve tcp addr")
+		}
+
+		ln, err := net.ListenTCP("tcp", laddr)
+		if err != nil {
+			return nil, errors.Annotate(err, "listen tcp")
+		}
+		l.raw = util.NewTimeoutListener(ln)
+	}
+
+	l.accept = l.raw
+	if addr.Network == "tcp" {
+		l.accept = tls.NewListener(l.raw, tlsConfig)
+	}
+
+	return l, nil
+}
+
+// Close closes the listener and removes its unix socket,
+// unless it has been replaced in the meantime.
+func (l *listener) Close() error {
+	err := l.accept.Close()
+
+	if l.socket != nil {
+		if info, statErr := os.Stat(l.addr.Addr); statErr == nil && os.SameFile(info, l.socket) {
+			os.Remove(l.addr.Addr)
+		}
+	}
+
+	return err
+}
+
+// removeStaleSocket removes the socket file at path, if nobody listens on it.
+func removeStaleSocket(path string) error {
+	info, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return errors.Annotate(err, "stat socket")
+	}
+
+	if info.Mode()&os.ModeSocket == 0 {
+		return errors.Errorf("%q exists and is no socket", path)
+	}
+
+	if c, err := net.Dial("unix", path); err == nil {
+		c.Close()
+		return errors.Errorf("%q is in use", path)
+	}
+
+	logging.Logger.Infof("remove stale socket %q", path)
+	return os.Remove(path)
+}
+
+//////////////////////////////////////////////////////////////////////////////////
+// identifyUnix identifies the client of a unix socket connection by
+// the user of the connecting process. Everybody allowed to connect
+// to the socket has full access.
+func identifyUnix(c net.Conn) (*peer, error) {
+	uc, ok := c.(*net.UnixConn)
+	if !ok {
+		return nil, errors.New("no unix connection")
+	}
+
+	raw, err := uc.SyscallConn()
+	if err != nil {
+		return nil, errors.Annotate(err, "get raw connection")
+	}
+
+	var cred *syscall.Ucred
+	var credErr error
+	if err := raw.Control(func(fd uintptr) {
+		cred, credErr = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	}); err != nil {
+		return nil, errors.Annotate(err, "control")
+	}
+	if credErr != nil {
+		return nil, errors.Annotate(credErr, "get peer credentials")
+	}
+
+	name := fmt.Sprintf("%d", cred.Uid)
+	if u, err := user.LookupId(name); err == nil {
+		name = u.Username
+	}
+
+	return &peer{
+		ID:         "unix:" + name,
+		CommonName: name,
+		Addr:       fmt.Sprintf("%s (pid %d)", c.LocalAddr(), cred.Pid),
+		Policy:     store.Policy{},
+	}, nil
+}
@@ -0,0 +1,208 @@
+package server
+
+import (
+	"crypto/sha256"
+	"net"
+	"strconv"
+
+	"github.com/denkhaus/llconf/logging"
+	"github.com/denkhaus/llconf/promise"
+	"github.com/denkhaus/llconf/store"
+	"github.com/denkhaus/llconf/util"
+	"github.com/denkhaus/llconf/wire"
+	"github.com/docker/libchan"
+	"github.com/docker/libchan/spdy"
+	"github.com/juju/errors"
+	"gopkg.in/tomb.v2"
+)
+
+// RelayDialFunc opens an authenticated connection to the server at target.
+type RelayDialFunc func(target string) (net.Conn, error)
+
+//////////////////////////////////////////////////////////////////////////////////
+// EnableRelay lets clients address commands to other servers, which are
+// forwarded over connections opened with dial. Only targets matching
+// one of the shell patterns in targets are relayed, tcp targets are
+// matched with their port, eg. *.internal:9954.
+func (p *Server) EnableRelay(targets []string, dial RelayDialFunc) {
+	p.relayTargets = targets
+	p.dialRelay = dial
+}
+
+//////////////////////////////////////////////////////////////////////////////////
+// checkRelay returns the normalized target of cmd, or an error if client
+// may not relay cmd to it. Trees of clients restricted to certain roots
+// or builtins are checked here, since the target only knows the relay.
+func (p *Server) checkRelay(cmd RemoteCommand, client *peer, publisher string) (string, error) {
+	if p.dialRelay == nil {
+		return "", errors.New("relaying is not enabled")
+	}
+
+	port, _ := strconv.Atoi(p.port)
+	addr, err := util.ParseAddress(cmd.Target, port)
+	if err != nil {
+		return "", errors.Annotate(err, "parse target")
+	}
+
+	if err := addr.CheckLogin(); err != nil {
+		return "", err
+	}
+
+	target := addr.String()
+	if !store.MatchTarget(p.relayTargets, target) {
+		return "", errors.Errorf("relay to %q not allowed", target)
+	}
+
+	policy := client.Policy
+	if err := policy.CheckRelay(target); err != nil {
+		return "", err
+	}
+
+	if len(policy.Roots) == 0 && len(policy.Builtins) == 0 && len(policy.Deny) == 0 {
+		return target, nil
+	}
+
+	if len(cmd.Source) > 0 {
+		return "", errors.New("source bundles of restricted clients cannot be relayed")
+	}
+
+	tree, _, err := wire.Decode(cmd.Data)
+	if err != nil {
+		return "", errors.Annotate(err, "decode command")
+	}
+
+	pr, ok := tree.(promise.NamedPromise)
+	if !ok {
+		return "", errors.Errorf("root promise %q is not a named promise", promise.BuiltinName(tree))
+	}
+
+	return target, policy.Check(pr, publisher != "")
+}
+
+//////////////////////////////////////////////////////////////////////////////////
+// relay forwards cmd of client, signed by publisher, to its target
+// and sends the response of the target back to the client.
+func (p *Server) relay(cmd RemoteCommand, client *peer, signed []byte, publisher string) error {
+	res := CommandResponse{
+		ServerVersion: p.serverVersion,
+		Capabilities:  wire.Local(),
+	}
+
+	target, err := p.checkRelay(cmd, client, publisher)
+	if err != nil {
+		closeStreams(cmd)
+		logging.Logger.Warnf("audit: denied relay to %q for client %q (%s) from %s, data sha256 %x: %s",
+			cmd.Target, client.ID, client.CommonName, client.Addr, sha256.Sum256(signed), err)
+
+		res.Status = "relay denied"
+		res.Error = err.Error()
+
+		logging.Logger.Info("send denied response")
+		if err := cmd.SendChannel.Send(&res); err != nil {
+			return errors.Annotate(err, "send")
+		}
+		return nil
+	}
+
+	if !p.beginRun() {
+		closeStreams(cmd)
+
+		res.Status = "server shutting down"
+		res.Error = "server is shutting down, please retry"
+
+		logging.Logger.Info("send shutdown response")
+		if err := cmd.SendChannel.Send(&res); err != nil {
+			return errors.Annotate(err, "send")
+		}
+		return tomb.ErrDying
+	}
+
+	logging.Logger.Infof("audit: relaying to %q for client %q (%s) from %s, data sha256 %x",
+		target, client.ID, client.CommonName, client.Addr, sha256.Sum256(signed))
+
+	resp, err := p.forward(cmd, target)
+	closeOutput(cmd)
+
+	if err != nil {
+		err = errors.Annotatef(err, "relay to %q", target)
+		logging.Logger.Error(err)
+
+		res.Status = "relay failed"
+		res.Error = err.Error()
+		resp = res
+	} else {
+		logging.Logger.Infof("audit: relayed to %q for client %q (%s) from %s: %s",
+			target, client.ID, client.CommonName, client.Addr, resp.Status)
+	}
+
+	logging.Logger.Info("send relay response")
+	err = cmd.SendChannel.Send(&resp)
+	p.runs.Done()
+	if err != nil {
+		return errors.Annotate(err, "send")
+	}
+
+	return nil
+}
+
+//////////////////////////////////////////////////////////////////////////////////
+// forward sends cmd over a new connection to target and waits for the
+// response. Output and attachment streams are passed through, cancel
+// requests of the client and the shutdown deadline are passed on.
+func (p *Server) forward(cmd RemoteCommand, target string) (CommandResponse, error) {
+	resp := CommandResponse{}
+
+	conn, err := p.dialRelay(target)
+	if err != nil {
+		closeAttachments(cmd)
+		return resp, errors.Annotate(err, "dial")
+	}
+
+	pr, err := spdy.NewSpdyStreamProvider(conn, false)
+	if err != nil {
+		closeAttachments(cmd)
+		conn.Close()
+		return resp, errors.Annotate(err, "new stream provider")
+	}
+	defer pr.Close()
+
+	sender, err := spdy.NewTransport(pr).NewSendChannel()
+	if err != nil {
+		closeAttachments(cmd)
+		return resp, errors.Annotate(err, "new send channel")
+	}
+	defer sender.Close()
+
+	receiver, remoteSender := libchan.Pipe()
+	cancelReceiver, cancelSender := libchan.Pipe()
+	defer cancelSender.Close()
+
+	cancel, stopCancel := p.watchCancel(cmd)
+	defer stopCancel()
+
+	done := make(chan struct{})
+	defer close(done)
+
+	go func() {
+		select {
+		case <-cancel:
+			cancelSender.Send(&CancelRequest{Reason: "canceled by relay"})
+		case <-done:
+		}
+	}()
+
+	fwd := cmd
+	fwd.Target = ""
+	fwd.Cancel = cancelReceiver
+	fwd.SendChannel = remoteSender
+
+	if err := sender.Send(&fwd); err != nil {
+		return resp, errors.Annotate(err, "send")
+	}
+
+	if err := receiver.Receive(&resp); err != nil {
+		return resp, errors.Annotate(err, "receive")
+	}
+
+	return resp, nil
+}
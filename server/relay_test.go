@@ -0,0 +1,253 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/denkhaus/llconf/promise"
+	"github.com/denkhaus/llconf/source"
+	"github.com/denkhaus/llconf/store"
+	"github.com/denkhaus/llconf/wire"
+	"github.com/docker/libchan"
+	"github.com/docker/libchan/spdy"
+	"github.com/juju/errors"
+)
+
+// outputBuffer collects the output of a command.
+type outputBuffer struct {
+	bytes.Buffer
+}
+
+func (b *outputBuffer) Close() error {
+	return nil
+}
+
+// relayClient is a client connected to a relay forwarding commands
+// to a target server at target.internal over in-memory connections.
+type relayClient struct {
+	sender libchan.Sender
+	close  func()
+}
+
+func newRelayClient(t *testing.T, opr oprFunc, compile SourceCompileFunc) *relayClient {
+	dir, err := ioutil.TempDir("", "llconf-relay-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	targetDS, err := store.New("target", "client", dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	relayDS, err := store.New("relay", "client", dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cache, err := source.OpenCache(filepath.Join(dir, "cache"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	target := New("127.0.0.1", 9954, targetDS, opr, true, "test")
+	target.EnableSource(cache, compile)
+
+	relay := New("127.0.0.1", 9954, relayDS, nil, true, "test")
+	relay.EnableRelay([]string{"target.internal:9954"}, func(addr string) (net.Conn, error) {
+		if addr != "target.internal:9954" {
+			return nil, errors.Errorf("unexpected target %q", addr)
+		}
+
+		c, s := net.Pipe()
+		go target.ServeConn(s, "relay")
+		return c, nil
+	})
+
+	c, s := net.Pipe()
+	go relay.ServeConn(s, "client")
+
+	pr, err := spdy.NewSpdyStreamProvider(c, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sender, err := spdy.NewTransport(pr).NewSendChannel()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &relayClient{
+		sender: sender,
+		close: func() {
+			pr.Close()
+			targetDS.Close()
+			relayDS.Close()
+			os.RemoveAll(dir)
+		},
+	}
+}
+
+// send sends cmd to the target through the relay and returns the
+// channel the response arrives on.
+func (c *relayClient) send(t *testing.T, cmd RemoteCommand) <-chan CommandResponse {
+	receiver, remoteSender := libchan.Pipe()
+	cmd.SendChannel = remoteSender
+	cmd.Target = "target.internal"
+
+	if err := c.sender.Send(&cmd); err != nil {
+		t.Fatal(err)
+	}
+
+	res := make(chan CommandResponse, 1)
+	go func() {
+		resp := CommandResponse{}
+		if err := receiver.Receive(&resp); err != nil {
+			resp.Error = err.Error()
+		}
+		res <- resp
+	}()
+
+	return res
+}
+
+func waitResponse(t *testing.T, res <-chan CommandResponse) CommandResponse {
+	select {
+	case resp := <-res:
+		return resp
+	case <-time.After(5 * time.Second):
+		t.Fatal("no response relayed")
+	}
+	return CommandResponse{}
+}
+
+func encodeTree(t *testing.T, name string) []byte {
+	data, err := wire.Encode(promise.NamedPromise{
+		Name:    name,
+		Promise: promise.ExecPromise{Type: promise.ExecChange, Arguments: []promise.Argument{promise.Constant("true")}},
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestRelayOutputAndCancel(t *testing.T) {
+	c := newRelayClient(t, func(pr promise.Promise, opts ExecOptions) error {
+		name := pr.(promise.NamedPromise).Name
+		io.WriteString(opts.Output, "evaluating "+name+"\n")
+
+		if name != "wait" {
+			return nil
+		}
+
+		select {
+		case <-opts.Cancel:
+			return errors.New("canceled")
+		case <-time.After(5 * time.Second):
+			return errors.New("cancel request not relayed")
+		}
+	}, nil)
+	defer c.close()
+
+	out := &outputBuffer{}
+	resp := waitResponse(t, c.send(t, RemoteCommand{Data: encodeTree(t, "done"), Output: out}))
+	if resp.Error != "" || resp.Status != "execution successfull" {
+		t.Fatalf("unexpected response %+v", resp)
+	}
+	if out.String() != "evaluating done\n" {
+		t.Errorf("unexpected output %q", out.String())
+	}
+
+	outReader, outWriter := io.Pipe()
+	cancelReceiver, cancelSender := libchan.Pipe()
+	defer cancelSender.Close()
+
+	res := c.send(t, RemoteCommand{Data: encodeTree(t, "wait"), Output: outWriter, Cancel: cancelReceiver})
+
+	// the output streams while the target still evaluates
+	line, err := bufio.NewReader(outReader).ReadString('\n')
+	if err != nil || line != "evaluating wait\n" {
+		t.Fatalf("unexpected output %q: %v", line, err)
+	}
+
+	if err := cancelSender.Send(&CancelRequest{Reason: "test"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if resp := waitResponse(t, res); resp.Status != "execution canceled" {
+		t.Errorf("unexpected response %+v", resp)
+	}
+}
+
+func TestRelaySourceIncomplete(t *testing.T) {
+	main := []byte("(done (change true))")
+	compile := func(dir string, root string) (promise.Promise, error) {
+		data, err := ioutil.ReadFile(filepath.Join(dir, "main.cnf"))
+		if err != nil {
+			return nil, err
+		}
+		if !bytes.Equal(data, main) {
+			return nil, errors.Errorf("unexpected source %q", data)
+		}
+
+		return promise.NamedPromise{
+			Name:    root,
+			Promise: promise.ExecPromise{Type: promise.ExecChange, Arguments: []promise.Argument{promise.Constant("true")}},
+		}, nil
+	}
+
+	c := newRelayClient(t, func(pr promise.Promise, opts ExecOptions) error {
+		motd, err := ioutil.ReadFile(filepath.Join(opts.BundleDir, "motd.txt"))
+		if err != nil {
+			return err
+		}
+
+		io.WriteString(opts.Output, pr.(promise.NamedPromise).Name+": "+string(motd))
+		return nil
+	}, compile)
+	defer c.close()
+
+	motd := "hello"
+	manifest := wire.Source{
+		Root:        "done",
+		Files:       []wire.SourceFile{{Path: "main.cnf", Hash: source.Hash(main)}},
+		Attachments: []wire.SourceFile{{Path: "motd.txt", Hash: source.Hash([]byte(motd))}},
+	}
+	data, err := wire.EncodeSource(manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	attachments := func() []Attachment {
+		return []Attachment{{Path: "motd.txt", Content: ioutil.NopCloser(strings.NewReader(motd))}}
+	}
+
+	resp := waitResponse(t, c.send(t, RemoteCommand{Source: data, Attachments: attachments()}))
+	if resp.Status != "source incomplete" || len(resp.Missing) != 1 || resp.Missing[0] != source.Hash(main) {
+		t.Fatalf("unexpected response %+v", resp)
+	}
+
+	// the attachment streams of the first command are consumed, so the
+	// client sends them again along with the missing source files
+	out := &outputBuffer{}
+	resp = waitResponse(t, c.send(t, RemoteCommand{
+		Source:      data,
+		Blobs:       [][]byte{main},
+		Attachments: attachments(),
+		Output:      out,
+	}))
+	if resp.Error != "" || resp.Status != "execution successfull" {
+		t.Fatalf("unexpected response %+v", resp)
+	}
+	if out.String() != "done: hello" {
+		t.Errorf("unexpected output %q", out.String())
+	}
+}
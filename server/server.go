@@ -1,18 +1,24 @@
 package server
 
 import (
-	"bytes"
+	"crypto/sha256"
 	"crypto/tls"
-	"encoding/gob"
+	"crypto/x509"
 	"fmt"
 	"io"
 	"net"
 	"os"
+	"strconv"
+	"sync"
+	"time"
 
 	"github.com/denkhaus/goagain"
+	"github.com/denkhaus/llconf/bundle"
 	"github.com/denkhaus/llconf/logging"
+	"github.com/denkhaus/llconf/source"
 	"github.com/denkhaus/llconf/store"
 	"github.com/denkhaus/llconf/util"
+	"github.com/denkhaus/llconf/wire"
 	"github.com/juju/errors"
 
 	"github.com/denkhaus/llconf/promise"
@@ -24,32 +30,97 @@ import (
 //////////////////////////////////////////////////////////////////////////////////
 type RemoteCommand struct {
 	Data          []byte
+	Source        []byte
+	Blobs         [][]byte
+	Attachments   []Attachment
+	Signature     []byte
+	Targets       []string
+	NotAfter      time.Time
 	Stdout        io.WriteCloser
+	Output        io.WriteCloser
+	Cancel        libchan.Receiver
 	SendChannel   libchan.Sender
+	Target        string
 	Verbose       bool
 	Debug         bool
 	ClientVersion string
 }
 
+//////////////////////////////////////////////////////////////////////////////////
+// Attachment streams the content of a file attached to a command.
+type Attachment struct {
+	Path    string
+	Content io.ReadCloser
+}
+
+//////////////////////////////////////////////////////////////////////////////////
+// CancelRequest is sent by the client on the cancel channel of a
+// command to abort its evaluation.
+type CancelRequest struct {
+	Reason string
+}
+
 //////////////////////////////////////////////////////////////////////////////////
 type CommandResponse struct {
 	ServerVersion string
 	Status        string
 	Error         string
+	Capabilities  wire.Capabilities
+	Missing       []string
+}
+
+//////////////////////////////////////////////////////////////////////////////////
+// ExecOptions control the evaluation of a received promise.
+type ExecOptions struct {
+	Verbose   bool
+	ReadOnly  bool
+	SourceDir string
+	BundleDir string
+	// Output streams the output of commands to the client
+	Output io.Writer
+	// Cancel is closed when the client cancels the evaluation
+	Cancel <-chan struct{}
 }
 
-type oprFunc func(pr promise.Promise, verbose bool) error
+type oprFunc func(pr promise.Promise, opts ExecOptions) error
+
+// SourceCompileFunc compiles the root promise of a source bundle staged in dir.
+type SourceCompileFunc func(dir string, root string) (promise.Promise, error)
+
+//////////////////////////////////////////////////////////////////////////////////
+// peer identifies the client of a connection by the
+// certificate entry it was verified with.
+type peer struct {
+	ID         string
+	CommonName string
+	Addr       string
+	Policy     store.Policy
+}
+
+// CertificateFunc returns the current server certificate.
+type CertificateFunc func() (*tls.Certificate, error)
 
 //////////////////////////////////////////////////////////////////////////////////
 type Server struct {
 	tomb              tomb.Tomb
-	tslListener       net.Listener
-	tcpListener       net.Listener
+	listeners         []*listener
+	addresses         []util.Address
 	host              string
 	port              string
 	serverVersion     string
 	noRedirect        bool
+	enrolling         bool
+	getCertificate    CertificateFunc
+	sourceCache       *source.Cache
+	compileSource     SourceCompileFunc
+	relayTargets      []string
+	dialRelay         RelayDialFunc
+	names             []string
 	dataStore         *store.DataStore
+	runMutex          sync.Mutex
+	runs              sync.WaitGroup
+	conns             map[net.Conn]struct{}
+	abort             chan struct{}
 	OnPromiseReceived oprFunc
 }
 
@@ -61,6 +132,8 @@ func New(host string, port int, ds *store.DataStore, opr oprFunc, noRedirect boo
 		dataStore:         ds,
 		noRedirect:        noRedirect,
 		serverVersion:     serverVersion,
+		abort:             make(chan struct{}),
+		conns:             map[net.Conn]struct{}{},
 		OnPromiseReceived: opr,
 	}
 
@@ -71,13 +144,150 @@ func New(host string, port int, ds *store.DataStore, opr oprFunc, noRedirect boo
 func (p *Server) Close() error {
 	logging.Logger.Debug("server: close")
 
-	defer p.tslListener.Close()
+	defer p.closeListeners()
 	p.tomb.Kill(nil)
+	p.closeConns()
 
 	logging.Logger.Debug("server: wait")
 	return p.tomb.Wait()
 }
 
+// abortGrace is the time canceled evaluations and closed
+// connections get to finish after the shutdown deadline.
+const abortGrace = 10 * time.Second
+
+//////////////////////////////////////////////////////////////////////////////////
+// Shutdown stops accepting connections and waits up to timeout for
+// running evaluations to finish. Evaluations still running after
+// timeout are canceled. Idle connections are closed once no evaluation
+// runs anymore, so clients keeping a connection open do not block it.
+func (p *Server) Shutdown(timeout time.Duration) error {
+	logging.Logger.Infof("server: shutdown, waiting up to %s for running evaluations", timeout)
+
+	p.runMutex.Lock()
+	p.tomb.Kill(nil)
+	p.runMutex.Unlock()
+	p.closeListeners()
+
+	done := make(chan struct{})
+	go func() {
+		p.runs.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		logging.Logger.Warn("shutdown deadline passed, canceling running evaluations")
+		close(p.abort)
+
+		select {
+		case <-done:
+		case <-time.After(abortGrace):
+			logging.Logger.Warn("canceled evaluations did not finish, closing connections")
+		}
+	}
+
+	p.closeConns()
+
+	dead := make(chan error, 1)
+	go func() { dead <- p.tomb.Wait() }()
+
+	logging.Logger.Debug("server: wait")
+	select {
+	case err := <-dead:
+		return err
+	case <-time.After(abortGrace):
+		return errors.New("connections did not close in time")
+	}
+}
+
+// trackConn registers the accepted connection c, which is closed on
+// shutdown. It reports false if the server shuts down already.
+func (p *Server) trackConn(c net.Conn) bool {
+	p.runMutex.Lock()
+	defer p.runMutex.Unlock()
+
+	if !p.tomb.Alive() {
+		return false
+	}
+
+	p.conns[c] = struct{}{}
+	return true
+}
+
+func (p *Server) untrackConn(c net.Conn) {
+	p.runMutex.Lock()
+	defer p.runMutex.Unlock()
+
+	delete(p.conns, c)
+}
+
+func (p *Server) closeConns() {
+	p.runMutex.Lock()
+	defer p.runMutex.Unlock()
+
+	for c := range p.conns {
+		c.Close()
+	}
+}
+
+// beginRun registers a new evaluation, unless the server shuts down.
+func (p *Server) beginRun() bool {
+	p.runMutex.Lock()
+	defer p.runMutex.Unlock()
+
+	if !p.tomb.Alive() {
+		return false
+	}
+
+	p.runs.Add(1)
+	return true
+}
+
+//////////////////////////////////////////////////////////////////////////////////
+// SetCertificateFunc makes the server ask fn for its certificate on every
+// connection instead of using the one it was started with.
+func (p *Server) SetCertificateFunc(fn CertificateFunc) {
+	p.getCertificate = fn
+}
+
+//////////////////////////////////////////////////////////////////////////////////
+// verifyCommand returns the publisher of cmd, whose signed data is signed.
+// Signed commands must be meant for this server, or the target they are
+// relayed to, and must not have expired.
+func (p *Server) verifyCommand(cmd RemoteCommand, signed []byte) (string, error) {
+	e := bundle.Envelope{Data: signed, Targets: cmd.Targets, NotAfter: cmd.NotAfter}
+	publisher, err := p.dataStore.VerifyBundle(e, cmd.Signature)
+	if err != nil || publisher == "" {
+		return publisher, err
+	}
+
+	names := p.names
+	if cmd.Target != "" {
+		port, _ := strconv.Atoi(p.port)
+		if addr, err := util.ParseAddress(cmd.Target, port); err == nil && addr.Host() != "" {
+			names = []string{addr.Host()}
+		}
+	}
+
+	return publisher, e.Check(names, time.Now())
+}
+
+//////////////////////////////////////////////////////////////////////////////////
+// SetNames sets the names signed promise trees may address the server by.
+func (p *Server) SetNames(names []string) {
+	p.names = names
+}
+
+//////////////////////////////////////////////////////////////////////////////////
+// EnableSource lets clients send source bundles, which are
+// cached in cache and compiled with compile.
+func (p *Server) EnableSource(cache *source.Cache, compile SourceCompileFunc) {
+	p.sourceCache = cache
+	p.compileSource = compile
+}
+
 //////////////////////////////////////////////////////////////////////////////////
 func (p *Server) Alive() bool {
 	return p.tomb.Alive()
@@ -89,92 +299,152 @@ func (p *Server) LastError() error {
 }
 
 //////////////////////////////////////////////////////////////////////////////////
+// SetListenAddresses makes the server listen on addrs
+// instead of its host and port.
+func (p *Server) SetListenAddresses(addrs []util.Address) {
+	p.addresses = addrs
+}
+
+//////////////////////////////////////////////////////////////////////////////////
+// ListenerTCP returns the listener of the first tcp address, which is
+// passed to the restarted process, or nil if there is none.
 func (p *Server) ListenerTCP() net.Listener {
-	return p.tcpListener
+	if l := p.primaryListener(); l != nil {
+		return l.raw
+	}
+	return nil
+}
+
+func (p *Server) primaryListener() *listener {
+	for _, l := range p.listeners {
+		if l.addr.Network == "tcp" {
+			return l
+		}
+	}
+	return nil
 }
 
 //////////////////////////////////////////////////////////////////////////////////
-func (p *Server) listenTCP(addr string) (*util.TimeoutListener, error) {
-	laddr, err := net.ResolveTCPAddr("tcp", addr)
-	if err != nil {
-		return nil, errors.Annotate(err, "resolve tcp addr")
+// ReleaseListeners closes all listeners but the one passed to a
+// restarted process, so the restarted process is able to bind them.
+func (p *Server) ReleaseListeners() {
+	primary := p.primaryListener()
+	for _, l := range p.listeners {
+		if l != primary {
+			l.Close()
+		}
 	}
+}
 
-	l, err := net.ListenTCP("tcp", laddr)
-	if err != nil {
-		return nil, errors.Annotate(err, "listen tcp")
+func (p *Server) closeListeners() {
+	for _, l := range p.listeners {
+		l.Close()
+	}
+}
+
+//////////////////////////////////////////////////////////////////////////////////
+func (p *Server) listenAddresses() []util.Address {
+	if len(p.addresses) > 0 {
+		return p.addresses
 	}
 
-	return util.NewTimeoutListener(l), nil
+	return []util.Address{{Network: "tcp", Addr: net.JoinHostPort(p.host, p.port)}}
 }
 
 //////////////////////////////////////////////////////////////////////////////////
+// ReuseListenerAndRun runs the server with ln, inherited from the parent
+// process, as listener of the first tcp address.
 func (p *Server) ReuseListenerAndRun(ln net.Listener, cert *tls.Certificate) error {
 	logging.Logger.Infof("resume listening on %s", ln.Addr())
+	return p.listenAndRun(ln, cert)
+}
 
+//////////////////////////////////////////////////////////////////////////////////
+func (p *Server) CreateListenerAndRun(cert *tls.Certificate) error {
+	return p.listenAndRun(nil, cert)
+}
+
+func (p *Server) listenAndRun(inherited net.Listener, cert *tls.Certificate) error {
 	tlsConfig, err := p.prepeareTLSConfig(cert)
 	if err != nil {
 		return errors.Annotate(err, "prepare tls config")
 	}
 
-	p.tcpListener = util.NewTimeoutListener(ln.(*net.TCPListener))
-	p.tslListener = tls.NewListener(p.tcpListener, tlsConfig)
+	for _, addr := range p.listenAddresses() {
+		var reuse net.Listener
+		if addr.Network == "tcp" && inherited != nil {
+			reuse, inherited = inherited, nil
+		}
 
-	p.tomb.Go(func() error {
-		if err := p.run(); err != nil {
-			if err != tomb.ErrDying {
-				return errors.Annotate(err, "reuse run")
-			}
+		l, err := listen(addr, reuse, tlsConfig)
+		if err != nil {
+			p.closeListeners()
+			return errors.Annotatef(err, "listen on %s", addr)
 		}
+		p.listeners = append(p.listeners, l)
+	}
 
-		return nil
-	})
+	for _, l := range p.listeners {
+		l := l
+		logging.Logger.Infof("listening on %s", l.addr)
+		p.tomb.Go(func() error {
+			if err := p.run(l); err != nil {
+				if err != tomb.ErrDying {
+					return errors.Annotatef(err, "run %s", l.addr)
+				}
+			}
+
+			return nil
+		})
+	}
 
 	return nil
 }
 
-//////////////////////////////////////////////////////////////////////////////////
-func (p *Server) CreateListenerAndRun(cert *tls.Certificate) error {
-	tlsConfig, err := p.prepeareTLSConfig(cert)
+////////////////////////////////////////////////////////////////////////////////
+// The client cert pool is read for every connection, so
+// certificates added while the server runs are trusted at once.
+func (p *Server) prepeareTLSConfig(cert *tls.Certificate) (*tls.Config, error) {
+	pool, err := p.clientPool()
 	if err != nil {
-		return errors.Annotate(err, "prepare tls config")
+		if !p.enrolling {
+			return nil, errors.Annotate(err, "get client cert pool")
+		}
+		logging.Logger.Warnf("%s, waiting for enrollment", err)
 	}
 
-	hostPort := net.JoinHostPort(p.host, p.port)
-	ln, err := p.listenTCP(hostPort)
-	if err != nil {
-		return errors.Annotate(err, "listen tcp")
-	}
+	tlsConfig := p.newTLSConfig(cert, pool)
+	tlsConfig.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+		pool, err := p.clientPool()
+		if err != nil {
+			return nil, errors.Annotate(err, "get client cert pool")
+		}
 
-	p.tcpListener = ln
-	p.tslListener = tls.NewListener(p.tcpListener, tlsConfig)
+		return p.newTLSConfig(cert, pool), nil
+	}
 
-	logging.Logger.Infof("listening on %s", hostPort)
-	p.tomb.Go(func() error {
-		if err := p.run(); err != nil {
-			if err != tomb.ErrDying {
-				return errors.Annotate(err, "new run")
-			}
-		}
+	return tlsConfig, nil
+}
 
-		return nil
-	})
+// clientPool stores the certificates queued while the server
+// holds the datastore and returns the client cert pool.
+func (p *Server) clientPool() (*x509.CertPool, error) {
+	if err := p.dataStore.ImportPending(); err != nil {
+		logging.Logger.Errorf("import queued certificates: %s", err)
+	}
 
-	return nil
+	return p.dataStore.Pool()
 }
 
 ////////////////////////////////////////////////////////////////////////////////
-func (p *Server) prepeareTLSConfig(cert *tls.Certificate) (*tls.Config, error) {
-	pool, err := p.dataStore.Pool()
-	if err != nil {
-		return nil, errors.Annotate(err, "get client cert pool")
-	}
+func (p *Server) newTLSConfig(cert *tls.Certificate, pool *x509.CertPool) *tls.Config {
 	tlsConfig := &tls.Config{
-		Certificates: []tls.Certificate{*cert},
 		// Reject any TLS certificate that cannot be validated
 		ClientAuth: tls.RequireAndVerifyClientCert,
 		// Ensure that we only use our "CA" to validate certificates
 		ClientCAs: pool,
+		// Reject revoked certificates
+		VerifyPeerCertificate: p.dataStore.VerifyPeerCertificate,
 		CipherSuites: []uint16{
 			tls.TLS_RSA_WITH_AES_256_GCM_SHA384,
 			tls.TLS_RSA_WITH_AES_256_CBC_SHA,
@@ -185,8 +455,18 @@ func (p *Server) prepeareTLSConfig(cert *tls.Certificate) (*tls.Config, error) {
 		MinVersion: tls.VersionTLS12,
 	}
 
+	// GetCertificate is only asked without Certificates or for
+	// clients sending a server name, not for clients dialing an ip
+	if p.getCertificate != nil {
+		tlsConfig.GetCertificate = func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return p.getCertificate()
+		}
+	} else {
+		tlsConfig.Certificates = []tls.Certificate{*cert}
+	}
+
 	tlsConfig.BuildNameToCertificate()
-	return tlsConfig, nil
+	return tlsConfig
 }
 
 //////////////////////////////////////////////////////////////////////////////////
@@ -200,12 +480,227 @@ func (p *Server) redirectOutput(writer io.Writer, fn func() error) error {
 }
 
 //////////////////////////////////////////////////////////////////////////////////
-func (p *Server) receive(t libchan.Transport) error {
+// identify completes the handshake of c and looks up the
+// certificate entry the client was verified with.
+func (p *Server) identify(c net.Conn) (*peer, error) {
+	tlsConn, ok := c.(*tls.Conn)
+	if !ok {
+		return nil, errors.New("no tls connection")
+	}
+
+	tlsConn.SetDeadline(time.Now().Add(30 * time.Second))
+	defer tlsConn.SetDeadline(time.Time{})
+
+	if err := tlsConn.Handshake(); err != nil {
+		return nil, errors.Annotate(err, "handshake")
+	}
+
+	chains := tlsConn.ConnectionState().VerifiedChains
+	id, policy, err := p.dataStore.Identify(chains)
+	if err != nil {
+		return nil, errors.Annotate(err, "identify")
+	}
+
+	return &peer{
+		ID:         id,
+		CommonName: chains[0][0].Subject.CommonName,
+		Addr:       c.RemoteAddr().String(),
+		Policy:     policy,
+	}, nil
+}
+
+//////////////////////////////////////////////////////////////////////////////////
+// command is a decoded RemoteCommand.
+type command struct {
+	Promise     promise.NamedPromise
+	Attachments []wire.SourceFile
+	SourceDir   string
+	BundleDir   string
+	// Missing lists the source hashes the client has to send
+	Missing []string
+}
+
+// cleanup removes the folders the command was staged in.
+func (c command) cleanup() {
+	removeDir(c.SourceDir)
+	removeDir(c.BundleDir)
+}
+
+//////////////////////////////////////////////////////////////////////////////////
+// decodeCommand decodes the promise tree or source bundle of cmd.
+func (p *Server) decodeCommand(cmd RemoteCommand) (command, error) {
+	if len(cmd.Source) > 0 {
+		return p.loadSource(cmd)
+	}
+
+	tree, attachments, err := wire.Decode(cmd.Data)
+	if err != nil {
+		return command{}, err
+	}
+
+	pr, ok := tree.(promise.NamedPromise)
+	if !ok {
+		return command{}, errors.Errorf("root promise %q is not a named promise", promise.BuiltinName(tree))
+	}
+
+	return command{Promise: pr, Attachments: attachments}, nil
+}
+
+//////////////////////////////////////////////////////////////////////////////////
+// loadSource caches the blobs of a source bundle command. If the bundle is
+// complete, it is staged and compiled, otherwise the hashes still missing
+// are returned.
+func (p *Server) loadSource(cmd RemoteCommand) (command, error) {
+	if p.sourceCache == nil {
+		return command{}, errors.New("source bundles are not enabled")
+	}
+
+	manifest, err := wire.DecodeSource(cmd.Source)
+	if err != nil {
+		return command{}, errors.Annotate(err, "decode source")
+	}
+
+	wanted := map[string]bool{}
+	for _, hash := range p.sourceCache.Missing(manifest) {
+		wanted[hash] = true
+	}
+
+	for _, blob := range cmd.Blobs {
+		if !wanted[source.Hash(blob)] {
+			return command{}, errors.New("unrequested source blob received")
+		}
+		if err := p.sourceCache.Put(blob); err != nil {
+			return command{}, errors.Annotate(err, "cache source blob")
+		}
+	}
+
+	if missing := p.sourceCache.Missing(manifest); len(missing) > 0 {
+		return command{Missing: missing}, nil
+	}
+
+	dir, err := p.sourceCache.Stage(manifest)
+	if err != nil {
+		return command{}, errors.Annotate(err, "stage source")
+	}
+
+	tree, err := p.compileSource(dir, manifest.Root)
+	if err != nil {
+		removeDir(dir)
+		return command{}, err
+	}
+
+	pr, ok := tree.(promise.NamedPromise)
+	if !ok {
+		removeDir(dir)
+		return command{}, errors.Errorf("root promise %q is not a named promise", manifest.Root)
+	}
+
+	return command{Promise: pr, Attachments: manifest.Attachments, SourceDir: dir}, nil
+}
+
+//////////////////////////////////////////////////////////////////////////////////
+// stageAttachments writes the files attached to cmd into the bundle folder of c.
+func (c *command) stageAttachments(cmd RemoteCommand) error {
+	if len(c.Attachments) == 0 {
+		return nil
+	}
+
+	streams := map[string]io.Reader{}
+	for _, a := range cmd.Attachments {
+		streams[a.Path] = a.Content
+	}
+
+	dir, err := source.StageAttachments(c.Attachments, streams)
+	if err != nil {
+		return err
+	}
+
+	c.BundleDir = dir
+	return nil
+}
+
+//////////////////////////////////////////////////////////////////////////////////
+// watchCancel returns a channel that is closed once the client requests
+// to cancel cmd or the shutdown deadline has passed, until stop is called.
+func (p *Server) watchCancel(cmd RemoteCommand) (cancel <-chan struct{}, stop func()) {
+	c := make(chan struct{})
+	once := sync.Once{}
+	done := make(chan struct{})
+
+	if cmd.Cancel != nil {
+		go func() {
+			req := CancelRequest{}
+			if err := cmd.Cancel.Receive(&req); err != nil {
+				return
+			}
+
+			logging.Logger.Warnf("client requested to cancel the evaluation: %s", req.Reason)
+			once.Do(func() { close(c) })
+		}()
+	}
+
+	go func() {
+		select {
+		case <-done:
+		case <-p.abort:
+			once.Do(func() { close(c) })
+		}
+	}()
+
+	return c, func() { close(done) }
+}
+
+func isClosed(c <-chan struct{}) bool {
+	select {
+	case <-c:
+		return true
+	default:
+		return false
+	}
+}
+
+//////////////////////////////////////////////////////////////////////////////////
+func closeOutput(cmd RemoteCommand) {
+	if cmd.Output != nil {
+		cmd.Output.Close()
+	}
+}
+
+// closeStreams closes all streams of a command that is not executed.
+func closeStreams(cmd RemoteCommand) {
+	closeAttachments(cmd)
+	closeOutput(cmd)
+}
+
+//////////////////////////////////////////////////////////////////////////////////
+func closeAttachments(cmd RemoteCommand) {
+	for _, a := range cmd.Attachments {
+		if a.Content != nil {
+			a.Content.Close()
+		}
+	}
+}
+
+//////////////////////////////////////////////////////////////////////////////////
+func removeDir(dir string) {
+	if dir != "" {
+		if err := os.RemoveAll(dir); err != nil {
+			logging.Logger.Warnf("unable to remove %q: %s", dir, err)
+		}
+	}
+}
+
+//////////////////////////////////////////////////////////////////////////////////
+func (p *Server) receive(t libchan.Transport, client *peer) error {
 	defer logging.Logger.Debug("server: receive leaved")
 
 	logging.Logger.Debug("server: wait for receive channel")
 	receiver, err := t.WaitReceiveChannel()
 	if err != nil {
+		if err == io.EOF {
+			// the client disconnected without sending a command
+			return nil
+		}
 		return errors.Annotate(err, "wait receive channel")
 	}
 
@@ -214,6 +709,7 @@ func (p *Server) receive(t libchan.Transport) error {
 	for {
 		res := CommandResponse{
 			ServerVersion: p.serverVersion,
+			Capabilities:  wire.Local(),
 		}
 
 		cmd := RemoteCommand{}
@@ -226,9 +722,49 @@ func (p *Server) receive(t libchan.Transport) error {
 
 		logging.Logger.Info("promise received")
 
-		pr := promise.NamedPromise{}
-		enc := gob.NewDecoder(bytes.NewBuffer(cmd.Data))
-		if err := enc.Decode(&pr); err != nil {
+		signed := cmd.Data
+		if len(cmd.Source) > 0 {
+			signed = cmd.Source
+		}
+
+		publisher, err := p.verifyCommand(cmd, signed)
+		if err != nil {
+			closeStreams(cmd)
+			logging.Logger.Warnf("audit: denied unverified promise for client %q (%s) from %s, data sha256 %x: %s",
+				client.ID, client.CommonName, client.Addr, sha256.Sum256(signed), err)
+
+			res.Status = "execution denied"
+			res.Error = errors.Annotate(err, "verify signature").Error()
+
+			logging.Logger.Info("send denied response")
+			if err := cmd.SendChannel.Send(&res); err != nil {
+				return errors.Annotate(err, "send")
+			}
+			continue
+		}
+
+		if cmd.Target != "" {
+			if err := p.relay(cmd, client, signed, publisher); err != nil {
+				return err
+			}
+			continue
+		}
+
+		c, err := p.decodeCommand(cmd)
+		if err == nil && len(c.Missing) > 0 {
+			closeStreams(cmd)
+			logging.Logger.Infof("request %d uncached source files", len(c.Missing))
+
+			res.Status = "source incomplete"
+			res.Missing = c.Missing
+			if err := cmd.SendChannel.Send(&res); err != nil {
+				return errors.Annotate(err, "send")
+			}
+			continue
+		}
+
+		if err != nil {
+			closeStreams(cmd)
 			err = errors.Annotate(err, "decode command")
 			logging.Logger.Error(err)
 
@@ -243,16 +779,72 @@ func (p *Server) receive(t libchan.Transport) error {
 			return nil
 		}
 
-		err := p.redirectOutput(cmd.Stdout, func() error {
-			if cmd.ClientVersion != p.serverVersion {
-				logging.Logger.Warn("client/server version mismatch")
-				logging.Logger.Warnf("server: %s client: %s", p.serverVersion, cmd.ClientVersion)
-				logging.Logger.Warn("please update your server")
-				logging.Logger.Warnings++
+		pr := c.Promise
+		if err := client.Policy.Check(pr, publisher != ""); err != nil {
+			closeStreams(cmd)
+			c.cleanup()
+
+			logging.Logger.Warnf("audit: denied %q for client %q (%s) from %s, data sha256 %x: %s",
+				pr.Name, client.ID, client.CommonName, client.Addr, sha256.Sum256(signed), err)
+
+			res.Status = "execution denied"
+			res.Error = err.Error()
+
+			logging.Logger.Info("send denied response")
+			if err := cmd.SendChannel.Send(&res); err != nil {
+				return errors.Annotate(err, "send")
 			}
+			continue
+		}
 
-			return p.OnPromiseReceived(pr, cmd.Verbose)
-		})
+		logging.Logger.Infof("audit: accepted %q for client %q (%s) from %s, data sha256 %x, publisher %q, read-only %t",
+			pr.Name, client.ID, client.CommonName, client.Addr, sha256.Sum256(signed), publisher, client.Policy.ReadOnly)
+
+		if !p.beginRun() {
+			closeStreams(cmd)
+			c.cleanup()
+
+			res.Status = "server shutting down"
+			res.Error = "server is shutting down, please retry"
+
+			logging.Logger.Info("send shutdown response")
+			if err := cmd.SendChannel.Send(&res); err != nil {
+				return errors.Annotate(err, "send")
+			}
+			return tomb.ErrDying
+		}
+
+		cancel, stopCancel := p.watchCancel(cmd)
+		err = c.stageAttachments(cmd)
+		closeAttachments(cmd)
+		if err == nil {
+			err = p.redirectOutput(cmd.Stdout, func() error {
+				if cmd.ClientVersion != p.serverVersion {
+					logging.Logger.Warn("client/server version mismatch")
+					logging.Logger.Warnf("server: %s client: %s", p.serverVersion, cmd.ClientVersion)
+					logging.Logger.Warn("please update your server")
+					logging.Logger.Warnings++
+				}
+
+				if client.Policy.ReadOnly {
+					logging.Logger.Warn("read-only access, changes are skipped")
+				}
+
+				return p.OnPromiseReceived(pr, ExecOptions{
+					Verbose:   cmd.Verbose,
+					ReadOnly:  client.Policy.ReadOnly,
+					SourceDir: c.SourceDir,
+					BundleDir: c.BundleDir,
+					Output:    cmd.Output,
+					Cancel:    cancel,
+				})
+			})
+		} else {
+			err = errors.Annotate(err, "stage attachments")
+		}
+		c.cleanup()
+		closeOutput(cmd)
+		stopCancel()
 
 		res.Status = "execution successfull"
 		if err != nil {
@@ -260,8 +852,23 @@ func (p *Server) receive(t libchan.Transport) error {
 			res.Status = "execution aborted with error"
 		}
 
+		switch {
+		case err != nil && isClosed(p.abort):
+			logging.Logger.Warnf("audit: interrupted %q for client %q (%s) from %s by shutdown: %s",
+				pr.Name, client.ID, client.CommonName, client.Addr, res.Error)
+			res.Status = "execution interrupted by server shutdown"
+		case err != nil && isClosed(cancel):
+			logging.Logger.Warnf("audit: canceled %q for client %q (%s) from %s: %s",
+				pr.Name, client.ID, client.CommonName, client.Addr, res.Error)
+			res.Status = "execution canceled"
+		}
+
+		// the run ends with its response, so shutdown does
+		// not close the connection before it is sent
 		logging.Logger.Info("send response")
-		if err := cmd.SendChannel.Send(&res); err != nil {
+		err = cmd.SendChannel.Send(&res)
+		p.runs.Done()
+		if err != nil {
 			return errors.Annotate(err, "send")
 		}
 
@@ -277,7 +884,7 @@ func (p *Server) receive(t libchan.Transport) error {
 }
 
 //////////////////////////////////////////////////////////////////////////////////
-func (p *Server) run() error {
+func (p *Server) run(l *listener) error {
 	defer logging.Logger.Debug("server: run leaved")
 
 	for {
@@ -289,7 +896,7 @@ func (p *Server) run() error {
 		default:
 		}
 
-		c, err := p.tslListener.Accept()
+		c, err := l.accept.Accept()
 		if err != nil {
 
 			if netErr, ok := err.(net.Error); ok &&
@@ -305,23 +912,62 @@ func (p *Server) run() error {
 
 		logging.Logger.Debug("server: connection available")
 
-		pr, err := spdy.NewSpdyStreamProvider(c, true)
-		if err != nil {
-			return errors.Annotate(err, "new stream provider")
+		if !p.trackConn(c) {
+			c.Close()
+			continue
 		}
 
 		p.tomb.Go(func() error {
-			defer pr.Close()
+			defer p.untrackConn(c)
 
-			t := spdy.NewTransport(pr)
-			if err := p.receive(t); err != nil {
-				if err != tomb.ErrDying {
-					return errors.Annotate(err, "receive")
-				}
+			identify := p.identify
+			if l.addr.Network == "unix" {
+				identify = identifyUnix
 			}
-			return nil
+
+			client, err := identify(c)
+			if err != nil {
+				logging.Logger.Warnf("audit: rejected connection from %s: %s", c.RemoteAddr(), err)
+				c.Close()
+				return nil
+			}
+
+			return p.serve(c, client)
 		})
 	}
 
 	return nil
 }
+
+// serve receives the commands of client on c.
+func (p *Server) serve(c net.Conn, client *peer) error {
+	pr, err := spdy.NewSpdyStreamProvider(c, true)
+	if err != nil {
+		return errors.Annotate(err, "new stream provider")
+	}
+	defer pr.Close()
+
+	t := spdy.NewTransport(pr)
+	if err := p.receive(t, client); err != nil {
+		if err == tomb.ErrDying || !p.tomb.Alive() {
+			// connections are closed on shutdown
+			return nil
+		}
+		return errors.Annotate(err, "receive")
+	}
+	return nil
+}
+
+//////////////////////////////////////////////////////////////////////////////////
+// ServeConn receives the commands of a single client, already authenticated
+// as id, on c, eg. the stdio of an ssh session. The client has full access.
+func (p *Server) ServeConn(c net.Conn, id string) error {
+	client := &peer{
+		ID:         id,
+		CommonName: id,
+		Addr:       c.RemoteAddr().String(),
+	}
+
+	logging.Logger.Infof("audit: serving client %q from %s", client.ID, client.Addr)
+	return p.serve(c, client)
+}
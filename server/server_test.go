@@ -0,0 +1,310 @@
+package server
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/user"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/denkhaus/llconf/bundle"
+	"github.com/denkhaus/llconf/promise"
+	"github.com/denkhaus/llconf/store"
+	"github.com/denkhaus/llconf/util"
+	"github.com/denkhaus/llconf/wire"
+	"github.com/docker/libchan/spdy"
+)
+
+func newTestServer(t *testing.T) *Server {
+	srv := New("127.0.0.1", 0, nil, nil, true, "test")
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.listeners = []*listener{{accept: ln}}
+
+	srv.tomb.Go(func() error {
+		<-srv.tomb.Dying()
+		return nil
+	})
+
+	return srv
+}
+
+func TestShutdownWaitsForRuns(t *testing.T) {
+	srv := newTestServer(t)
+	if !srv.beginRun() {
+		t.Fatal("run not accepted")
+	}
+
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		srv.runs.Done()
+	}()
+
+	start := time.Now()
+	if err := srv.Shutdown(5 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	if time.Since(start) < 100*time.Millisecond {
+		t.Error("shutdown did not wait for the running evaluation")
+	}
+	if isClosed(srv.abort) {
+		t.Error("finished evaluation has been canceled")
+	}
+	if srv.beginRun() {
+		t.Error("run accepted while shutting down")
+	}
+}
+
+func TestShutdownDeadline(t *testing.T) {
+	srv := newTestServer(t)
+	if !srv.beginRun() {
+		t.Fatal("run not accepted")
+	}
+
+	cancel, stop := srv.watchCancel(RemoteCommand{})
+	go func() {
+		<-cancel
+		stop()
+		srv.runs.Done()
+	}()
+
+	done := make(chan error)
+	go func() { done <- srv.Shutdown(50 * time.Millisecond) }()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("running evaluation has not been canceled")
+	}
+}
+
+func TestShutdownIdleConnection(t *testing.T) {
+	dir, err := ioutil.TempDir("", "llconf-server-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "llconf.sock")
+	l, err := listen(util.Address{Network: "unix", Addr: path}, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := New("127.0.0.1", 0, nil, nil, true, "test")
+	srv.listeners = []*listener{l}
+	srv.tomb.Go(func() error { return srv.run(l) })
+
+	c, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	pr, err := spdy.NewSpdyStreamProvider(c, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pr.Close()
+
+	// the client opens its channel, but never sends a command
+	if _, err := spdy.NewTransport(pr).NewSendChannel(); err != nil {
+		t.Fatal(err)
+	}
+
+	for start := time.Now(); ; time.Sleep(10 * time.Millisecond) {
+		srv.runMutex.Lock()
+		accepted := len(srv.conns) > 0
+		srv.runMutex.Unlock()
+
+		if accepted {
+			break
+		}
+		if time.Since(start) > 5*time.Second {
+			t.Fatal("connection not accepted")
+		}
+	}
+
+	done := make(chan error)
+	go func() { done <- srv.Shutdown(50 * time.Millisecond) }()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("shutdown blocked by idle connection")
+	}
+}
+
+func TestUnixListener(t *testing.T) {
+	dir, err := ioutil.TempDir("", "llconf-server-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "llconf.sock")
+	l, err := listen(util.Address{Network: "unix", Addr: path}, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		if c, err := net.Dial("unix", path); err == nil {
+			defer c.Close()
+			time.Sleep(100 * time.Millisecond)
+		}
+	}()
+
+	c, err := l.accept.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	client, err := identifyUnix(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if u, err := user.Current(); err == nil && client.CommonName != u.Username {
+		t.Errorf("expected client %q, got %q", u.Username, client.CommonName)
+	}
+
+	l.Close()
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Error("socket has not been removed")
+	}
+}
+
+func TestCheckRelay(t *testing.T) {
+	srv := New("127.0.0.1", 9954, nil, nil, true, "test")
+
+	data, err := wire.Encode(promise.NamedPromise{
+		Name:    "setup",
+		Promise: promise.ExecPromise{Type: promise.ExecChange, Arguments: []promise.Argument{promise.Constant("true")}},
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmd := RemoteCommand{Data: data, Target: "db1.internal"}
+
+	if _, err := srv.checkRelay(cmd, &peer{}, ""); err == nil {
+		t.Error("relayed without relay mode")
+	}
+
+	srv.EnableRelay([]string{"*.internal:9954", "ssh://*.internal", "ssh://root@*.internal"},
+		func(string) (net.Conn, error) {
+			return nil, nil
+		})
+
+	tests := []struct {
+		target string
+		policy store.Policy
+		ok     bool
+	}{
+		{"db1.internal", store.Policy{}, true},
+		{"tcp://db1.internal:9954", store.Policy{}, true},
+		{"db1.internal:22", store.Policy{}, false},
+		{"db1.example.com", store.Policy{}, false},
+		{"ssh://root@db1.internal", store.Policy{}, true},
+		{"ssh://-oProxyCommand=touch pwned;.internal", store.Policy{}, false},
+		{"ssh://-oProxyCommand=id.internal", store.Policy{}, false},
+		{"ssh://root@db1.internal pwned", store.Policy{}, false},
+		{"db1.internal", store.Policy{Relay: []string{"web*"}}, false},
+		{"db1.internal", store.Policy{Relay: []string{"db1.internal:9954"}}, true},
+		{"db1.internal", store.Policy{ReadOnly: true}, false},
+		{"db1.internal", store.Policy{Roots: []string{"setup"}}, true},
+		{"db1.internal", store.Policy{Deny: []string{"change"}}, false},
+	}
+
+	for i, test := range tests {
+		cmd.Target = test.target
+		_, err := srv.checkRelay(cmd, &peer{Policy: test.policy}, "")
+		if (err == nil) != test.ok {
+			t.Errorf("test %d: relay to %q with policy %s, unexpected result %v",
+				i, test.target, test.policy, err)
+		}
+	}
+}
+
+func TestVerifyCommand(t *testing.T) {
+	dir, err := ioutil.TempDir("", "llconf-server-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ds, err := store.New("server", "client", dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ds.Close()
+
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ds.AddPublisher("ci", pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})); err != nil {
+		t.Fatal(err)
+	}
+
+	srv := New("127.0.0.1", 9954, ds, nil, true, "test")
+	srv.SetNames([]string{"web1.internal"})
+
+	data := []byte("serialized promise tree")
+	tests := []struct {
+		targets  []string
+		notAfter time.Duration
+		relay    string
+		ok       bool
+	}{
+		{[]string{"web1.internal"}, time.Minute, "", true},
+		{[]string{"*.internal"}, time.Minute, "", true},
+		{[]string{"web2.internal"}, time.Minute, "", false},
+		{[]string{"web1.internal"}, -time.Minute, "", false},
+		{[]string{"db1.internal"}, time.Minute, "db1.internal", true},
+		{[]string{"db1.internal"}, time.Minute, "ssh://root@db1.internal", true},
+		{[]string{"web1.internal"}, time.Minute, "db1.internal", false},
+	}
+
+	for i, test := range tests {
+		e := bundle.Envelope{Data: data, Targets: test.targets, NotAfter: time.Now().Add(test.notAfter)}
+		sig, err := bundle.Sign(e, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		cmd := RemoteCommand{Data: data, Signature: sig, Targets: e.Targets, NotAfter: e.NotAfter, Target: test.relay}
+		publisher, err := srv.verifyCommand(cmd, data)
+		if (err == nil) != test.ok || (err == nil && publisher != "ci") {
+			t.Errorf("test %d: %v relayed to %q, unexpected result %q %v",
+				i, test.targets, test.relay, publisher, err)
+		}
+
+		// the envelope is signed, so its targets cannot be widened
+		cmd.Targets = []string{"*"}
+		if _, err := srv.verifyCommand(cmd, data); err == nil {
+			t.Errorf("test %d: widened targets accepted", i)
+		}
+	}
+}
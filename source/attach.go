@@ -0,0 +1,116 @@
+package source
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/denkhaus/llconf/wire"
+	"github.com/juju/errors"
+)
+
+// MaxAttachmentSize limits the size of a single attached file.
+const MaxAttachmentSize = 64 << 20
+
+////////////////////////////////////////////////////////////////////////////////
+// Attachments describes the files at paths by the names they are attached
+// as and returns the local path of every name. Files below dir keep their
+// path relative to dir, all others are attached by their base name.
+func Attachments(dir string, paths []string) ([]wire.SourceFile, map[string]string, error) {
+	files := []wire.SourceFile{}
+	local := map[string]string{}
+
+	for _, path := range paths {
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(dir, path)
+		}
+
+		name := filepath.Base(path)
+		if rel, err := filepath.Rel(dir, path); err == nil && !strings.HasPrefix(rel, "..") {
+			name = filepath.ToSlash(rel)
+		}
+
+		if prev, ok := local[name]; ok {
+			if prev == path {
+				continue
+			}
+			return nil, nil, errors.Errorf("%q and %q are both attached as %q", prev, path, name)
+		}
+
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, nil, errors.Annotatef(err, "read attachment %q", path)
+		}
+
+		if len(data) > MaxAttachmentSize {
+			return nil, nil, errors.Errorf("attachment %q exceeds %d bytes", path, MaxAttachmentSize)
+		}
+
+		files = append(files, wire.SourceFile{Path: name, Hash: Hash(data)})
+		local[name] = path
+	}
+
+	return files, local, nil
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// StageAttachments writes the attached files read from streams into a new
+// temporary folder, which has to be removed by the caller. Every file of
+// manifest has to be streamed and match its hash.
+func StageAttachments(manifest []wire.SourceFile, streams map[string]io.Reader) (string, error) {
+	dir, err := ioutil.TempDir("", "llconf-bundle")
+	if err != nil {
+		return "", errors.Annotate(err, "create bundle dir")
+	}
+
+	for _, f := range manifest {
+		if err := stageAttachment(dir, f, streams[f.Path]); err != nil {
+			os.RemoveAll(dir)
+			return "", errors.Annotatef(err, "attachment %q", f.Path)
+		}
+	}
+
+	return dir, nil
+}
+
+func stageAttachment(dir string, f wire.SourceFile, stream io.Reader) error {
+	rel, err := checkFile(f)
+	if err != nil {
+		return err
+	}
+
+	if stream == nil {
+		return errors.New("content not sent")
+	}
+
+	path := filepath.Join(dir, rel)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return errors.Annotate(err, "create dir")
+	}
+
+	out, err := os.Create(path)
+	if err != nil {
+		return errors.Annotate(err, "create file")
+	}
+	defer out.Close()
+
+	hash := sha256.New()
+	n, err := io.Copy(io.MultiWriter(out, hash), io.LimitReader(stream, MaxAttachmentSize+1))
+	if err != nil {
+		return errors.Annotate(err, "copy content")
+	}
+
+	if n > MaxAttachmentSize {
+		return errors.Errorf("exceeds %d bytes", MaxAttachmentSize)
+	}
+
+	if hex.EncodeToString(hash.Sum(nil)) != f.Hash {
+		return errors.New("content does not match its hash")
+	}
+
+	return out.Close()
+}
@@ -0,0 +1,67 @@
+package source
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestAttachAndStage(t *testing.T) {
+	root, err := ioutil.TempDir("", "llconf-attach-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	input := filepath.Join(root, "input")
+	write(t, filepath.Join(input, "conf", "site.tmpl"), `{{.name}}`)
+	write(t, filepath.Join(root, "setup.sh"), `#!/bin/sh`)
+
+	files, local, err := Attachments(input, []string{"conf/site.tmpl", filepath.Join(root, "setup.sh")})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(files) != 2 || files[0].Path != "conf/site.tmpl" || files[1].Path != "setup.sh" {
+		t.Fatalf("unexpected attachments %v", files)
+	}
+
+	streams := map[string]io.Reader{}
+	for name, path := range local {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		streams[name] = bytes.NewReader(data)
+	}
+
+	dir, err := StageAttachments(files, streams)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	data, err := ioutil.ReadFile(filepath.Join(dir, "conf", "site.tmpl"))
+	if err != nil || string(data) != `{{.name}}` {
+		t.Errorf("attachment not staged: %q %v", data, err)
+	}
+
+	streams["setup.sh"] = bytes.NewReader([]byte("tampered"))
+	streams["conf/site.tmpl"] = bytes.NewReader([]byte(`{{.name}}`))
+	if _, err := StageAttachments(files, streams); err == nil {
+		t.Error("expected hash mismatch")
+	}
+
+	delete(streams, "setup.sh")
+	if _, err := StageAttachments(files, streams); err == nil {
+		t.Error("expected missing content error")
+	}
+
+	files[0].Path = "../escape"
+	if _, err := StageAttachments(files[:1], streams); err == nil {
+		t.Error("expected invalid path error")
+	}
+}
@@ -0,0 +1,256 @@
+// Package source collects the promise files of an input folder into
+// content addressed bundles and caches their contents by hash on the
+// receiving side, so unchanged files are sent only once.
+package source
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/denkhaus/llconf/promise"
+	"github.com/denkhaus/llconf/wire"
+	"github.com/juju/errors"
+)
+
+////////////////////////////////////////////////////////////////////////////////
+// Hash returns the hex encoded sha256 sum of data.
+func Hash(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// Collect returns the manifest and the contents by hash of all .cnf files
+// below dir and of the files in extra, given relative to dir.
+func Collect(dir string, root string, extra []string) (wire.Source, map[string][]byte, error) {
+	s := wire.Source{Root: root, Files: []wire.SourceFile{}}
+	contents := map[string][]byte{}
+
+	paths, err := listFiles(dir, ".cnf")
+	if err != nil {
+		return s, nil, errors.Annotate(err, "list files")
+	}
+
+	seen := map[string]bool{}
+	for _, rel := range append(paths, extra...) {
+		if seen[rel] {
+			continue
+		}
+		seen[rel] = true
+
+		data, err := ioutil.ReadFile(filepath.Join(dir, rel))
+		if err != nil {
+			return s, nil, errors.Annotatef(err, "read %q", rel)
+		}
+
+		hash := Hash(data)
+		contents[hash] = data
+		s.Files = append(s.Files, wire.SourceFile{Path: filepath.ToSlash(rel), Hash: hash})
+	}
+
+	return s, contents, nil
+}
+
+// listFiles returns the paths of all files below dir with suffix,
+// relative to dir. Symlinked folders are followed once, hidden
+// folders like .git are skipped.
+func listFiles(dir string, suffix string) ([]string, error) {
+	files := []string{}
+	visited := map[string]bool{}
+
+	var walk func(real, rel string) error
+	walk = func(real, rel string) error {
+		resolved, err := filepath.EvalSymlinks(real)
+		if err != nil {
+			return err
+		}
+		if visited[resolved] {
+			return nil
+		}
+		visited[resolved] = true
+
+		infos, err := ioutil.ReadDir(resolved)
+		if err != nil {
+			return err
+		}
+
+		for _, info := range infos {
+			name := info.Name()
+			path := filepath.Join(resolved, name)
+
+			if info.Mode()&os.ModeSymlink != 0 {
+				if info, err = os.Stat(path); err != nil {
+					return err
+				}
+			}
+
+			switch {
+			case info.IsDir() && !strings.HasPrefix(name, "."):
+				if err := walk(path, filepath.Join(rel, name)); err != nil {
+					return err
+				}
+			case !info.IsDir() && strings.HasSuffix(name, suffix):
+				files = append(files, filepath.Join(rel, name))
+			}
+		}
+
+		return nil
+	}
+
+	if err := walk(dir, ""); err != nil {
+		return nil, err
+	}
+
+	sort.Strings(files)
+	return files, nil
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// Templates returns the template files of all (template) promises in tree
+// with a constant relative path that exist below dir.
+func Templates(tree promise.Promise, dir string) []string {
+	templates := []string{}
+
+	promise.Walk(tree, func(p promise.Promise) error {
+		t, ok := p.(promise.TemplatePromise)
+		if !ok {
+			return nil
+		}
+
+		file, ok := t.TemplateFile.(promise.Constant)
+		if !ok || filepath.IsAbs(string(file)) {
+			return nil
+		}
+
+		rel := filepath.Clean(string(file))
+		if strings.HasPrefix(rel, "..") {
+			return nil
+		}
+
+		if _, err := os.Stat(filepath.Join(dir, rel)); err == nil {
+			templates = append(templates, rel)
+		}
+		return nil
+	})
+
+	return templates
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// Cache stores the contents of source files by hash.
+type Cache struct {
+	dir string
+}
+
+////////////////////////////////////////////////////////////////////////////////
+func OpenCache(dir string) (*Cache, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, errors.Annotate(err, "create cache dir")
+	}
+
+	return &Cache{dir: dir}, nil
+}
+
+func (c *Cache) path(hash string) string {
+	return filepath.Join(c.dir, hash)
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// Missing returns the sorted hashes of all files of s not cached yet.
+func (c *Cache) Missing(s wire.Source) []string {
+	missing := []string{}
+	seen := map[string]bool{}
+
+	for _, f := range s.Files {
+		if seen[f.Hash] {
+			continue
+		}
+		seen[f.Hash] = true
+
+		if _, err := os.Stat(c.path(f.Hash)); err != nil {
+			missing = append(missing, f.Hash)
+		}
+	}
+
+	sort.Strings(missing)
+	return missing
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// Put caches data under its hash.
+func (c *Cache) Put(data []byte) error {
+	tmp, err := ioutil.TempFile(c.dir, ".put")
+	if err != nil {
+		return errors.Annotate(err, "create temp file")
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return errors.Annotate(err, "write temp file")
+	}
+
+	if err := tmp.Close(); err != nil {
+		return errors.Annotate(err, "close temp file")
+	}
+
+	return os.Rename(tmp.Name(), c.path(Hash(data)))
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// Stage writes the files of s into a new temporary folder, which
+// has to be removed by the caller.
+func (c *Cache) Stage(s wire.Source) (string, error) {
+	dir, err := ioutil.TempDir("", "llconf-source")
+	if err != nil {
+		return "", errors.Annotate(err, "create stage dir")
+	}
+
+	for _, f := range s.Files {
+		rel, err := checkFile(f)
+		if err != nil {
+			os.RemoveAll(dir)
+			return "", err
+		}
+
+		data, err := ioutil.ReadFile(c.path(f.Hash))
+		if err != nil {
+			os.RemoveAll(dir)
+			return "", errors.Annotatef(err, "read cached %q", f.Path)
+		}
+
+		path := filepath.Join(dir, rel)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			os.RemoveAll(dir)
+			return "", errors.Annotate(err, "create source dir")
+		}
+
+		if err := ioutil.WriteFile(path, data, 0644); err != nil {
+			os.RemoveAll(dir)
+			return "", errors.Annotatef(err, "write %q", f.Path)
+		}
+	}
+
+	return dir, nil
+}
+
+// checkFile validates the hash of f and returns its
+// path, which must not leave the folder it is staged in.
+func checkFile(f wire.SourceFile) (string, error) {
+	rel := filepath.Clean(filepath.FromSlash(f.Path))
+	if filepath.IsAbs(rel) || rel == "." || rel == ".." ||
+		strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", errors.Errorf("invalid path %q", f.Path)
+	}
+
+	if b, err := hex.DecodeString(f.Hash); err != nil || len(b) != sha256.Size {
+		return "", errors.Errorf("invalid hash %q of %q", f.Hash, f.Path)
+	}
+
+	return rel, nil
+}
@@ -0,0 +1,111 @@
+package source
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/denkhaus/llconf/promise"
+	"github.com/denkhaus/llconf/wire"
+)
+
+func write(t *testing.T, path string, content string) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCollectAndStage(t *testing.T) {
+	root, err := ioutil.TempDir("", "llconf-source-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	input := filepath.Join(root, "input")
+	write(t, filepath.Join(input, "main.cnf"), `(done (test "true"))`)
+	write(t, filepath.Join(input, "vendor", "nginx", "module.cnf"), `(export "x") (x (test "true"))`)
+	write(t, filepath.Join(input, "copy.cnf"), `(done (test "true"))`)
+	write(t, filepath.Join(input, "site.tmpl"), `{{.name}}`)
+	write(t, filepath.Join(input, ".git", "config.cnf"), `ignored`)
+
+	tree := promise.TemplatePromise{
+		JsonInput:    promise.Constant("{}"),
+		TemplateFile: promise.Constant("site.tmpl"),
+		Output:       promise.Constant("/tmp/out"),
+	}
+
+	manifest, contents, err := Collect(input, "done", Templates(tree, input))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(manifest.Files) != 4 {
+		t.Fatalf("expected 4 files, got %v", manifest.Files)
+	}
+	if len(contents) != 3 {
+		t.Errorf("expected 3 distinct contents, got %d", len(contents))
+	}
+
+	cache, err := OpenCache(filepath.Join(root, "cache"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	missing := cache.Missing(manifest)
+	if len(missing) != 3 {
+		t.Fatalf("expected 3 missing hashes, got %v", missing)
+	}
+
+	for _, hash := range missing {
+		if err := cache.Put(contents[hash]); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if missing := cache.Missing(manifest); len(missing) != 0 {
+		t.Errorf("expected complete cache, missing %v", missing)
+	}
+
+	dir, err := cache.Stage(manifest)
+	if err != nil {
+		t.Fatalf("stage: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	data, err := ioutil.ReadFile(filepath.Join(dir, "vendor", "nginx", "module.cnf"))
+	if err != nil || string(data) != `(export "x") (x (test "true"))` {
+		t.Errorf("staged module differs: %q %v", data, err)
+	}
+}
+
+func TestStageInvalid(t *testing.T) {
+	root, err := ioutil.TempDir("", "llconf-source-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	cache, err := OpenCache(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := []byte("content")
+	cache.Put(data)
+
+	for _, f := range []wire.SourceFile{
+		{Path: "../escape.cnf", Hash: Hash(data)},
+		{Path: "/etc/escape.cnf", Hash: Hash(data)},
+		{Path: "main.cnf", Hash: "../../etc/passwd"},
+	} {
+		if dir, err := cache.Stage(wire.Source{Files: []wire.SourceFile{f}}); err == nil {
+			os.RemoveAll(dir)
+			t.Errorf("expected %v to be rejected", f)
+		}
+	}
+}
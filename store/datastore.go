@@ -1,44 +1,106 @@
 package store
 
 import (
+	"crypto/rsa"
+	"crypto/sha256"
 	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
 	"fmt"
 	"io/ioutil"
+	"math/big"
+	"os"
 	"path"
+	"sort"
+	"strings"
+	"time"
 
 	"github.com/juju/errors"
 
 	"github.com/boltdb/bolt"
+	"github.com/denkhaus/llconf/bundle"
+	"github.com/denkhaus/llconf/ca"
 	"github.com/denkhaus/llconf/logging"
 	"github.com/djherbis/stow"
 )
 
 type CertEntry struct {
+	Data   []byte
+	Policy Policy
+}
+
+type TokenEntry struct {
+	Expires time.Time
+	Used    bool
+}
+
+type PublisherEntry struct {
 	Data []byte
 }
 
+type RevokedEntry struct {
+	Serial    string
+	RevokedAt time.Time
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// CertInfo describes a stored certificate.
+type CertInfo struct {
+	ID          string
+	Subject     string
+	Serial      string
+	Fingerprint string
+	NotAfter    time.Time
+	Revoked     bool
+	Policy      Policy
+}
+
 ////////////////////////////////////////////////////////////////////////////////
 type DataStore struct {
-	db        *bolt.DB
-	role      string
-	certStore *stow.Store
-	serverCS  *stow.Store
+	db             *bolt.DB
+	role           string
+	certStore      *stow.Store
+	revokedStore   *stow.Store
+	tokenStore     *stow.Store
+	publisherStore *stow.Store
+	serverCS       *stow.Store
+	pendingPath    string
 }
 
+// openTimeout is the time New waits for the lock of a
+// datastore held by another process, eg. a running server.
+var openTimeout = 5 * time.Second
+
+// ErrLocked is returned by New if another process, eg. a
+// running server, holds the lock of the datastore.
+var ErrLocked = errors.New("datastore is locked by a running server")
+
 ////////////////////////////////////////////////////////////////////////////////
 func New(id, role, storePath string) (*DataStore, error) {
 
+	pendingPath := pendingDir(id, storePath)
 	storePath = path.Join(storePath, fmt.Sprintf("%s.store.db", id))
-	db, err := bolt.Open(storePath, 0600, nil)
+	db, err := bolt.Open(storePath, 0600, &bolt.Options{Timeout: openTimeout})
+	if err == bolt.ErrTimeout {
+		return nil, errors.Annotatef(ErrLocked, "open %s", storePath)
+	}
 	if err != nil {
 		return nil, err
 	}
 
 	certStore := stow.NewStore(db, []byte("certs"))
+	revokedStore := stow.NewStore(db, []byte("revoked"))
+	tokenStore := stow.NewStore(db, []byte("tokens"))
+	publisherStore := stow.NewStore(db, []byte("publishers"))
 	store := &DataStore{
-		db:        db,
-		role:      role,
-		certStore: certStore,
+		db:             db,
+		role:           role,
+		certStore:      certStore,
+		revokedStore:   revokedStore,
+		tokenStore:     tokenStore,
+		publisherStore: publisherStore,
+		pendingPath:    pendingPath,
 	}
 
 	return store, nil
@@ -76,11 +138,115 @@ func (d *DataStore) Pool() (*x509.CertPool, error) {
 }
 
 ////////////////////////////////////////////////////////////////////////////////
-func (d *DataStore) StoreCert(id string, certPath string) error {
+// StoreCert stores the certificates of certPath under id. An existing
+// entry is only overwritten if replace is set, eg. to trust the bundle
+// of a rotated certificate.
+func (d *DataStore) StoreCert(id string, certPath string, replace bool) error {
 	data, err := ioutil.ReadFile(certPath)
 	if err != nil {
 		return errors.Annotatef(err, "load %s cert file", d.role)
 	}
+
+	return d.storeCert(id, data, replace)
+}
+
+func (d *DataStore) storeCert(id string, data []byte, replace bool) error {
+	if replace {
+		entry := CertEntry{}
+		d.certStore.Get(id, &entry)
+		entry.Data = data
+		return d.certStore.Put(id, entry)
+	}
+
+	return d.StoreCertData(id, data)
+}
+
+// pendingCert is a certificate queued for a locked datastore.
+type pendingCert struct {
+	ID      string
+	Data    []byte
+	Replace bool
+}
+
+// pendingDir returns the folder certificates for the
+// locked datastore id in storePath are queued in.
+func pendingDir(id, storePath string) string {
+	return path.Join(storePath, fmt.Sprintf("%s.pending", id))
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// QueueCert queues the certificates of certPath for the datastore id in
+// storePath while a running server holds its lock. The server stores them
+// under certID before it accepts the next connection.
+func QueueCert(id, storePath, certID, certPath string, replace bool) error {
+	data, err := ioutil.ReadFile(certPath)
+	if err != nil {
+		return errors.Annotate(err, "load cert file")
+	}
+
+	buf, err := json.Marshal(pendingCert{ID: certID, Data: data, Replace: replace})
+	if err != nil {
+		return errors.Annotate(err, "encode cert")
+	}
+
+	dir := pendingDir(id, storePath)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return errors.Annotate(err, "create queue dir")
+	}
+
+	// the name keeps the queue in order, the rename makes the entry
+	// visible to the server only once it is complete
+	name := fmt.Sprintf("%020d-%s", time.Now().UnixNano(), tokenKey(certID)[:16])
+	tmp := path.Join(dir, "."+name)
+	if err := ioutil.WriteFile(tmp, buf, 0600); err != nil {
+		return errors.Annotate(err, "write queue entry")
+	}
+
+	return os.Rename(tmp, path.Join(dir, name+".json"))
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// ImportPending stores the certificates queued by QueueCert. Entries that
+// cannot be stored are logged and dropped.
+func (d *DataStore) ImportPending() error {
+	files, err := ioutil.ReadDir(d.pendingPath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return errors.Annotate(err, "read queue dir")
+	}
+
+	for _, f := range files {
+		if !strings.HasSuffix(f.Name(), ".json") {
+			continue
+		}
+
+		entryPath := path.Join(d.pendingPath, f.Name())
+		buf, err := ioutil.ReadFile(entryPath)
+		if err != nil {
+			return errors.Annotate(err, "read queue entry")
+		}
+
+		pc := pendingCert{}
+		if err := json.Unmarshal(buf, &pc); err != nil {
+			logging.Logger.Errorf("unable to decode queued %s certificate %q: %s", d.role, f.Name(), err)
+		} else if err := d.storeCert(pc.ID, pc.Data, pc.Replace); err != nil {
+			logging.Logger.Errorf("unable to store queued %s certificate for id %q: %s", d.role, pc.ID, err)
+		} else {
+			logging.Logger.Infof("stored queued %s certificate for id %q", d.role, pc.ID)
+		}
+
+		if err := os.Remove(entryPath); err != nil {
+			return errors.Annotate(err, "remove queue entry")
+		}
+	}
+
+	return nil
+}
+
+////////////////////////////////////////////////////////////////////////////////
+func (d *DataStore) StoreCertData(id string, data []byte) error {
 	entry := CertEntry{}
 	if err := d.certStore.Get(id, &entry); err == nil {
 		return errors.Errorf("certificate for %s id %q already stored", d.role, id)
@@ -103,3 +269,393 @@ func (d *DataStore) RemoveCert(id string) error {
 
 	return nil
 }
+
+////////////////////////////////////////////////////////////////////////////////
+func (d *DataStore) certificates() (map[string][]*x509.Certificate, error) {
+	certs, _, err := d.entries()
+	return certs, err
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// entries returns the parsed certificates and the policies of all entries.
+func (d *DataStore) entries() (map[string][]*x509.Certificate, map[string]Policy, error) {
+	certs := map[string][]*x509.Certificate{}
+	policies := map[string]Policy{}
+
+	err := d.certStore.ForEach(func(id string, entry CertEntry) {
+		policies[id] = entry.Policy
+
+		data := entry.Data
+		for {
+			var block *pem.Block
+			if block, data = pem.Decode(data); block == nil {
+				break
+			}
+
+			if block.Type != "CERTIFICATE" {
+				continue
+			}
+
+			cert, err := x509.ParseCertificate(block.Bytes)
+			if err != nil {
+				logging.Logger.Errorf("unable to parse %s certificate for id %q: %s", d.role, id, err)
+				continue
+			}
+			certs[id] = append(certs[id], cert)
+		}
+	})
+	if err != nil {
+		return nil, nil, errors.Annotate(err, "enumerate cert entries")
+	}
+
+	return certs, policies, nil
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// SetPolicy stores policy with the certificate entry of id.
+func (d *DataStore) SetPolicy(id string, policy Policy) error {
+	entry := CertEntry{}
+	if err := d.certStore.Get(id, &entry); err != nil {
+		return errors.Errorf("certificate for %s id %q not available", d.role, id)
+	}
+
+	entry.Policy = policy
+	return d.certStore.Put(id, entry)
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// Identify returns the id and policy of the entry a peer was verified by.
+// An entry holding the peer certificate itself is preferred over
+// an entry holding one of its issuers.
+func (d *DataStore) Identify(verifiedChains [][]*x509.Certificate) (string, Policy, error) {
+	certs, policies, err := d.entries()
+	if err != nil {
+		return "", Policy{}, errors.Annotate(err, "get entries")
+	}
+
+	ids := []string{}
+	for id := range certs {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	find := func(cert *x509.Certificate) (string, bool) {
+		for _, id := range ids {
+			for _, stored := range certs[id] {
+				if stored.Equal(cert) {
+					return id, true
+				}
+			}
+		}
+		return "", false
+	}
+
+	for _, chain := range verifiedChains {
+		if len(chain) > 0 {
+			if id, ok := find(chain[0]); ok {
+				return id, policies[id], nil
+			}
+		}
+	}
+
+	for _, chain := range verifiedChains {
+		for _, cert := range chain {
+			if id, ok := find(cert); ok {
+				return id, policies[id], nil
+			}
+		}
+	}
+
+	return "", Policy{}, errors.New("no certificate entry matches peer")
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// Certs returns all stored certificates sorted by id.
+func (d *DataStore) Certs() ([]CertInfo, error) {
+	certs, policies, err := d.entries()
+	if err != nil {
+		return nil, errors.Annotate(err, "get entries")
+	}
+
+	infos := []CertInfo{}
+	for id, list := range certs {
+		for _, cert := range list {
+			serial := ca.SerialString(cert.SerialNumber)
+			revoked, err := d.IsRevoked(serial)
+			if err != nil {
+				return nil, errors.Annotate(err, "is revoked")
+			}
+
+			infos = append(infos, CertInfo{
+				ID:          id,
+				Subject:     cert.Subject.String(),
+				Serial:      serial,
+				Fingerprint: ca.Fingerprint(cert),
+				NotAfter:    cert.NotAfter,
+				Revoked:     revoked,
+				Policy:      policies[id],
+			})
+		}
+	}
+
+	sort.Sort(certInfos(infos))
+	return infos, nil
+}
+
+type certInfos []CertInfo
+
+func (c certInfos) Len() int           { return len(c) }
+func (c certInfos) Swap(i, j int)      { c[i], c[j] = c[j], c[i] }
+func (c certInfos) Less(i, j int) bool { return c[i].ID < c[j].ID }
+
+////////////////////////////////////////////////////////////////////////////////
+// WarnExpiring logs a warning for every stored certificate
+// expiring within ca.ExpiryWarning.
+func (d *DataStore) WarnExpiring() error {
+	certs, err := d.certificates()
+	if err != nil {
+		return errors.Annotate(err, "get certificates")
+	}
+
+	for id, list := range certs {
+		for _, cert := range list {
+			if ca.ExpiresSoon(cert) {
+				logging.Logger.Warnf("%s certificate %q for id %q expires on %s",
+					d.role, cert.Subject.CommonName, id, cert.NotAfter.Format(time.RFC3339))
+			}
+		}
+	}
+
+	return nil
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// Revoke adds serial to the revocation list.
+func (d *DataStore) Revoke(serial string) error {
+	n, ok := new(big.Int).SetString(strings.Replace(serial, ":", "", -1), 16)
+	if !ok {
+		return errors.Errorf("invalid serial %q", serial)
+	}
+
+	serial = ca.SerialString(n)
+	entry := RevokedEntry{Serial: serial, RevokedAt: time.Now()}
+	if err := d.revokedStore.Put(serial, entry); err != nil {
+		return errors.Annotatef(err, "store revoked serial %q", serial)
+	}
+
+	return nil
+}
+
+////////////////////////////////////////////////////////////////////////////////
+func (d *DataStore) IsRevoked(serial string) (bool, error) {
+	entry := RevokedEntry{}
+	if err := d.revokedStore.Get(serial, &entry); err != nil {
+		if err == stow.ErrNotFound {
+			return false, nil
+		}
+		return false, errors.Annotate(err, "get revoked entry")
+	}
+
+	return true, nil
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// ImportCRL adds all serials of a revocation list signed by
+// a stored certificate to the revocation list.
+func (d *DataStore) ImportCRL(data []byte) (int, error) {
+	crl, err := x509.ParseCRL(data)
+	if err != nil {
+		return 0, errors.Annotate(err, "parse crl")
+	}
+
+	certs, err := d.certificates()
+	if err != nil {
+		return 0, errors.Annotate(err, "get certificates")
+	}
+
+	trusted := false
+	for _, list := range certs {
+		for _, cert := range list {
+			if err := cert.CheckCRLSignature(crl); err == nil {
+				trusted = true
+			}
+		}
+	}
+
+	if !trusted {
+		return 0, errors.New("crl is not signed by a stored certificate")
+	}
+
+	if crl.HasExpired(time.Now()) {
+		logging.Logger.Warn("crl is outdated, import it anyway")
+	}
+
+	for _, revoked := range crl.TBSCertList.RevokedCertificates {
+		if err := d.Revoke(ca.SerialString(revoked.SerialNumber)); err != nil {
+			return 0, errors.Annotate(err, "revoke")
+		}
+	}
+
+	return len(crl.TBSCertList.RevokedCertificates), nil
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// VerifyPeerCertificate rejects verified chains containing revoked
+// certificates and warns about expiring peer certificates. It is
+// meant to be used as tls.Config.VerifyPeerCertificate.
+func (d *DataStore) VerifyPeerCertificate(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+	for _, chain := range verifiedChains {
+		for _, cert := range chain {
+			revoked, err := d.IsRevoked(ca.SerialString(cert.SerialNumber))
+			if err != nil {
+				return errors.Annotate(err, "is revoked")
+			}
+
+			if revoked {
+				return errors.Errorf("certificate %q with serial %s is revoked",
+					cert.Subject.CommonName, ca.SerialString(cert.SerialNumber))
+			}
+		}
+
+		if len(chain) > 0 && ca.ExpiresSoon(chain[0]) {
+			logging.Logger.Warnf("peer certificate %q expires on %s",
+				chain[0].Subject.CommonName, chain[0].NotAfter.Format(time.RFC3339))
+		}
+	}
+
+	return nil
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// AddPublisher trusts bundles signed by the key of the
+// PEM encoded certificate or public key data.
+func (d *DataStore) AddPublisher(id string, data []byte) error {
+	if _, err := bundle.PublicKey(data); err != nil {
+		return errors.Annotate(err, "public key")
+	}
+
+	entry := PublisherEntry{}
+	if err := d.publisherStore.Get(id, &entry); err == nil {
+		return errors.Errorf("publisher %q already stored", id)
+	}
+
+	entry.Data = data
+	return d.publisherStore.Put(id, entry)
+}
+
+////////////////////////////////////////////////////////////////////////////////
+func (d *DataStore) RemovePublisher(id string) error {
+	entry := PublisherEntry{}
+	if err := d.publisherStore.Get(id, &entry); err != nil {
+		return errors.Errorf("publisher %q not available", id)
+	}
+
+	if err := d.publisherStore.Delete(id); err != nil {
+		return errors.Annotatef(err, "delete publisher %q", id)
+	}
+
+	return nil
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// Publishers returns the keys of all trusted publishers by id.
+func (d *DataStore) Publishers() (map[string]*rsa.PublicKey, error) {
+	keys := map[string]*rsa.PublicKey{}
+
+	err := d.publisherStore.ForEach(func(id string, entry PublisherEntry) {
+		key, err := bundle.PublicKey(entry.Data)
+		if err != nil {
+			logging.Logger.Errorf("unable to parse key of publisher %q: %s", id, err)
+			return
+		}
+		keys[id] = key
+	})
+	if err != nil {
+		return nil, errors.Annotate(err, "enumerate publisher entries")
+	}
+
+	return keys, nil
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// VerifyBundle returns the publisher e was signed by. Unsigned envelopes
+// are accepted with an empty publisher as long as no publisher is trusted.
+func (d *DataStore) VerifyBundle(e bundle.Envelope, signature []byte) (string, error) {
+	keys, err := d.Publishers()
+	if err != nil {
+		return "", errors.Annotate(err, "get publishers")
+	}
+
+	if len(keys) == 0 {
+		return "", nil
+	}
+
+	return bundle.Verify(e, signature, keys)
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// tokenKey returns the key a token is stored by, so
+// the token itself is never written to disk.
+func tokenKey(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// AddToken registers an enrollment token valid until expires. A token
+// that is already known keeps its expiry and usage, so restarting
+// with the same token cannot revive it.
+func (d *DataStore) AddToken(token string, expires time.Time) (TokenEntry, error) {
+	entry := TokenEntry{}
+	if err := d.tokenStore.Get(tokenKey(token), &entry); err == nil {
+		return entry, nil
+	} else if err != stow.ErrNotFound {
+		return entry, errors.Annotate(err, "get token")
+	}
+
+	entry.Expires = expires
+	if err := d.tokenStore.Put(tokenKey(token), entry); err != nil {
+		return entry, errors.Annotate(err, "put token")
+	}
+
+	return entry, nil
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// CheckToken returns an error if token is unknown, used or expired.
+func (d *DataStore) CheckToken(token string) error {
+	entry := TokenEntry{}
+	if err := d.tokenStore.Get(tokenKey(token), &entry); err != nil {
+		return errors.New("unknown token")
+	}
+
+	if entry.Used {
+		return errors.New("token already used")
+	}
+
+	if time.Now().After(entry.Expires) {
+		return errors.New("token expired")
+	}
+
+	return nil
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// UseToken marks a valid token as used.
+func (d *DataStore) UseToken(token string) error {
+	if err := d.CheckToken(token); err != nil {
+		return err
+	}
+
+	entry := TokenEntry{}
+	if err := d.tokenStore.Get(tokenKey(token), &entry); err != nil {
+		return errors.Annotate(err, "get token")
+	}
+
+	entry.Used = true
+	if err := d.tokenStore.Put(tokenKey(token), entry); err != nil {
+		return errors.Annotate(err, "put token")
+	}
+
+	return nil
+}
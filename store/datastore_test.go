@@ -0,0 +1,85 @@
+package store
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"path/filepath"
+	"time"
+
+	"github.com/juju/errors"
+)
+
+func TestNewLocked(t *testing.T) {
+	dir, err := ioutil.TempDir("", "llconf-store")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ds, err := New("server", "client", dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ds.Close()
+
+	defer func(timeout time.Duration) { openTimeout = timeout }(openTimeout)
+	openTimeout = 50 * time.Millisecond
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := New("server", "client", dir)
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		if errors.Cause(err) != ErrLocked || !strings.Contains(err.Error(), "locked by a running server") {
+			t.Errorf("expected locked error, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("open of locked datastore blocked")
+	}
+}
+
+func TestQueueCert(t *testing.T) {
+	dir, err := ioutil.TempDir("", "llconf-store")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ds, err := New("server", "client", dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ds.Close()
+
+	if err := ds.StoreCertData("web1", []byte("old")); err != nil {
+		t.Fatal(err)
+	}
+
+	certPath := filepath.Join(dir, "web1.cert.pem")
+	for _, content := range []string{"next", "bundle"} {
+		if err := ioutil.WriteFile(certPath, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := QueueCert("server", dir, "web1", certPath, true); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := ds.ImportPending(); err != nil {
+		t.Fatal(err)
+	}
+
+	entry := CertEntry{}
+	if err := ds.certStore.Get("web1", &entry); err != nil || string(entry.Data) != "bundle" {
+		t.Errorf("queued certificates not stored in order: %q %v", entry.Data, err)
+	}
+
+	if files, _ := ioutil.ReadDir(pendingDir("server", dir)); len(files) != 0 {
+		t.Errorf("%d queue entries left", len(files))
+	}
+}
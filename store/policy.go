@@ -0,0 +1,130 @@
+package store
+
+import (
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/denkhaus/llconf/promise"
+	"github.com/juju/errors"
+)
+
+////////////////////////////////////////////////////////////////////////////////
+// Policy restricts what a client may run on the server. Empty
+// Roots and Builtins allow everything, Deny forbids builtins
+// even if they are allowed by Builtins. Relay restricts the
+// targets a relay forwards commands of the client to.
+//
+// The client writes unsigned trees itself, so Roots only restricts
+// the names of their root promises, and read-only clients may only
+// run commands of trees signed by a trusted publisher.
+type Policy struct {
+	Roots    []string
+	Builtins []string
+	Deny     []string
+	Relay    []string
+	ReadOnly bool
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// IsEmpty reports whether p restricts nothing.
+func (p Policy) IsEmpty() bool {
+	return len(p.Roots) == 0 && len(p.Builtins) == 0 &&
+		len(p.Deny) == 0 && len(p.Relay) == 0 && !p.ReadOnly
+}
+
+////////////////////////////////////////////////////////////////////////////////
+func (p Policy) String() string {
+	if p.IsEmpty() {
+		return "-"
+	}
+
+	parts := []string{}
+	if len(p.Roots) > 0 {
+		parts = append(parts, fmt.Sprintf("roots=%s", strings.Join(p.Roots, ",")))
+	}
+	if len(p.Builtins) > 0 {
+		parts = append(parts, fmt.Sprintf("allow=%s", strings.Join(p.Builtins, ",")))
+	}
+	if len(p.Deny) > 0 {
+		parts = append(parts, fmt.Sprintf("deny=%s", strings.Join(p.Deny, ",")))
+	}
+	if len(p.Relay) > 0 {
+		parts = append(parts, fmt.Sprintf("relay=%s", strings.Join(p.Relay, ",")))
+	}
+	if p.ReadOnly {
+		parts = append(parts, "read-only")
+	}
+
+	return strings.Join(parts, " ")
+}
+
+// execBuiltins run commands given by the promise tree, even in read-only
+// mode, or evaluate promise files, which may have been attached.
+var execBuiltins = []string{"test", "change", "pipe", "spipe", "readvar", "eval"}
+
+////////////////////////////////////////////////////////////////////////////////
+// Check returns an error if the promise tree root violates p. Signed
+// reports whether root has been signed by a trusted publisher.
+func (p Policy) Check(root promise.NamedPromise, signed bool) error {
+	if len(p.Roots) > 0 && !contains(p.Roots, root.Name) {
+		return errors.Errorf("root promise %q not allowed", root.Name)
+	}
+
+	return promise.Walk(root, func(pr promise.Promise) error {
+		name := promise.BuiltinName(pr)
+		if name == "" {
+			return nil
+		}
+
+		if len(p.Builtins) > 0 && !contains(p.Builtins, name) {
+			return errors.Errorf("builtin (%s) not allowed", name)
+		}
+		if contains(p.Deny, name) {
+			return errors.Errorf("builtin (%s) denied", name)
+		}
+		if p.ReadOnly && !signed && contains(execBuiltins, name) {
+			return errors.Errorf("builtin (%s) denied for read-only clients in unsigned promises", name)
+		}
+
+		return nil
+	})
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// CheckRelay returns an error if p does not allow to relay to target.
+// Read-only clients may not relay, since the target cannot enforce it.
+func (p Policy) CheckRelay(target string) error {
+	if p.ReadOnly {
+		return errors.New("read-only clients may not relay")
+	}
+
+	if len(p.Relay) > 0 && !MatchTarget(p.Relay, target) {
+		return errors.Errorf("relay to %q not allowed", target)
+	}
+
+	return nil
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// MatchTarget reports whether target matches one of the
+// shell patterns in patterns, eg. *.internal.
+func MatchTarget(patterns []string, target string) bool {
+	for _, pattern := range patterns {
+		if ok, err := path.Match(pattern, target); err == nil && ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,63 @@
+package store
+
+import (
+	"testing"
+
+	"github.com/denkhaus/llconf/promise"
+)
+
+func TestPolicyCheck(t *testing.T) {
+	tree := promise.NamedPromise{
+		Name: "setup",
+		Promise: promise.AndPromise{Promises: []promise.Promise{
+			promise.ExecPromise{Type: promise.ExecTest, Arguments: []promise.Argument{promise.Constant("true")}},
+			promise.AsUser{UserName: promise.Constant("nobody"), Promise: promise.PipePromise{
+				Execs: []promise.ExecPromise{{Type: promise.ExecChange}},
+			}},
+		}},
+	}
+
+	tests := []struct {
+		policy Policy
+		signed bool
+		ok     bool
+	}{
+		{Policy{}, false, true},
+		{Policy{Roots: []string{"setup"}}, false, true},
+		{Policy{Roots: []string{"other"}}, false, false},
+		{Policy{Deny: []string{"asuser"}}, false, false},
+		{Policy{Deny: []string{"restart", "eval"}}, false, true},
+		{Policy{Builtins: []string{"and", "test", "asuser", "pipe"}}, false, false},
+		{Policy{Builtins: []string{"and", "test", "asuser", "pipe", "change"}}, false, true},
+		{Policy{ReadOnly: true}, false, false},
+		{Policy{ReadOnly: true}, true, true},
+	}
+
+	for i, test := range tests {
+		err := test.policy.Check(tree, test.signed)
+		if (err == nil) != test.ok {
+			t.Errorf("test %d: policy %s, unexpected result %v", i, test.policy, err)
+		}
+	}
+}
+
+func TestPolicyCheckRelay(t *testing.T) {
+	tests := []struct {
+		policy Policy
+		target string
+		ok     bool
+	}{
+		{Policy{}, "db1.internal", true},
+		{Policy{Relay: []string{"*.internal"}}, "db1.internal", true},
+		{Policy{Relay: []string{"*.internal"}}, "db1.example.com", false},
+		{Policy{Relay: []string{"web*", "db1.internal"}}, "db1.internal", true},
+		{Policy{ReadOnly: true}, "db1.internal", false},
+	}
+
+	for i, test := range tests {
+		err := test.policy.CheckRelay(test.target)
+		if (err == nil) != test.ok {
+			t.Errorf("test %d: policy %s, unexpected result %v", i, test.policy, err)
+		}
+	}
+}
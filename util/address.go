@@ -0,0 +1,115 @@
+package util
+
+import (
+	"fmt"
+	"net"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/juju/errors"
+)
+
+const (
+	unixScheme = "unix://"
+	sshScheme  = "ssh://"
+)
+
+var sshLoginChars = regexp.MustCompile(`^[A-Za-z0-9._@:%\[\]-]+$`)
+
+////////////////////////////////////////////////////////////////////////////////
+// Address is a network address the server listens on or the client
+// connects to, either a tcp host and port, the path of a unix socket
+// or an ssh login.
+type Address struct {
+	Network string
+	Addr    string
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// ParseAddress parses unix:///path/to/socket, ssh://[user@]host[:port],
+// tcp://host:port, host:port or a plain host, which gets port. IPv6
+// hosts are given with or without brackets, eg. [::1]:9954 or ::1.
+func ParseAddress(s string, port int) (Address, error) {
+	if strings.HasPrefix(s, sshScheme) {
+		login := strings.TrimPrefix(s, sshScheme)
+		if login == "" || strings.HasSuffix(login, "@") {
+			return Address{}, errors.Errorf("ssh address %q has no host", s)
+		}
+		return Address{Network: "ssh", Addr: login}, nil
+	}
+
+	if strings.HasPrefix(s, unixScheme) {
+		path := strings.TrimPrefix(s, unixScheme)
+		if !filepath.IsAbs(path) {
+			return Address{}, errors.Errorf("unix socket path %q is not absolute", path)
+		}
+		return Address{Network: "unix", Addr: filepath.Clean(path)}, nil
+	}
+
+	s = strings.TrimPrefix(s, "tcp://")
+	if s == "" {
+		return Address{}, errors.New("empty address")
+	}
+
+	if _, _, err := net.SplitHostPort(s); err == nil {
+		return Address{Network: "tcp", Addr: s}, nil
+	}
+
+	host := strings.TrimSuffix(strings.TrimPrefix(s, "["), "]")
+	return Address{Network: "tcp", Addr: net.JoinHostPort(host, fmt.Sprintf("%d", port))}, nil
+}
+
+////////////////////////////////////////////////////////////////////////////////
+func (a Address) String() string {
+	switch a.Network {
+	case "unix":
+		return unixScheme + a.Addr
+	case "ssh":
+		return sshScheme + a.Addr
+	}
+	return a.Addr
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// CheckLogin returns an error if a is an ssh login that is not a plain
+// [user@]host[:port], eg. contains whitespace or shell metacharacters,
+// or starts with -, which ssh would take as an option.
+func (a Address) CheckLogin() error {
+	if a.Network != "ssh" {
+		return nil
+	}
+
+	if !sshLoginChars.MatchString(a.Addr) {
+		return errors.Errorf("invalid ssh login %q", a.Addr)
+	}
+
+	login, host := "", a.Addr
+	if i := strings.LastIndex(a.Addr, "@"); i >= 0 {
+		login, host = a.Addr[:i], a.Addr[i+1:]
+	}
+
+	if strings.HasPrefix(login, "-") || strings.HasPrefix(strings.TrimPrefix(host, "["), "-") {
+		return errors.Errorf("invalid ssh login %q", a.Addr)
+	}
+
+	return nil
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// Host returns the host name of a tcp or ssh address without login, port
+// and brackets, or an empty string for unix sockets.
+func (a Address) Host() string {
+	host := a.Addr
+	switch a.Network {
+	case "unix":
+		return ""
+	case "ssh":
+		host = host[strings.LastIndex(host, "@")+1:]
+	}
+
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		return h
+	}
+	return strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+}
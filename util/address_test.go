@@ -0,0 +1,82 @@
+package util
+
+import "testing"
+
+func TestParseAddress(t *testing.T) {
+	tests := []struct {
+		in      string
+		network string
+		addr    string
+	}{
+		{"localhost", "tcp", "localhost:9954"},
+		{"web1:22", "tcp", "web1:22"},
+		{"tcp://10.0.0.1:80", "tcp", "10.0.0.1:80"},
+		{"::1", "tcp", "[::1]:9954"},
+		{"[::1]", "tcp", "[::1]:9954"},
+		{"[::]:9000", "tcp", "[::]:9000"},
+		{"unix:///run/llconf.sock", "unix", "/run/llconf.sock"},
+		{"ssh://root@web1:2222", "ssh", "root@web1:2222"},
+	}
+
+	for _, test := range tests {
+		addr, err := ParseAddress(test.in, 9954)
+		if err != nil {
+			t.Errorf("%q: %s", test.in, err)
+			continue
+		}
+		if addr.Network != test.network || addr.Addr != test.addr {
+			t.Errorf("%q: expected %s %s, got %s %s", test.in, test.network, test.addr, addr.Network, addr.Addr)
+		}
+	}
+
+	if _, err := ParseAddress("unix://run/llconf.sock", 9954); err == nil {
+		t.Error("expected error for relative socket path")
+	}
+}
+
+func TestCheckLogin(t *testing.T) {
+	tests := map[string]bool{
+		"ssh://root@web1":                   true,
+		"ssh://admin@[fd00::1]:22":          true,
+		"ssh://-oProxyCommand=touch":        false,
+		"ssh://root@-oProxyCommand=id":      false,
+		"ssh://root@web1;id":                false,
+		"ssh://root@web1 -oProxyCommand=id": false,
+		"ssh://root@$(id)":                  false,
+		"unix:///run/llconf.sock":           true,
+	}
+
+	for in, ok := range tests {
+		addr, err := ParseAddress(in, 9954)
+		if err != nil {
+			t.Errorf("%q: %s", in, err)
+			continue
+		}
+		if err := addr.CheckLogin(); (err == nil) != ok {
+			t.Errorf("%q: unexpected result %v", in, err)
+		}
+	}
+}
+
+func TestAddressHost(t *testing.T) {
+	tests := map[string]string{
+		"web1.internal":           "web1.internal",
+		"tcp://10.0.0.1:80":       "10.0.0.1",
+		"[::1]:9000":              "::1",
+		"ssh://root@web1:2222":    "web1",
+		"ssh://admin@[fd00::1]":   "fd00::1",
+		"ssh://web2":              "web2",
+		"unix:///run/llconf.sock": "",
+	}
+
+	for in, host := range tests {
+		addr, err := ParseAddress(in, 9954)
+		if err != nil {
+			t.Errorf("%q: %s", in, err)
+			continue
+		}
+		if h := addr.Host(); h != host {
+			t.Errorf("%q: expected host %q, got %q", in, host, h)
+		}
+	}
+}
@@ -2,30 +2,55 @@ package util
 
 import (
 	"net"
+	"os"
 	"time"
+
+	"github.com/juju/errors"
 )
 
 ////////////////////////////////////////////////////////////////////////////////
+// TimeoutListener returns from Accept every second, so the accept
+// loop is able to check whether it has to stop.
 type TimeoutListener struct {
-	*net.TCPListener
+	net.Listener
 }
 
 ////////////////////////////////////////////////////////////////////////////////
 func (ln *TimeoutListener) Accept() (c net.Conn, err error) {
-	ln.SetDeadline(time.Now().Add(1 * time.Second))
+	if d, ok := ln.Listener.(interface {
+		SetDeadline(time.Time) error
+	}); ok {
+		d.SetDeadline(time.Now().Add(1 * time.Second))
+	}
 
-	tc, err := ln.AcceptTCP()
+	c, err = ln.Listener.Accept()
 	if err != nil {
 		return nil, err
 	}
-	tc.SetKeepAlive(true)
-	tc.SetKeepAlivePeriod(3 * time.Minute)
 
-	return tc, nil
+	if tc, ok := c.(*net.TCPConn); ok {
+		tc.SetKeepAlive(true)
+		tc.SetKeepAlivePeriod(3 * time.Minute)
+	}
+
+	return c, nil
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// File returns a copy of the underlying file descriptor,
+// so the listener can be passed to a restarted process.
+func (ln *TimeoutListener) File() (*os.File, error) {
+	if f, ok := ln.Listener.(interface {
+		File() (*os.File, error)
+	}); ok {
+		return f.File()
+	}
+
+	return nil, errors.Errorf("%s listener has no file", ln.Addr().Network())
 }
 
 ////////////////////////////////////////////////////////////////////////////////
-func NewTimeoutListener(inner *net.TCPListener) *TimeoutListener {
+func NewTimeoutListener(inner net.Listener) *TimeoutListener {
 	tl := TimeoutListener{inner}
 	return &tl
 }
@@ -0,0 +1,44 @@
+package util
+
+import (
+	"io"
+	"net"
+	"time"
+)
+
+////////////////////////////////////////////////////////////////////////////////
+// pipeConn is a net.Conn reading from r and writing to w,
+// eg. the stdio of a process.
+type pipeConn struct {
+	io.Reader
+	io.Writer
+	addr    pipeAddr
+	onClose func() error
+}
+
+// NewPipeConn returns a connection reading from r and writing to w. On
+// Close w is closed and onClose is called, if set. addr names the peer.
+func NewPipeConn(r io.Reader, w io.WriteCloser, addr string, onClose func() error) net.Conn {
+	return &pipeConn{Reader: r, Writer: w, addr: pipeAddr(addr), onClose: onClose}
+}
+
+func (c *pipeConn) Close() error {
+	err := c.Writer.(io.Closer).Close()
+	if c.onClose != nil {
+		if closeErr := c.onClose(); err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+func (c *pipeConn) LocalAddr() net.Addr                { return c.addr }
+func (c *pipeConn) RemoteAddr() net.Addr               { return c.addr }
+func (c *pipeConn) SetDeadline(t time.Time) error      { return nil }
+func (c *pipeConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *pipeConn) SetWriteDeadline(t time.Time) error { return nil }
+
+type pipeAddr string
+
+func (a pipeAddr) Network() string { return "pipe" }
+func (a pipeAddr) String() string  { return string(a) }
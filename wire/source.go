@@ -0,0 +1,49 @@
+package wire
+
+import (
+	"encoding/json"
+
+	"github.com/juju/errors"
+)
+
+////////////////////////////////////////////////////////////////////////////////
+// Source is the manifest of a source bundle. It lists the files of an
+// input folder by their content hash, so the receiver compiles Root
+// itself and only needs the contents it has not cached yet.
+type Source struct {
+	Version     int          `json:"version"`
+	Root        string       `json:"root"`
+	Files       []SourceFile `json:"files"`
+	Attachments []SourceFile `json:"attachments,omitempty"`
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// SourceFile is a file of a source bundle, relative to the input folder,
+// or a file attached to a promise tree.
+type SourceFile struct {
+	Path string `json:"path"`
+	Hash string `json:"hash"`
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// EncodeSource returns the JSON encoding of the manifest s.
+func EncodeSource(s Source) ([]byte, error) {
+	s.Version = Version
+	return json.Marshal(s)
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// DecodeSource decodes a manifest encoded by EncodeSource.
+func DecodeSource(data []byte) (Source, error) {
+	s := Source{}
+	if err := json.Unmarshal(data, &s); err != nil {
+		return s, errors.Annotate(err, "unmarshal")
+	}
+
+	if s.Version > Version {
+		return s, errors.Errorf("protocol version %d not supported, highest supported version is %d",
+			s.Version, Version)
+	}
+
+	return s, nil
+}
@@ -0,0 +1,299 @@
+// Package wire defines the versioned JSON format promise trees are
+// sent in. Builtins are encoded by name with their string arguments
+// and nested promises and rebuilt with the New method of the builtin,
+// so the format does not depend on the fields of the promise structs.
+package wire
+
+import (
+	"encoding/json"
+	"sort"
+	"strings"
+
+	"github.com/denkhaus/llconf/compiler/parser"
+	"github.com/denkhaus/llconf/promise"
+	"github.com/juju/errors"
+)
+
+// Version is the protocol version written by Encode. It is
+// incremented whenever the meaning of encoded trees changes.
+const Version = 1
+
+// namedType marks nodes holding named promises.
+const namedType = "named"
+
+////////////////////////////////////////////////////////////////////////////////
+// Tree is an encoded promise tree. Builtins lists all builtins
+// used in Root, so receivers can reject trees they cannot evaluate
+// before decoding them. Attachments lists the files sent along
+// with the tree.
+type Tree struct {
+	Version     int          `json:"version"`
+	Builtins    []string     `json:"builtins"`
+	Root        Node         `json:"root"`
+	Attachments []SourceFile `json:"attachments,omitempty"`
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// Node is an encoded promise.
+type Node struct {
+	Type     string          `json:"type"`
+	Name     string          `json:"name,omitempty"`
+	Params   []promise.Param `json:"params,omitempty"`
+	Args     []Arg           `json:"args,omitempty"`
+	Children []Node          `json:"children,omitempty"`
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// Arg is an encoded string argument or getter.
+type Arg struct {
+	Type     string `json:"type"`
+	Value    string `json:"value,omitempty"`
+	Position int    `json:"position,omitempty"`
+	Optional bool   `json:"optional,omitempty"`
+	Args     []Arg  `json:"args,omitempty"`
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// Capabilities describes what a peer is able to evaluate.
+type Capabilities struct {
+	Version  int
+	Builtins []string
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// Local returns the capabilities of this build.
+func Local() Capabilities {
+	return Capabilities{Version: Version, Builtins: parser.BuiltinNames()}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// Check returns an error if the tree cannot be evaluated with c.
+func (c Capabilities) Check(tree Tree) error {
+	if tree.Version > c.Version {
+		return errors.Errorf("protocol version %d not supported, highest supported version is %d",
+			tree.Version, c.Version)
+	}
+
+	missing := []string{}
+	for _, name := range tree.Builtins {
+		found := false
+		for _, b := range c.Builtins {
+			if b == name {
+				found = true
+				break
+			}
+		}
+		if !found {
+			missing = append(missing, "("+name+")")
+		}
+	}
+
+	if len(missing) > 0 {
+		return errors.Errorf("unsupported builtins %s", strings.Join(missing, ", "))
+	}
+
+	return nil
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// Encode returns the JSON encoding of the promise tree root
+// and the files attached to it.
+func Encode(root promise.Promise, attachments []SourceFile) ([]byte, error) {
+	builtins := map[string]bool{}
+	node, err := encodeNode(root, builtins)
+	if err != nil {
+		return nil, err
+	}
+
+	tree := Tree{Version: Version, Builtins: []string{}, Root: node, Attachments: attachments}
+	for name := range builtins {
+		tree.Builtins = append(tree.Builtins, name)
+	}
+	sort.Strings(tree.Builtins)
+
+	return json.Marshal(tree)
+}
+
+func encodeNode(p promise.Promise, builtins map[string]bool) (Node, error) {
+	node := Node{}
+
+	if named, ok := p.(promise.NamedPromise); ok {
+		node.Type = namedType
+		node.Name = named.Name
+		node.Params = named.Params
+	} else {
+		node.Type = promise.BuiltinName(p)
+		if node.Type == "" {
+			return node, errors.Errorf("unable to encode promise of type %T", p)
+		}
+		builtins[node.Type] = true
+	}
+
+	for _, a := range promise.Arguments(p) {
+		arg, err := encodeArg(a)
+		if err != nil {
+			return node, err
+		}
+		node.Args = append(node.Args, arg)
+	}
+
+	for _, c := range promise.Children(p) {
+		child, err := encodeNode(c, builtins)
+		if err != nil {
+			return node, err
+		}
+		node.Children = append(node.Children, child)
+	}
+
+	return node, nil
+}
+
+func encodeArgs(args []promise.Argument) ([]Arg, error) {
+	encoded := []Arg{}
+	for _, a := range args {
+		arg, err := encodeArg(a)
+		if err != nil {
+			return nil, err
+		}
+		encoded = append(encoded, arg)
+	}
+
+	return encoded, nil
+}
+
+func encodeArg(a promise.Argument) (Arg, error) {
+	var err error
+
+	switch t := a.(type) {
+	case promise.Constant:
+		return Arg{Type: "const", Value: string(t)}, nil
+	case promise.ArgGetter:
+		return Arg{Type: "arg", Position: t.Position}, nil
+	case promise.ParamGetter:
+		return Arg{Type: "param", Value: t.Name, Position: t.Position}, nil
+	case promise.VarGetter:
+		return Arg{Type: "var", Value: t.Name, Optional: t.Optional}, nil
+	case promise.EnvGetter:
+		return Arg{Type: "env", Value: t.Name}, nil
+	case promise.FactGetter:
+		return Arg{Type: "fact", Value: t.Name}, nil
+	case promise.JoinArgument:
+		arg := Arg{Type: "join"}
+		arg.Args, err = encodeArgs(t.Args)
+		return arg, err
+	case promise.StringGetter:
+		arg := Arg{Type: "string", Value: t.Name}
+		arg.Args, err = encodeArgs(t.Args)
+		return arg, err
+	case promise.DefaultGetter:
+		arg := Arg{Type: "default"}
+		arg.Args, err = encodeArgs([]promise.Argument{t.Value, t.Fallback})
+		return arg, err
+	}
+
+	return Arg{}, errors.Errorf("unable to encode argument of type %T", a)
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// Decode decodes a tree encoded by Encode and returns it with its
+// attachments. The tree is checked against the local capabilities first.
+func Decode(data []byte) (promise.Promise, []SourceFile, error) {
+	tree := Tree{}
+	if err := json.Unmarshal(data, &tree); err != nil {
+		return nil, nil, errors.Annotate(err, "unmarshal")
+	}
+
+	if err := Local().Check(tree); err != nil {
+		return nil, nil, err
+	}
+
+	root, err := decodeNode(tree.Root)
+	return root, tree.Attachments, err
+}
+
+func decodeNode(node Node) (promise.Promise, error) {
+	args, err := decodeArgs(node.Args)
+	if err != nil {
+		return nil, err
+	}
+
+	children := []promise.Promise{}
+	for _, c := range node.Children {
+		child, err := decodeNode(c)
+		if err != nil {
+			return nil, err
+		}
+		children = append(children, child)
+	}
+
+	if node.Type == namedType {
+		if len(children) != 1 {
+			return nil, errors.Errorf("named promise %q needs exactly one nested promise", node.Name)
+		}
+
+		return promise.NamedPromise{
+			Name:      node.Name,
+			Promise:   children[0],
+			Arguments: args,
+			Params:    node.Params,
+		}, nil
+	}
+
+	builtin, ok := parser.Builtin(node.Type)
+	if !ok {
+		return nil, errors.Errorf("unsupported builtin (%s)", node.Type)
+	}
+
+	p, err := builtin.New(children, args)
+	if err != nil {
+		return nil, errors.Annotatef(err, "decode (%s)", node.Type)
+	}
+
+	return p, nil
+}
+
+func decodeArgs(encoded []Arg) ([]promise.Argument, error) {
+	args := []promise.Argument{}
+	for _, a := range encoded {
+		arg, err := decodeArg(a)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, arg)
+	}
+
+	return args, nil
+}
+
+func decodeArg(a Arg) (promise.Argument, error) {
+	switch a.Type {
+	case "const":
+		return promise.Constant(a.Value), nil
+	case "arg":
+		return promise.ArgGetter{Position: a.Position}, nil
+	case "param":
+		return promise.ParamGetter{Name: a.Value, Position: a.Position}, nil
+	case "var":
+		return promise.VarGetter{Name: a.Value, Optional: a.Optional}, nil
+	case "env":
+		return promise.EnvGetter{Name: a.Value}, nil
+	case "fact":
+		return promise.FactGetter{Name: a.Value}, nil
+	}
+
+	args, err := decodeArgs(a.Args)
+	if err != nil {
+		return nil, err
+	}
+
+	switch a.Type {
+	case "join":
+		return promise.JoinArgument{Args: args}, nil
+	case "string":
+		return promise.NewStringGetter(a.Value, args)
+	case "default":
+		return promise.NewDefaultGetter(args)
+	}
+
+	return nil, errors.Errorf("unsupported argument type %q", a.Type)
+}
@@ -0,0 +1,97 @@
+package wire
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/denkhaus/llconf/compiler/parser"
+	"github.com/denkhaus/llconf/promise"
+)
+
+const source = `
+(done
+	(and
+		(setvar "dir" "/tmp")
+		(readvar "user" (test "whoami"))
+		(if (test "true") (info "yes") (warn "no"))
+		(when (not (false (test "false"))) (true (error [var?:missing])))
+		(foreach "item" "a,b" "continue" (site [var:item]))
+		(indir [var:dir] (setenv "LANG" [env:LANG] (change "touch" [fact:hostname])))
+		(pipe (test "echo" [join [var:dir] "/" [upper "x"]]) (test "cat"))
+		(spipe (test "echo") (test "cat"))
+		(or (asuser "nobody" (test "id")) (restart))
+		(template "{}" "in.tmpl" [default [var?:out] "out"])
+		(eval "done" "/srv/promises")))
+
+(site (params "name" "port=80")
+	(test "echo" [param:name] [param:port] [split "a.b" "." "-1"]))
+`
+
+func TestRoundTrip(t *testing.T) {
+	promises, err := parser.Parse([]parser.Input{{File: "main.cnf", String: source}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	root := promises["done"]
+	attachments := []SourceFile{{Path: "site.tmpl", Hash: "00"}}
+	data, err := Encode(root, attachments)
+	if err != nil {
+		t.Fatalf("encode: %s", err)
+	}
+
+	decoded, decodedAttachments, err := Decode(data)
+	if err != nil {
+		t.Fatalf("decode: %s", err)
+	}
+
+	if len(decodedAttachments) != 1 || decodedAttachments[0] != attachments[0] {
+		t.Errorf("attachments differ: %v", decodedAttachments)
+	}
+
+	again, err := Encode(decoded, attachments)
+	if err != nil {
+		t.Fatalf("encode decoded: %s", err)
+	}
+
+	if string(data) != string(again) {
+		t.Errorf("decoded tree differs:\n%s\n%s", data, again)
+	}
+
+	if root.Desc(nil) != decoded.Desc(nil) {
+		t.Errorf("decoded tree differs:\n%s\n%s", root.Desc(nil), decoded.Desc(nil))
+	}
+}
+
+func TestUnsupported(t *testing.T) {
+	data, err := json.Marshal(Tree{
+		Version:  Version,
+		Builtins: []string{"test", "teleport"},
+		Root:     Node{Type: "teleport"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, _, err = Decode(data)
+	if err == nil || !strings.Contains(err.Error(), "unsupported builtins (teleport)") {
+		t.Errorf("expected unsupported builtin error, got %v", err)
+	}
+
+	data, _ = json.Marshal(Tree{Version: Version + 1, Root: Node{Type: "true"}})
+	if _, _, err := Decode(data); err == nil {
+		t.Error("expected newer protocol version to fail")
+	}
+}
+
+func TestEncodeUnknown(t *testing.T) {
+	tree := promise.NamedPromise{Name: "done", Promise: promise.AndPromise{
+		Promises: []promise.Promise{unknown{}}}}
+
+	if _, err := Encode(tree, nil); err == nil {
+		t.Error("expected unknown promise to fail")
+	}
+}
+
+type unknown struct{ promise.TruePromise }